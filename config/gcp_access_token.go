@@ -0,0 +1,212 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// the timeout for running access_token_command
+	accessTokenCommandTimeout = time.Minute
+	// how long a token returned by access_token_command without an expiry is used before the command is run again
+	accessTokenCommandDefaultLifetime = 5 * time.Minute
+)
+
+// ErrAccessTokenExpired is returned by [GcpConnection.AuthError] for requests rejected as unauthenticated,
+// which is usually because the access token has expired
+var ErrAccessTokenExpired = errors.New("access token expired or invalid")
+
+// accessTokenOutput is the JSON output of access_token_command, or the JSON contents of access_token_file
+// - the gcloud config config-helper --format=json output, with the token in credential, is also supported
+type accessTokenOutput struct {
+	AccessToken string `json:"access_token"`
+	// the number of seconds until the token expires
+	ExpiresIn int64 `json:"expires_in"`
+	// the RFC 3339 expiry time of the token
+	Expiry      string `json:"expiry"`
+	TokenExpiry string `json:"token_expiry"`
+	Credential  *struct {
+		AccessToken string `json:"access_token"`
+		TokenExpiry string `json:"token_expiry"`
+	} `json:"credential"`
+}
+
+// parseAccessToken parses an access token, which is either the token alone or an accessTokenOutput
+// the token itself is never included in the error
+func parseAccessToken(data []byte) (*oauth2.Token, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, fmt.Errorf("no access token")
+	}
+
+	if data[0] != '{' {
+		if bytes.ContainsAny(data, " \t\r\n") {
+			return nil, fmt.Errorf("expected an access token or a JSON object with an access_token")
+		}
+		return &oauth2.Token{AccessToken: string(data), TokenType: "Bearer"}, nil
+	}
+
+	var output accessTokenOutput
+	if err := json.Unmarshal(data, &output); err != nil {
+		return nil, fmt.Errorf("expected an access token or a JSON object with an access_token")
+	}
+	accessToken, expiry := output.AccessToken, output.Expiry
+	if expiry == "" {
+		expiry = output.TokenExpiry
+	}
+	if output.Credential != nil && accessToken == "" {
+		accessToken, expiry = output.Credential.AccessToken, output.Credential.TokenExpiry
+	}
+	if accessToken == "" {
+		return nil, fmt.Errorf("no access_token")
+	}
+
+	token := &oauth2.Token{AccessToken: accessToken, TokenType: "Bearer"}
+	switch {
+	case expiry != "":
+		t, err := time.Parse(time.RFC3339, expiry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry %s, expected an RFC 3339 time", expiry)
+		}
+		token.Expiry = t
+	case output.ExpiresIn > 0:
+		token.Expiry = time.Now().Add(time.Duration(output.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+// accessTokenCommandSource is an oauth2.TokenSource which runs access_token_command for each token
+// it is wrapped in an oauth2.ReuseTokenSource, so the command is only run when the token expires
+type accessTokenCommandSource struct {
+	command string
+}
+
+func (s *accessTokenCommandSource) Token() (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), accessTokenCommandTimeout)
+	defer cancel()
+
+	stdout, err := runCommand(ctx, s.command)
+	if err != nil {
+		return nil, fmt.Errorf("error running access_token_command: %w", err)
+	}
+
+	token, err := parseAccessToken(stdout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access_token_command output: %w", err)
+	}
+	if token.Expiry.IsZero() {
+		token.Expiry = time.Now().Add(accessTokenCommandDefaultLifetime)
+	}
+	return token, nil
+}
+
+// runCommand runs the command in the shell and returns its output - neither the output nor the standard error of
+// the command, where credential helpers commonly echo tokens, is included in the error
+func runCommand(ctx context.Context, command string) ([]byte, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// accessTokenFileSource is an oauth2.TokenSource which reads the token from access_token_file - the file is
+// read again whenever it changes, so a token rotated by another process is used as soon as it is written
+type accessTokenFileSource struct {
+	path string
+
+	mut     sync.Mutex
+	token   *oauth2.Token
+	modTime time.Time
+	size    int64
+}
+
+func newAccessTokenFileSource(path string) (*accessTokenFileSource, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access_token_file: %w", err)
+	}
+	return &accessTokenFileSource{path: path}, nil
+}
+
+func (s *accessTokenFileSource) Token() (*oauth2.Token, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading access_token_file: %w", err)
+	}
+	if s.token == nil || !info.ModTime().Equal(s.modTime) || info.Size() != s.size {
+		data, err := os.ReadFile(s.path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading access_token_file: %w", err)
+		}
+		token, err := parseAccessToken(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access_token_file %s: %w", s.path, err)
+		}
+		s.token, s.modTime, s.size = token, info.ModTime(), info.Size()
+	}
+
+	if !s.token.Expiry.IsZero() && time.Now().After(s.token.Expiry) {
+		return nil, fmt.Errorf("%w: the token in access_token_file %s expired at %s and the file has not been rotated", ErrAccessTokenExpired, s.path, s.token.Expiry.Format(time.RFC3339))
+	}
+	return s.token, nil
+}
+
+// AuthError returns the error wrapped with ErrAccessTokenExpired, and what to do about it for the authentication
+// configured, if the error is a request rejected as unauthenticated (HTTP 401) - otherwise the error is returned as is
+func (c *GcpConnection) AuthError(err error) error {
+	if err == nil || errors.Is(err, ErrAccessTokenExpired) || !isUnauthenticated(err) {
+		return err
+	}
+
+	var action string
+	switch {
+	case c.ImpersonateAccessToken != nil:
+		action = "impersonate_access_token is a static token which cannot be refreshed - generate a new token, or set access_token_command or access_token_file so the token is refreshed"
+	case c.AccessTokenCommand != nil:
+		action = "check access_token_command returns a valid token, and the expiry of the token if it returns one"
+	case c.AccessTokenFile != nil:
+		action = fmt.Sprintf("check access_token_file %s is being rotated before the token expires", *c.AccessTokenFile)
+	default:
+		action = "check the credentials are valid and have not been revoked"
+	}
+	return fmt.Errorf("%w: %s: %w", ErrAccessTokenExpired, action, err)
+}
+
+// isUnauthenticated returns whether the error is a request rejected as unauthenticated by a JSON or gRPC API
+func isUnauthenticated(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusUnauthorized
+	}
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return retrieveErr.Response != nil && retrieveErr.Response.StatusCode == http.StatusUnauthorized
+	}
+	return status.Code(err) == codes.Unauthenticated
+}
@@ -0,0 +1,266 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	htransport "google.golang.org/api/transport/http"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseAccessToken(t *testing.T) {
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		data       string
+		wantToken  string
+		wantExpiry time.Time
+		// for expires_in, the expiry is relative to now
+		wantExpiresIn time.Duration
+		wantErr       string
+	}{
+		{
+			name:      "token",
+			data:      "ya29.token\n",
+			wantToken: "ya29.token",
+		},
+		{
+			name:       "json with expiry",
+			data:       `{"access_token":"ya29.token","expiry":"2030-01-02T03:04:05Z"}`,
+			wantToken:  "ya29.token",
+			wantExpiry: expiry,
+		},
+		{
+			name:          "json with expires_in",
+			data:          `{"access_token":"ya29.token","expires_in":3599}`,
+			wantToken:     "ya29.token",
+			wantExpiresIn: 3599 * time.Second,
+		},
+		{
+			name:       "gcloud config-helper",
+			data:       `{"configuration":{"active_configuration":"default"},"credential":{"access_token":"ya29.token","token_expiry":"2030-01-02T03:04:05Z"}}`,
+			wantToken:  "ya29.token",
+			wantExpiry: expiry,
+		},
+		{
+			name:    "empty",
+			data:    " \n",
+			wantErr: "no access token",
+		},
+		{
+			name:    "more than one line",
+			data:    "Updated property [core/project].\nya29.token",
+			wantErr: "expected an access token or a JSON object with an access_token",
+		},
+		{
+			name:    "json without access token",
+			data:    `{"token":"ya29.token"}`,
+			wantErr: "no access_token",
+		},
+		{
+			name:    "invalid expiry",
+			data:    `{"access_token":"ya29.token","expiry":"tomorrow"}`,
+			wantErr: "invalid expiry tomorrow",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := parseAccessToken([]byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want an error containing %q", err, tt.wantErr)
+				}
+				if strings.Contains(err.Error(), "ya29.token") {
+					t.Errorf("error %q contains the token", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if token.AccessToken != tt.wantToken {
+				t.Errorf("got token %q, want %q", token.AccessToken, tt.wantToken)
+			}
+			wantExpiry := tt.wantExpiry
+			if tt.wantExpiresIn != 0 {
+				wantExpiry = time.Now().Add(tt.wantExpiresIn)
+			}
+			if diff := token.Expiry.Sub(wantExpiry).Abs(); diff > time.Minute {
+				t.Errorf("got expiry %s, want %s", token.Expiry, wantExpiry)
+			}
+		})
+	}
+}
+
+// tokenClient makes requests with the client options of the connection, returning the Authorization header of each
+type tokenClient struct {
+	client *http.Client
+	api    *httptest.Server
+
+	mut    sync.Mutex
+	header string
+}
+
+func newTokenClient(t *testing.T, c *GcpConnection) *tokenClient {
+	t.Helper()
+
+	tc := &tokenClient{}
+	tc.api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tc.mut.Lock()
+		defer tc.mut.Unlock()
+		tc.header = r.Header.Get("Authorization")
+	}))
+	t.Cleanup(tc.api.Close)
+
+	ctx := context.Background()
+	opts, err := c.GetClientOptions(ctx, StorageAPI)
+	if err != nil {
+		t.Fatalf("error getting client options: %s", err)
+	}
+	tc.client, _, err = htransport.NewClient(ctx, opts...)
+	if err != nil {
+		t.Fatalf("error creating client: %s", err)
+	}
+	return tc
+}
+
+func (tc *tokenClient) authorizationHeader() (string, error) {
+	resp, err := tc.client.Get(tc.api.URL)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	tc.mut.Lock()
+	defer tc.mut.Unlock()
+	return tc.header, nil
+}
+
+func TestAccessTokenCommand(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("requires sh")
+	}
+
+	// the token expires immediately, so the command is run for every request
+	tokenFile := writeFile(t, "token.json", `{"access_token":"first-token","expires_in":1}`)
+	command := "cat " + tokenFile
+	tc := newTokenClient(t, &GcpConnection{AccessTokenCommand: &command})
+
+	for _, want := range []string{"first-token", "second-token"} {
+		if err := os.WriteFile(tokenFile, []byte(fmt.Sprintf(`{"access_token":%q,"expires_in":1}`, want)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := tc.authorizationHeader()
+		if err != nil {
+			t.Fatalf("error making request: %s", err)
+		}
+		if got != "Bearer "+want {
+			t.Errorf("got Authorization %q, want %q", got, "Bearer "+want)
+		}
+	}
+
+	// helpers may echo the token to standard error, so it is not included in the error
+	failing := "echo 'secret-token' >&2; exit 1"
+	tc = newTokenClient(t, &GcpConnection{AccessTokenCommand: &failing})
+	if _, err := tc.authorizationHeader(); err == nil || !strings.Contains(err.Error(), "error running access_token_command: exit status 1") || strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("got error %v, want the access_token_command error without its standard error", err)
+	}
+}
+
+func TestAccessTokenFile(t *testing.T) {
+	tokenFile := writeFile(t, "token", "first-token")
+	tc := newTokenClient(t, &GcpConnection{AccessTokenFile: &tokenFile})
+
+	// the file is read again when it is rotated
+	for _, want := range []string{"first-token", "rotated-token"} {
+		if err := os.WriteFile(tokenFile, []byte(want), 0600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := tc.authorizationHeader()
+		if err != nil {
+			t.Fatalf("error making request: %s", err)
+		}
+		if got != "Bearer "+want {
+			t.Errorf("got Authorization %q, want %q", got, "Bearer "+want)
+		}
+	}
+
+	// a token which has expired without the file being rotated is reported as expired
+	expired := fmt.Sprintf(`{"access_token":"expired-token","expiry":%q}`, time.Now().Add(-time.Minute).UTC().Format(time.RFC3339))
+	if err := os.WriteFile(tokenFile, []byte(expired), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := tc.authorizationHeader()
+	if !errors.Is(err, ErrAccessTokenExpired) || !strings.Contains(err.Error(), "the file has not been rotated") {
+		t.Errorf("got error %v, want an expired token error", err)
+	}
+}
+
+func TestAuthError(t *testing.T) {
+	accessToken := "ya29.token"
+	tokenFile := "/var/run/secrets/token"
+
+	unauthenticated := &googleapi.Error{Code: http.StatusUnauthorized, Message: "Request had invalid authentication credentials."}
+	tests := []struct {
+		name       string
+		conn       GcpConnection
+		err        error
+		wantAction string
+	}{
+		{
+			name:       "static access token",
+			conn:       GcpConnection{ImpersonateAccessToken: &accessToken},
+			err:        fmt.Errorf("error listing objects, %w", unauthenticated),
+			wantAction: "impersonate_access_token is a static token which cannot be refreshed",
+		},
+		{
+			name:       "access token file",
+			conn:       GcpConnection{AccessTokenFile: &tokenFile},
+			err:        errors.Join(errors.New("other error"), unauthenticated),
+			wantAction: "check access_token_file /var/run/secrets/token is being rotated",
+		},
+		{
+			name:       "grpc",
+			conn:       GcpConnection{},
+			err:        fmt.Errorf("error fetching log entries after 0 retries, %w", status.Error(codes.Unauthenticated, "invalid credentials")),
+			wantAction: "check the credentials are valid",
+		},
+		{
+			name: "permission denied",
+			conn: GcpConnection{ImpersonateAccessToken: &accessToken},
+			err:  &googleapi.Error{Code: http.StatusForbidden},
+		},
+		{
+			name: "nil",
+			conn: GcpConnection{ImpersonateAccessToken: &accessToken},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.conn.AuthError(tt.err)
+			if tt.wantAction == "" {
+				if got != tt.err {
+					t.Errorf("got error %v, want %v", got, tt.err)
+				}
+				return
+			}
+			if !errors.Is(got, ErrAccessTokenExpired) || !errors.Is(got, tt.err) {
+				t.Errorf("got error %v, want it to wrap ErrAccessTokenExpired and %v", got, tt.err)
+			}
+			if !strings.Contains(got.Error(), tt.wantAction) {
+				t.Errorf("got error %v, want an error containing %q", got, tt.wantAction)
+			}
+		})
+	}
+}
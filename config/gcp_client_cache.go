@@ -0,0 +1,82 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// clientCache is the cache of the clients created by GetClient, keyed by the connection and client key
+var clientCache = struct {
+	sync.Mutex
+	clients map[string]any
+}{clients: make(map[string]any)}
+
+// GetClient returns the client of the connection with the key, e.g. the API and any options specific to the client,
+// creating it with newClient if it is not cached
+//
+// Clients are shared by all the sources using a connection with the same attributes, so the credentials, token source
+// and connection pools are reused across partitions. They must not be closed by the sources - they are closed by
+// CloseClients when the plugin shuts down.
+func GetClient[T any](ctx context.Context, c *GcpConnection, key string, newClient func(context.Context) (T, error)) (T, error) {
+	var empty T
+	connectionKey, err := c.cacheKey()
+	if err != nil {
+		return empty, err
+	}
+	key = connectionKey + "/" + key
+
+	clientCache.Lock()
+	defer clientCache.Unlock()
+
+	if client, ok := clientCache.clients[key]; ok {
+		typed, ok := client.(T)
+		if !ok {
+			return empty, fmt.Errorf("cached GCP client is a %T, expected a %T", client, empty)
+		}
+		return typed, nil
+	}
+
+	// the client outlives the collection it is created for, so must not be cancelled with it
+	client, err := newClient(context.WithoutCancel(ctx))
+	if err != nil {
+		return empty, err
+	}
+	clientCache.clients[key] = client
+	return client, nil
+}
+
+// CloseClients closes all the clients cached by GetClient
+func CloseClients() error {
+	clientCache.Lock()
+	defer clientCache.Unlock()
+
+	var errs []error
+	for _, client := range clientCache.clients {
+		if closer, ok := client.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	slog.Debug("Closed GCP clients", "clients", len(clientCache.clients), "errors", len(errs))
+	clientCache.clients = make(map[string]any)
+	return errors.Join(errs...)
+}
+
+// cacheKey returns a hash of the connection attributes, so clients are only shared by connections which resolve
+// the same client options - the attributes include credentials, so are hashed rather than used as the key
+func (c *GcpConnection) cacheKey() (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("error creating GCP client cache key: %w", err)
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
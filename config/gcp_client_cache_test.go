@@ -0,0 +1,67 @@
+package config
+
+import (
+	"context"
+	"testing"
+)
+
+type fakeClient struct {
+	closed bool
+}
+
+func (f *fakeClient) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestGetClient(t *testing.T) {
+	t.Cleanup(func() { _ = CloseClients() })
+
+	var created int
+	newClient := func(ctx context.Context) (*fakeClient, error) {
+		if ctx.Done() != nil {
+			t.Error("client created with a cancellable context")
+		}
+		created++
+		return &fakeClient{}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	project, otherProject := "my-project", "other-project"
+
+	client, err := GetClient(ctx, &GcpConnection{Project: &project}, "test", newClient)
+	if err != nil {
+		t.Fatalf("GetClient() error = %v", err)
+	}
+	// a connection with the same attributes shares the client
+	if shared, _ := GetClient(ctx, &GcpConnection{Project: &project}, "test", newClient); shared != client {
+		t.Error("GetClient() created a new client for a connection with the same attributes")
+	}
+	// a connection with different attributes, or a different key, does not
+	if other, _ := GetClient(ctx, &GcpConnection{Project: &otherProject}, "test", newClient); other == client {
+		t.Error("GetClient() shared the client with a connection with different attributes")
+	}
+	if other, _ := GetClient(ctx, &GcpConnection{Project: &project}, "other", newClient); other == client {
+		t.Error("GetClient() shared the client for a different key")
+	}
+	if created != 3 {
+		t.Errorf("created %d clients, want 3", created)
+	}
+
+	if _, err := GetClient(ctx, &GcpConnection{Project: &project}, "test", func(context.Context) (*GcpConnection, error) {
+		return &GcpConnection{}, nil
+	}); err == nil {
+		t.Error("GetClient() returned a cached client of another type")
+	}
+
+	if err := CloseClients(); err != nil {
+		t.Fatalf("CloseClients() error = %v", err)
+	}
+	if !client.closed {
+		t.Error("CloseClients() did not close the client")
+	}
+	if recreated, _ := GetClient(ctx, &GcpConnection{Project: &project}, "test", newClient); recreated == client {
+		t.Error("GetClient() returned a closed client")
+	}
+}
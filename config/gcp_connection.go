@@ -3,125 +3,313 @@ package config
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
 
-	"github.com/mitchellh/go-homedir"
 	"golang.org/x/oauth2"
-	"google.golang.org/api/impersonate"
+	"golang.org/x/oauth2/google"
 	"google.golang.org/api/option"
 )
 
 const PluginName = "gcp"
 
+// the OAuth scope requested for all credentials
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
 type GcpConnection struct {
 	Project                   *string `json:"project" hcl:"project"`
 	Credentials               *string `json:"credentials" hcl:"credentials"`
 	QuotaProject              *string `json:"quota_project" hcl:"quota_project"`
 	ImpersonateAccessToken    *string `json:"impersonate_access_token" hcl:"impersonate_access_token"`
 	ImpersonateServiceAccount *string `json:"impersonate_service_account" hcl:"impersonate_service_account"`
+	// the chain of service accounts used to impersonate impersonate_service_account - the credentials must be able
+	// to create tokens for the first delegate, and each delegate for the next
+	ImpersonateDelegates []string `json:"impersonate_delegates" hcl:"impersonate_delegates,optional"`
+	// the lifetime of the access tokens of impersonate_service_account, e.g. 30m - defaults to 1h
+	ImpersonateTokenLifetime *string `json:"impersonate_token_lifetime" hcl:"impersonate_token_lifetime"`
+	// the OAuth scopes of the access tokens - defaults to the cloud-platform scope
+	Scopes []string `json:"scopes" hcl:"scopes,optional"`
+	// a command which prints an access token, run again whenever the token expires, e.g. gcloud auth print-access-token
+	AccessTokenCommand *string `json:"access_token_command" hcl:"access_token_command"`
+	// a file containing an access token, read again whenever it changes, e.g. a token rotated by a sidecar
+	AccessTokenFile *string `json:"access_token_file" hcl:"access_token_file"`
+	// the universe domain of the APIs, e.g. for a sovereign cloud - defaults to googleapis.com
+	UniverseDomain *string `json:"universe_domain" hcl:"universe_domain"`
+	// the Cloud Logging API endpoint, e.g. a Private Service Connect endpoint
+	LoggingEndpoint *string `json:"logging_endpoint" hcl:"logging_endpoint"`
+	// the Cloud Storage JSON API endpoint, e.g. a Private Service Connect endpoint
+	StorageEndpoint *string `json:"storage_endpoint" hcl:"storage_endpoint"`
+	// the URL of the proxy all requests are made through
+	HttpsProxy *string `json:"https_proxy" hcl:"https_proxy"`
+	// the path to a PEM file of CA certificates trusted in addition to the system certificates, e.g. for a TLS inspecting proxy
+	CaBundle *string `json:"ca_bundle" hcl:"ca_bundle"`
+	// if true, requests are not authenticated, e.g. for a local emulator
+	WithoutAuthentication *bool `json:"without_authentication" hcl:"without_authentication"`
 }
 
+// project IDs are 6 to 30 lowercase letters, digits or hyphens, starting with a letter and not ending with a hyphen
+// (legacy domain-scoped project IDs are prefixed with the domain, e.g. example.com:my-project)
+var projectIdRegex = regexp.MustCompile(`^([a-z0-9.-]+\.[a-z]{2,}:)?[a-z][a-z0-9-]{4,28}[a-z0-9]$`)
+
+// service accounts have an email in a gserviceaccount.com domain, e.g. my-sa@my-project.iam.gserviceaccount.com,
+// or 123456789-compute@developer.gserviceaccount.com for the Compute Engine default service account
+var serviceAccountEmailRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*@[a-z0-9][a-z0-9.:-]*\.gserviceaccount\.com$`)
+
 func (c *GcpConnection) Validate() error {
-	return nil
-}
+	// the access token attributes and impersonate_service_account each determine the token used
+	var tokenAttributes []string
+	for name, value := range map[string]*string{
+		"impersonate_access_token":    c.ImpersonateAccessToken,
+		"access_token_command":        c.AccessTokenCommand,
+		"access_token_file":           c.AccessTokenFile,
+		"impersonate_service_account": c.ImpersonateServiceAccount,
+	} {
+		if value == nil {
+			continue
+		}
+		if *value == "" {
+			return fmt.Errorf("%s cannot be empty", name)
+		}
+		tokenAttributes = append(tokenAttributes, name)
+	}
+	slices.Sort(tokenAttributes)
+	switch {
+	case len(tokenAttributes) == 2:
+		return fmt.Errorf("%s cannot both be set", strings.Join(tokenAttributes, " and "))
+	case len(tokenAttributes) > 2:
+		return fmt.Errorf("only one of %s can be set", strings.Join(tokenAttributes, ", "))
+	}
 
-func (c *GcpConnection) Identifier() string {
-	return PluginName
-}
+	if c.Project != nil && !projectIdRegex.MatchString(*c.Project) {
+		return fmt.Errorf("invalid project %q, expected a project ID of 6 to 30 lowercase letters, digits or hyphens, starting with a letter", *c.Project)
+	}
+	if c.QuotaProject != nil && !projectIdRegex.MatchString(*c.QuotaProject) {
+		return fmt.Errorf("invalid quota_project %q, expected a project ID of 6 to 30 lowercase letters, digits or hyphens, starting with a letter", *c.QuotaProject)
+	}
+
+	if c.ImpersonateServiceAccount != nil && !serviceAccountEmailRegex.MatchString(*c.ImpersonateServiceAccount) {
+		return fmt.Errorf("invalid impersonate_service_account %q, expected a service account email, e.g. my-sa@my-project.iam.gserviceaccount.com", *c.ImpersonateServiceAccount)
+	}
+	if c.ImpersonateServiceAccount == nil && (len(c.ImpersonateDelegates) > 0 || c.ImpersonateTokenLifetime != nil) {
+		return fmt.Errorf("impersonate_delegates and impersonate_token_lifetime cannot be set without impersonate_service_account")
+	}
+	for _, delegate := range c.ImpersonateDelegates {
+		if !serviceAccountEmailRegex.MatchString(delegate) {
+			return fmt.Errorf("invalid impersonate_delegates %q, expected a service account email, e.g. my-sa@my-project.iam.gserviceaccount.com", delegate)
+		}
+	}
+	if c.ImpersonateTokenLifetime != nil {
+		lifetime, err := time.ParseDuration(*c.ImpersonateTokenLifetime)
+		if err != nil || lifetime < time.Second || lifetime > maxImpersonateTokenLifetime {
+			return fmt.Errorf("invalid impersonate_token_lifetime %s, expected a duration between 1s and %s, e.g. 30m", *c.ImpersonateTokenLifetime, maxImpersonateTokenLifetime)
+		}
+	}
 
-func (c *GcpConnection) GetProject() string {
-	// return if set
-	if c.Project != nil {
-		return *c.Project
+	if len(c.Scopes) > 0 && (c.ImpersonateAccessToken != nil || c.AccessTokenCommand != nil || c.AccessTokenFile != nil) {
+		return fmt.Errorf("scopes cannot be set with impersonate_access_token, access_token_command or access_token_file")
+	}
+	for _, scope := range c.Scopes {
+		if scope == "" {
+			return fmt.Errorf("scopes cannot contain an empty scope")
+		}
 	}
 
-	// else check environment variables
-	envVars := []string{"CLOUDSDK_CORE_PROJECT", "GCP_PROJECT"}
-	for _, envVar := range envVars {
-		if val, exists := os.LookupEnv(envVar); exists {
-			return val
+	if c.UniverseDomain != nil && (*c.UniverseDomain == "" || strings.ContainsAny(*c.UniverseDomain, ":/")) {
+		return fmt.Errorf("invalid universe_domain %q, expected a domain, e.g. googleapis.com", *c.UniverseDomain)
+	}
+	for name, endpoint := range map[string]*string{"logging_endpoint": c.LoggingEndpoint, "storage_endpoint": c.StorageEndpoint} {
+		if endpoint != nil && *endpoint == "" {
+			return fmt.Errorf("%s cannot be empty", name)
+		}
+	}
+	if c.HttpsProxy != nil {
+		if _, err := parseProxyURL(*c.HttpsProxy); err != nil {
+			return err
+		}
+	}
+	if c.CaBundle != nil {
+		if _, err := c.tlsConfig(); err != nil {
+			return err
 		}
 	}
 
-	// TODO: #connection is there another location to check for an active project?
+	// credentials are ignored without authentication
+	if c.Credentials != nil && !c.withoutAuthentication() {
+		if *c.Credentials == "" {
+			return fmt.Errorf("credentials cannot be empty")
+		}
+		contents, err := c.getCredentials()
+		if err != nil {
+			return fmt.Errorf("invalid credentials: %w", err)
+		}
+		// the credentials may be a service account key, so the contents are never included in the error
+		if _, err := parseCredentials(contents); err != nil {
+			return fmt.Errorf("invalid credentials: %w", err)
+		}
+	}
 
-	return ""
+	return nil
 }
 
-func (c *GcpConnection) GetClientOptions(ctx context.Context) ([]option.ClientOption, error) {
-	var opts []option.ClientOption
+func (c *GcpConnection) Identifier() string {
+	return PluginName
+}
 
-	// credentials
-	if c.Credentials != nil {
-		contents, err := c.pathOrContents(*c.Credentials)
-		if err != nil {
-			return opts, fmt.Errorf("error reading credentials file: %v", err)
-		}
-		opts = append(opts, option.WithCredentialsJSON([]byte(contents)))
+// GetClientOptions returns the options for a client of the API - the authentication, quota project and universe
+// domain, along with the endpoint, HTTPS proxy and CA bundle set for the API
+func (c *GcpConnection) GetClientOptions(ctx context.Context, api GcpAPI) ([]option.ClientOption, error) {
+	// the transport for requests through the proxy, trusting the CA bundle - nil if neither is set
+	baseTransport, err := c.baseTransport()
+	if err != nil {
+		return nil, err
+	}
+	if baseTransport != nil {
+		// tokens requested by the oauth2 package use the client in the context
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: baseTransport})
 	}
 
-	// quota project
+	authOpts, err := c.getAuthOptions(ctx, baseTransport)
+	if err != nil {
+		return nil, err
+	}
+
+	var settingsOpts []option.ClientOption
+	// quota project - requests without authentication are not billed to a quota project
 	qp := os.Getenv("GOOGLE_CLOUD_QUOTA_PROJECT")
 	if c.QuotaProject != nil {
 		qp = *c.QuotaProject
 	}
-	if qp != "" {
-		opts = append(opts, option.WithQuotaProject(qp))
+	if qp != "" && !c.withoutAuthentication() {
+		settingsOpts = append(settingsOpts, option.WithQuotaProject(qp))
+	}
+	if c.UniverseDomain != nil {
+		settingsOpts = append(settingsOpts, option.WithUniverseDomain(*c.UniverseDomain))
 	}
 
+	opts := slices.Concat(authOpts, settingsOpts)
+	if baseTransport != nil {
+		opts, err = c.transportOptions(ctx, api, baseTransport, authOpts, settingsOpts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if endpoint := c.getEndpoint(api); endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint))
+	}
+	return opts, nil
+}
+
+// getAuthOptions returns the client options which authenticate requests
+func (c *GcpConnection) getAuthOptions(ctx context.Context, baseTransport *http.Transport) ([]option.ClientOption, error) {
+	var opts []option.ClientOption
+
+	// no authentication - any credentials are ignored
+	if c.withoutAuthentication() {
+		return append(opts, option.WithoutAuthentication()), nil
+	}
+
+	switch {
 	// Impersonate access token authentication
-	if c.ImpersonateAccessToken != nil {
+	case c.ImpersonateAccessToken != nil:
 		tokenConfig := oauth2.Token{
 			AccessToken: *c.ImpersonateAccessToken,
 		}
 		staticTokenSource := oauth2.StaticTokenSource(&tokenConfig)
 
 		opts = append(opts, option.WithTokenSource(staticTokenSource))
-	}
 
-	// Impersonate storage account authentication
-	if c.ImpersonateServiceAccount != nil {
-		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
-			TargetPrincipal: *c.ImpersonateServiceAccount,
-			Scopes:          []string{"https://www.googleapis.com/auth/cloud-platform"},
-		})
+	// access token command authentication - the command is run again when the token expires
+	case c.AccessTokenCommand != nil:
+		ts := oauth2.ReuseTokenSource(nil, &accessTokenCommandSource{command: *c.AccessTokenCommand})
+
+		opts = append(opts, option.WithTokenSource(ts))
+
+	// access token file authentication - the file is read again when it changes
+	case c.AccessTokenFile != nil:
+		ts, err := newAccessTokenFileSource(*c.AccessTokenFile)
 		if err != nil {
 			return nil, err
 		}
 
 		opts = append(opts, option.WithTokenSource(ts))
+
+	// Impersonate service account authentication - the credentials, if set, otherwise the application default
+	// credentials, are used to generate access tokens for the service account
+	case c.ImpersonateServiceAccount != nil:
+		baseOpts := []option.ClientOption{option.WithScopes(cloudPlatformScope)}
+		if c.Credentials != nil {
+			credentialsOpt, err := c.credentialsOption(ctx, []string{cloudPlatformScope})
+			if err != nil {
+				return nil, err
+			}
+			baseOpts = append(baseOpts, credentialsOpt)
+		}
+		ts, err := c.impersonatedTokenSource(ctx, baseTransport, baseOpts)
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, option.WithTokenSource(ts))
+
+	// credentials
+	case c.Credentials != nil:
+		credentialsOpt, err := c.credentialsOption(ctx, c.GetScopes())
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, credentialsOpt)
+		if len(c.Scopes) > 0 {
+			opts = append(opts, option.WithScopes(c.Scopes...))
+		}
+
+	// application default credentials
+	default:
+		if len(c.Scopes) > 0 {
+			opts = append(opts, option.WithScopes(c.Scopes...))
+		}
 	}
 
 	return opts, nil
 }
 
-// TODO: #graza #refactor Determine where this actually belongs, maybe a useful util func? https://github.com/turbot/tailpipe-plugin-gcp/issues/17
-func (c *GcpConnection) pathOrContents(in string) (string, error) {
-	if len(in) == 0 {
-		return "", nil
+// credentialsOption returns the client option for the credentials, with the scopes
+func (c *GcpConnection) credentialsOption(ctx context.Context, scopes []string) (option.ClientOption, error) {
+	contents, err := c.getCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("error reading credentials: %w", err)
 	}
-
-	filePath := in
-
-	if filePath[0] == '~' {
-		var err error
-		filePath, err = homedir.Expand(filePath)
-		if err != nil {
-			return filePath, err
-		}
+	credentialsType, err := parseCredentials(contents)
+	if err != nil {
+		return nil, err
 	}
 
-	if _, err := os.Stat(filePath); err == nil {
-		contents, err := os.ReadFile(filePath)
+	switch credentialsType {
+	case credentialsTypeExternalAccount, credentialsTypeImpersonatedServiceAccount:
+		// create the credentials up front, so any error in the credential configuration is reported
+		// here, rather than on the first request
+		creds, err := google.CredentialsFromJSON(ctx, contents, scopes...)
 		if err != nil {
-			return string(contents), err
+			return nil, fmt.Errorf("error creating %s credentials: %w", credentialsType, err)
 		}
-		return string(contents), nil
+		return option.WithCredentials(creds), nil
+	default:
+		return option.WithCredentialsJSON(contents), nil
 	}
+}
 
-	if len(filePath) > 1 && (filePath[0] == '/' || filePath[0] == '\\') {
-		return "", fmt.Errorf("%s: no such file or dir", filePath)
+// GetScopes returns the OAuth scopes of the access tokens - defaults to the cloud-platform scope
+func (c *GcpConnection) GetScopes() []string {
+	if len(c.Scopes) == 0 {
+		return []string{cloudPlatformScope}
 	}
+	return c.Scopes
+}
 
-	return in, nil
+func (c *GcpConnection) withoutAuthentication() bool {
+	return c.WithoutAuthentication != nil && *c.WithoutAuthentication
 }
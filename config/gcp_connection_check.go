@@ -0,0 +1,273 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/api/transport"
+)
+
+// the permissions required to collect from the Cloud Logging API and Cloud Storage buckets
+var (
+	LoggingReadPermissions = []string{"logging.logEntries.list"}
+	StorageReadPermissions = []string{"storage.objects.list", "storage.objects.get"}
+	// the permissions needed to restore a soft-deleted object so it can be read, and delete the restored copy -
+	// the bucket is read to check its retention settings allow the restored copy to be deleted
+	StorageRestorePermissions = []string{"storage.buckets.get", "storage.objects.create", "storage.objects.delete"}
+)
+
+// the timeout for requesting the identity of the access token from the tokeninfo endpoint
+const tokenInfoTimeout = 30 * time.Second
+
+// the endpoints used by the connection check - overridden in tests
+var (
+	// the tokeninfo endpoint, which returns the identity of an access token
+	tokenInfoEndpoint = "https://oauth2.googleapis.com/tokeninfo"
+	// the Resource Manager API endpoint - an empty string is the default endpoint of the universe domain
+	resourceManagerEndpoint = ""
+)
+
+// resourceManagerAPI is the Resource Manager API (HTTP), used to test the permissions on projects
+const resourceManagerAPI GcpAPI = "cloudresourcemanager"
+
+// PermissionCheck is a set of IAM permissions the caller requires on a project or bucket
+type PermissionCheck struct {
+	Project     string
+	Bucket      string
+	Permissions []string
+	// the project billed for testing the permissions on a requester-pays bucket
+	UserProject string
+}
+
+// ProjectPermissions returns a check of the permissions on the project
+func ProjectPermissions(project string, permissions ...string) PermissionCheck {
+	return PermissionCheck{Project: project, Permissions: permissions}
+}
+
+// BucketPermissions returns a check of the permissions on the bucket
+func BucketPermissions(bucket string, permissions ...string) PermissionCheck {
+	return PermissionCheck{Bucket: bucket, Permissions: permissions}
+}
+
+// resource returns the name of the resource the permissions are checked on, e.g. projects/my-project or gs://my-bucket
+func (p PermissionCheck) resource() string {
+	if p.Bucket != "" {
+		return "gs://" + p.Bucket
+	}
+	return "projects/" + p.Project
+}
+
+// ConnectionCheck is the result of [GcpConnection.CheckConnection]
+type ConnectionCheck struct {
+	// the email of the caller, or if there is no email, the client ID - empty if it cannot be resolved
+	Identity string
+	// map of resource, e.g. projects/my-project or gs://my-bucket, to the permissions the caller is missing on it
+	MissingPermissions map[string][]string
+}
+
+// Err returns an error listing the missing permissions, or nil if the caller has all the permissions checked
+func (r *ConnectionCheck) Err() error {
+	if len(r.MissingPermissions) == 0 {
+		return nil
+	}
+
+	var missing []string
+	for resource, permissions := range r.MissingPermissions {
+		missing = append(missing, fmt.Sprintf("%s on %s", strings.Join(permissions, ", "), resource))
+	}
+	slices.Sort(missing)
+
+	identity := r.Identity
+	if identity == "" {
+		identity = "the caller"
+	}
+	return fmt.Errorf("%s is missing permissions: %s", identity, strings.Join(missing, "; "))
+}
+
+// CheckConnection verifies the connection can authenticate, resolving the identity of the caller, and tests which
+// of the permissions the caller is missing - sources call it when they are initialized, after the SDK validates the
+// connection, so a misconfigured connection fails before anything is collected
+//
+// An error is returned if the credentials cannot be used, or the permissions cannot be tested, e.g. because the
+// project or bucket does not exist - missing permissions are reported in the result. The project permissions are
+// not checked if the Resource Manager API is not enabled, and nothing is checked without authentication, e.g. for
+// an emulator.
+func (c *GcpConnection) CheckConnection(ctx context.Context, checks ...PermissionCheck) (*ConnectionCheck, error) {
+	result := &ConnectionCheck{MissingPermissions: make(map[string][]string)}
+
+	if c.withoutAuthentication() {
+		slog.Warn("GCP connection permissions are not checked without authentication")
+		return result, nil
+	}
+
+	identity, err := c.getIdentity(ctx)
+	if err != nil {
+		return nil, c.AuthError(err)
+	}
+	result.Identity = identity
+
+	for _, check := range checks {
+		var granted []string
+		var err error
+		if check.Bucket != "" {
+			granted, err = c.testBucketPermissions(ctx, check.Bucket, check.UserProject, check.Permissions)
+		} else {
+			granted, err = c.testProjectPermissions(ctx, check.Project, check.Permissions)
+			if isServiceDisabled(err) {
+				slog.Warn("GCP connection permissions are not checked on the project, the Resource Manager API is not enabled", "project", check.Project)
+				continue
+			}
+		}
+		if err != nil {
+			return nil, c.AuthError(fmt.Errorf("error testing permissions on %s: %w", check.resource(), err))
+		}
+
+		for _, permission := range check.Permissions {
+			if !slices.Contains(granted, permission) {
+				result.MissingPermissions[check.resource()] = append(result.MissingPermissions[check.resource()], permission)
+			}
+		}
+	}
+
+	slog.Info("Checked GCP connection", "identity", result.Identity, "missing_permissions", result.MissingPermissions)
+	return result, nil
+}
+
+// isServiceDisabled returns whether the error is because the API is not enabled in the project billed for the request
+func isServiceDisabled(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusForbidden {
+		return false
+	}
+	return slices.ContainsFunc(apiErr.Errors, func(item googleapi.ErrorItem) bool {
+		return item.Reason == "accessNotConfigured"
+	})
+}
+
+// getIdentity returns the email of the access token, or if it has no email, e.g. for a federated token,
+// the client ID
+func (c *GcpConnection) getIdentity(ctx context.Context) (string, error) {
+	client := &http.Client{Timeout: tokenInfoTimeout}
+	baseTransport, err := c.baseTransport()
+	if err != nil {
+		return "", err
+	}
+	if baseTransport != nil {
+		client.Transport = baseTransport
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
+	}
+
+	authOpts, err := c.getAuthOptions(ctx, baseTransport)
+	if err != nil {
+		return "", err
+	}
+	creds, err := transport.Creds(ctx, append(authOpts, option.WithScopes(c.GetScopes()...))...)
+	if err != nil {
+		return "", fmt.Errorf("error resolving credentials: %w", err)
+	}
+	token, err := creds.TokenSource.Token()
+	if err != nil {
+		return "", fmt.Errorf("error getting access token: %w", err)
+	}
+
+	// the token is sent in the request body, so it is not recorded in the URL by proxies or in errors
+	form := url.Values{"access_token": {token.AccessToken}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tokenInfoEndpoint(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error getting access token info: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("error getting access token info: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error getting access token info: status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var info struct {
+		Email string `json:"email"`
+		Azp   string `json:"azp"`
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return "", fmt.Errorf("error parsing access token info: %w", err)
+	}
+	if info.Email != "" {
+		return info.Email, nil
+	}
+	return info.Azp, nil
+}
+
+// tokenInfoEndpoint returns the tokeninfo endpoint in the universe domain
+func (c *GcpConnection) tokenInfoEndpoint() string {
+	if c.UniverseDomain == nil || *c.UniverseDomain == defaultUniverseDomain {
+		return tokenInfoEndpoint
+	}
+	return "https://oauth2." + *c.UniverseDomain + "/tokeninfo"
+}
+
+// testProjectPermissions returns the permissions the caller has on the project
+func (c *GcpConnection) testProjectPermissions(ctx context.Context, project string, permissions []string) ([]string, error) {
+	svc, err := GetClient(ctx, c, string(resourceManagerAPI), func(ctx context.Context) (*cloudresourcemanager.Service, error) {
+		opts, err := c.GetClientOptions(ctx, resourceManagerAPI)
+		if err != nil {
+			return nil, err
+		}
+		svc, err := cloudresourcemanager.NewService(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCP Resource Manager client: %w", err)
+		}
+		return svc, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := svc.Projects.TestIamPermissions(project, &cloudresourcemanager.TestIamPermissionsRequest{Permissions: permissions}).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Permissions, nil
+}
+
+// testBucketPermissions returns the permissions the caller has on the bucket, billing the user project if it is set
+func (c *GcpConnection) testBucketPermissions(ctx context.Context, bucket, userProject string, permissions []string) ([]string, error) {
+	// the client is shared with the storage bucket sources using the connection
+	client, err := GetClient(ctx, c, string(StorageAPI), func(ctx context.Context) (*storage.Client, error) {
+		opts, err := c.GetClientOptions(ctx, StorageAPI)
+		if err != nil {
+			return nil, err
+		}
+		client, err := storage.NewClient(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCP Storage client: %w", err)
+		}
+		return client, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	bkt := client.Bucket(bucket)
+	if userProject != "" {
+		bkt = bkt.UserProject(userProject)
+	}
+	return bkt.IAM().TestPermissions(ctx, permissions)
+}
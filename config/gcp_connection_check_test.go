@@ -0,0 +1,254 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePermissionsServer serves the tokeninfo, Resource Manager and Cloud Storage testIamPermissions endpoints
+// granting the permissions in granted, keyed by resource, to requests with the access token
+type fakePermissionsServer struct {
+	*httptest.Server
+	accessToken string
+	granted     map[string][]string
+	// if true, the access token is accepted by tokeninfo, but rejected by the APIs
+	revoked bool
+	// the requester-pays buckets, in the form gs://bucket, which reject requests without a user project
+	requesterPays []string
+	// the projects, in the form projects/project, billed for requests which have not enabled the Resource Manager API
+	serviceDisabled []string
+
+	mut sync.Mutex
+	// the number of tokeninfo requests
+	tokenInfoRequests int
+	// if set, tokeninfo requests for the token wait until this is closed
+	blockedToken   string
+	tokenInfoBlock chan struct{}
+}
+
+func newFakePermissionsServer(t *testing.T, accessToken string, granted map[string][]string) *fakePermissionsServer {
+	f := &fakePermissionsServer{accessToken: accessToken, granted: granted}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+
+	prevTokenInfoEndpoint, prevResourceManagerEndpoint := tokenInfoEndpoint, resourceManagerEndpoint
+	tokenInfoEndpoint, resourceManagerEndpoint = f.URL+"/tokeninfo", f.URL+"/"
+	t.Cleanup(func() {
+		tokenInfoEndpoint, resourceManagerEndpoint = prevTokenInfoEndpoint, prevResourceManagerEndpoint
+		// the cached clients use the endpoints of the server
+		_ = CloseClients()
+	})
+	return f
+}
+
+func (f *fakePermissionsServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/tokeninfo" {
+		f.mut.Lock()
+		f.tokenInfoRequests++
+		block := f.tokenInfoBlock
+		if r.PostFormValue("access_token") != f.blockedToken {
+			block = nil
+		}
+		f.mut.Unlock()
+		if block != nil {
+			select {
+			case <-block:
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		// the token must be sent in the request body, not the URL
+		if r.Method != http.MethodPost || r.URL.Query().Has("access_token") || r.PostFormValue("access_token") != f.accessToken {
+			http.Error(w, `{"error":"invalid_token"}`, http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"azp":"1234","email":"reader@my-project.iam.gserviceaccount.com","expires_in":3599}`))
+		return
+	}
+
+	if f.revoked || r.Header.Get("Authorization") != "Bearer "+f.accessToken {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error":{"code":401,"message":"Request had invalid authentication credentials."}}`))
+		return
+	}
+
+	var resource string
+	var requested []string
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/projects/") && strings.HasSuffix(r.URL.Path, ":testIamPermissions"):
+		resource = strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/"), ":testIamPermissions")
+		if slices.Contains(f.serviceDisabled, resource) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"error":{"code":403,"message":"Cloud Resource Manager API has not been used in project 1234 before or it is disabled.","errors":[{"reason":"accessNotConfigured"}]}}`))
+			return
+		}
+		var req struct {
+			Permissions []string `json:"permissions"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		requested = req.Permissions
+	case strings.HasPrefix(r.URL.Path, "/storage/v1/b/") && strings.HasSuffix(r.URL.Path, "/iam/testPermissions"):
+		resource = "gs://" + strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/storage/v1/b/"), "/iam/testPermissions")
+		requested = r.URL.Query()["permissions"]
+		if slices.Contains(f.requesterPays, resource) && r.URL.Query().Get("userProject") == "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":{"code":400,"message":"Bucket is a requester pays bucket but no user project provided."}}`))
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	var permissions []string
+	for _, permission := range requested {
+		if slices.Contains(f.granted[resource], permission) {
+			permissions = append(permissions, permission)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"permissions": permissions})
+}
+
+func TestCheckConnection(t *testing.T) {
+	server := newFakePermissionsServer(t, "ya29.token", map[string][]string{
+		"projects/my-project": {"logging.logEntries.list"},
+		"gs://my-logs":        {"storage.objects.list", "storage.objects.get"},
+		"gs://other-logs":     {"storage.objects.list"},
+		"gs://paid-logs":      {"storage.objects.list", "storage.objects.get"},
+	})
+	server.requesterPays = []string{"gs://paid-logs"}
+	server.serviceDisabled = []string{"projects/disabled-project"}
+	storageEndpoint := server.URL + "/storage/v1/"
+
+	tests := []struct {
+		name         string
+		accessToken  string
+		checks       []PermissionCheck
+		wantIdentity string
+		wantMissing  map[string][]string
+		wantErr      string
+	}{
+		{
+			name:         "all permissions granted",
+			accessToken:  "ya29.token",
+			checks:       []PermissionCheck{ProjectPermissions("my-project", LoggingReadPermissions...), BucketPermissions("my-logs", StorageReadPermissions...)},
+			wantIdentity: "reader@my-project.iam.gserviceaccount.com",
+			wantMissing:  map[string][]string{},
+		},
+		{
+			name:         "missing permissions",
+			accessToken:  "ya29.token",
+			checks:       []PermissionCheck{ProjectPermissions("other-project", LoggingReadPermissions...), BucketPermissions("other-logs", StorageReadPermissions...)},
+			wantIdentity: "reader@my-project.iam.gserviceaccount.com",
+			wantMissing: map[string][]string{
+				"projects/other-project": {"logging.logEntries.list"},
+				"gs://other-logs":        {"storage.objects.get"},
+			},
+		},
+		{
+			name:         "requester-pays bucket",
+			accessToken:  "ya29.token",
+			checks:       []PermissionCheck{{Bucket: "paid-logs", Permissions: StorageReadPermissions, UserProject: "my-project"}},
+			wantIdentity: "reader@my-project.iam.gserviceaccount.com",
+			wantMissing:  map[string][]string{},
+		},
+		{
+			name:        "requester-pays bucket without a user project",
+			accessToken: "ya29.token",
+			checks:      []PermissionCheck{BucketPermissions("paid-logs", StorageReadPermissions...)},
+			wantErr:     "error testing permissions on gs://paid-logs",
+		},
+		{
+			name:         "resource manager api not enabled",
+			accessToken:  "ya29.token",
+			checks:       []PermissionCheck{ProjectPermissions("disabled-project", LoggingReadPermissions...), BucketPermissions("other-logs", StorageReadPermissions...)},
+			wantIdentity: "reader@my-project.iam.gserviceaccount.com",
+			wantMissing:  map[string][]string{"gs://other-logs": {"storage.objects.get"}},
+		},
+		{
+			name:        "invalid token",
+			accessToken: "ya29.expired",
+			checks:      []PermissionCheck{ProjectPermissions("my-project", LoggingReadPermissions...)},
+			wantErr:     "error getting access token info: status 400",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &GcpConnection{ImpersonateAccessToken: &tt.accessToken, StorageEndpoint: &storageEndpoint}
+			result, err := c.CheckConnection(context.Background(), tt.checks...)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("CheckConnection() error = %v, want %q", err, tt.wantErr)
+				}
+				if strings.Contains(err.Error(), tt.accessToken) {
+					t.Errorf("CheckConnection() error contains the access token: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CheckConnection() error = %v", err)
+			}
+			if result.Identity != tt.wantIdentity {
+				t.Errorf("Identity = %q, want %q", result.Identity, tt.wantIdentity)
+			}
+			if !reflect.DeepEqual(result.MissingPermissions, tt.wantMissing) {
+				t.Errorf("MissingPermissions = %v, want %v", result.MissingPermissions, tt.wantMissing)
+			}
+			if (len(tt.wantMissing) == 0) != (result.Err() == nil) {
+				t.Errorf("Err() = %v", result.Err())
+			}
+		})
+	}
+
+	t.Run("without authentication", func(t *testing.T) {
+		withoutAuthentication := true
+		c := &GcpConnection{WithoutAuthentication: &withoutAuthentication, StorageEndpoint: &storageEndpoint}
+
+		result, err := c.CheckConnection(context.Background(), BucketPermissions("other-logs", StorageReadPermissions...))
+		if err != nil {
+			t.Fatalf("CheckConnection() error = %v", err)
+		}
+		if result.Identity != "" || len(result.MissingPermissions) > 0 {
+			t.Errorf("CheckConnection() = %+v, want nothing checked", result)
+		}
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		server.revoked = true
+		t.Cleanup(func() { server.revoked = false })
+		token := "ya29.token"
+		c := &GcpConnection{ImpersonateAccessToken: &token}
+
+		_, err := c.CheckConnection(context.Background(), ProjectPermissions("my-project", LoggingReadPermissions...))
+		if !errors.Is(err, ErrAccessTokenExpired) {
+			t.Fatalf("CheckConnection() error = %v, want ErrAccessTokenExpired", err)
+		}
+	})
+}
+
+func TestConnectionCheckErr(t *testing.T) {
+	result := &ConnectionCheck{
+		Identity: "reader@my-project.iam.gserviceaccount.com",
+		MissingPermissions: map[string][]string{
+			"projects/my-project": {"logging.logEntries.list"},
+			"gs://my-logs":        {"storage.objects.list", "storage.objects.get"},
+		},
+	}
+	want := "reader@my-project.iam.gserviceaccount.com is missing permissions: logging.logEntries.list on projects/my-project; storage.objects.list, storage.objects.get on gs://my-logs"
+	if err := result.Err(); err == nil || err.Error() != want {
+		t.Errorf("Err() = %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,626 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	htransport "google.golang.org/api/transport/http"
+)
+
+const (
+	testSubjectToken   = "subject-token"
+	testStsToken       = "sts-access-token"
+	testSaToken        = "service-account-access-token"
+	testServiceAccount = "collector@my-project.iam.gserviceaccount.com"
+	testAudience       = "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider"
+)
+
+// fakeTokenServer is a stand-in for the Security Token Service, which exchanges the subject token for an access token,
+// and the IAM Credentials API, which exchanges the access token for a service account access token
+type fakeTokenServer struct {
+	*httptest.Server
+	t *testing.T
+
+	mut sync.Mutex
+	// the request body of the last generateAccessToken request
+	lastGenerateRequest generateAccessTokenRequest
+}
+
+type generateAccessTokenRequest struct {
+	Delegates []string `json:"delegates"`
+	Scope     []string `json:"scope"`
+	Lifetime  string   `json:"lifetime"`
+}
+
+func newFakeTokenServer(t *testing.T) *fakeTokenServer {
+	f := &fakeTokenServer{t: t}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/token", f.exchangeToken)
+	mux.HandleFunc("POST /v1/projects/-/serviceAccounts/{account}", f.generateAccessToken)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeTokenServer) exchangeToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for field, want := range map[string]string{
+		"grant_type":         "urn:ietf:params:oauth:grant-type:token-exchange",
+		"audience":           testAudience,
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"subject_token":      testSubjectToken,
+	} {
+		if got := r.Form.Get(field); got != want {
+			f.t.Errorf("token exchange %s: got %q, want %q", field, got, want)
+			http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"access_token":      testStsToken,
+		"issued_token_type": "urn:ietf:params:oauth:token-type:access_token",
+		"token_type":        "Bearer",
+		"expires_in":        3600,
+	})
+}
+
+func (f *fakeTokenServer) generateAccessToken(w http.ResponseWriter, r *http.Request) {
+	if got, want := r.PathValue("account"), testServiceAccount+":generateAccessToken"; got != want {
+		http.NotFound(w, r)
+		return
+	}
+	if got, want := r.Header.Get("Authorization"), "Bearer "+testStsToken; got != want {
+		f.t.Errorf("generate access token authorization: got %q, want %q", got, want)
+		http.Error(w, `{"error":{"code":401}}`, http.StatusUnauthorized)
+		return
+	}
+	var request generateAccessTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mut.Lock()
+	f.lastGenerateRequest = request
+	f.mut.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"accessToken": testSaToken,
+		"expireTime":  time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+	})
+}
+
+func (f *fakeTokenServer) lastGenerateAccessTokenRequest() generateAccessTokenRequest {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.lastGenerateRequest
+}
+
+func (f *fakeTokenServer) impersonationURL() string {
+	return fmt.Sprintf("%s/v1/projects/-/serviceAccounts/%s:generateAccessToken", f.URL, testServiceAccount)
+}
+
+// externalAccount returns external_account credentials reading the subject token from the file
+func (f *fakeTokenServer) externalAccount(tokenFile string, impersonate bool, format string) map[string]any {
+	source := map[string]any{"file": tokenFile}
+	if format != "" {
+		source["format"] = map[string]any{"type": format, "subject_token_field_name": "id_token"}
+	}
+	creds := map[string]any{
+		"type":               "external_account",
+		"audience":           testAudience,
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"token_url":          f.URL + "/v1/token",
+		"credential_source":  source,
+	}
+	if impersonate {
+		creds["service_account_impersonation_url"] = f.impersonationURL()
+	}
+	return creds
+}
+
+// authorizationHeader makes a request using the client options, returning the Authorization header sent
+func authorizationHeader(t *testing.T, c *GcpConnection) string {
+	t.Helper()
+
+	var mut sync.Mutex
+	var header string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		defer mut.Unlock()
+		header = r.Header.Get("Authorization")
+	}))
+	defer api.Close()
+
+	ctx := context.Background()
+	opts, err := c.GetClientOptions(ctx, StorageAPI)
+	if err != nil {
+		t.Fatalf("error getting client options: %s", err)
+	}
+	client, _, err := htransport.NewClient(ctx, opts...)
+	if err != nil {
+		t.Fatalf("error creating client: %s", err)
+	}
+	resp, err := client.Get(api.URL)
+	if err != nil {
+		t.Fatalf("error making request: %s", err)
+	}
+	resp.Body.Close()
+
+	mut.Lock()
+	defer mut.Unlock()
+	return header
+}
+
+func writeFile(t *testing.T, name, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func marshal(t *testing.T, v any) string {
+	t.Helper()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestGetClientOptionsExternalAccount(t *testing.T) {
+	server := newFakeTokenServer(t)
+	textTokenFile := writeFile(t, "token", testSubjectToken)
+	jsonTokenFile := writeFile(t, "token.json", fmt.Sprintf(`{"id_token":%q}`, testSubjectToken))
+
+	tests := []struct {
+		name        string
+		credentials map[string]any
+		want        string
+	}{
+		{
+			name:        "external account with token file",
+			credentials: server.externalAccount(textTokenFile, false, ""),
+			want:        "Bearer " + testStsToken,
+		},
+		{
+			name:        "external account with json token file",
+			credentials: server.externalAccount(jsonTokenFile, false, "json"),
+			want:        "Bearer " + testStsToken,
+		},
+		{
+			name:        "external account with service account impersonation",
+			credentials: server.externalAccount(textTokenFile, true, ""),
+			want:        "Bearer " + testSaToken,
+		},
+		{
+			name: "impersonated service account with external account source",
+			credentials: map[string]any{
+				"type":                              "impersonated_service_account",
+				"service_account_impersonation_url": server.impersonationURL(),
+				"source_credentials":                server.externalAccount(textTokenFile, false, ""),
+			},
+			want: "Bearer " + testSaToken,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contents := marshal(t, tt.credentials)
+
+			// credentials may be given as a path or as the JSON contents
+			for _, credentials := range []string{writeFile(t, "credentials.json", contents), contents} {
+				c := &GcpConnection{Credentials: &credentials}
+				if got := authorizationHeader(t, c); got != tt.want {
+					t.Errorf("got Authorization %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetClientOptionsImpersonateServiceAccount(t *testing.T) {
+	server := newFakeTokenServer(t)
+	tokenFile := writeFile(t, "token", testSubjectToken)
+	// the collector credentials, which are exchanged for the STS token used to impersonate the service account
+	credentialsFile := writeFile(t, "credentials.json", marshal(t, server.externalAccount(tokenFile, false, "")))
+
+	endpoint := iamCredentialsEndpoint
+	iamCredentialsEndpoint = server.URL
+	t.Cleanup(func() { iamCredentialsEndpoint = endpoint })
+
+	const brokerServiceAccount = "broker@my-project.iam.gserviceaccount.com"
+	const loggingReadScope = "https://www.googleapis.com/auth/logging.read"
+	serviceAccount := testServiceAccount
+	lifetime := "30m"
+
+	tests := []struct {
+		name string
+		conn GcpConnection
+		want generateAccessTokenRequest
+	}{
+		{
+			name: "credentials",
+			conn: GcpConnection{
+				Credentials:               &credentialsFile,
+				ImpersonateServiceAccount: &serviceAccount,
+			},
+			want: generateAccessTokenRequest{
+				Scope:    []string{cloudPlatformScope},
+				Lifetime: "3600s",
+			},
+		},
+		{
+			name: "delegates, scopes and lifetime",
+			conn: GcpConnection{
+				Credentials:               &credentialsFile,
+				ImpersonateServiceAccount: &serviceAccount,
+				ImpersonateDelegates:      []string{brokerServiceAccount},
+				ImpersonateTokenLifetime:  &lifetime,
+				Scopes:                    []string{loggingReadScope},
+			},
+			want: generateAccessTokenRequest{
+				Delegates: []string{"projects/-/serviceAccounts/" + brokerServiceAccount},
+				Scope:     []string{loggingReadScope},
+				Lifetime:  "1800s",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, want := authorizationHeader(t, &tt.conn), "Bearer "+testSaToken; got != want {
+				t.Errorf("got Authorization %q, want %q", got, want)
+			}
+			got := server.lastGenerateAccessTokenRequest()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got generateAccessToken request %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetClientOptionsInvalidCredentials(t *testing.T) {
+	server := newFakeTokenServer(t)
+	tokenFile := writeFile(t, "token", testSubjectToken)
+
+	withSource := func(source map[string]any) map[string]any {
+		creds := server.externalAccount(tokenFile, false, "")
+		creds["credential_source"] = source
+		return creds
+	}
+	without := func(field string) map[string]any {
+		creds := server.externalAccount(tokenFile, false, "")
+		delete(creds, field)
+		return creds
+	}
+
+	tests := []struct {
+		name        string
+		credentials any
+		env         map[string]string
+		wantErr     string
+	}{
+		{
+			name:        "not json",
+			credentials: `{"type": service_account}`,
+			wantErr:     "credentials must be a credentials JSON file or its contents: invalid JSON at offset",
+		},
+		{
+			name:        "missing file",
+			credentials: "my-credentials.json",
+			wantErr:     "credentials is not the JSON contents or the path of an existing file",
+		},
+		{
+			name:        "unknown type",
+			credentials: map[string]any{"type": "api_key"},
+			wantErr:     "unsupported credentials type api_key",
+		},
+		{
+			name:        "no audience",
+			credentials: without("audience"),
+			wantErr:     "invalid external_account credentials: audience is required",
+		},
+		{
+			name:        "no credential source",
+			credentials: without("credential_source"),
+			wantErr:     "credential_source is required",
+		},
+		{
+			name:        "missing token file",
+			credentials: withSource(map[string]any{"file": filepath.Join(t.TempDir(), "missing")}),
+			wantErr:     "subject token file",
+		},
+		{
+			name:        "more than one source",
+			credentials: withSource(map[string]any{"file": tokenFile, "url": "http://169.254.169.254/token"}),
+			wantErr:     "exactly one of file, url, executable or environment_id",
+		},
+		{
+			name:        "json format without field name",
+			credentials: withSource(map[string]any{"file": tokenFile, "format": map[string]any{"type": "json"}}),
+			wantErr:     "subject_token_field_name is required",
+		},
+		{
+			name:        "executable not allowed",
+			credentials: withSource(map[string]any{"executable": map[string]any{"command": "/usr/local/bin/token"}}),
+			env:         map[string]string{allowExecutablesEnvVar: ""},
+			wantErr:     allowExecutablesEnvVar,
+		},
+		{
+			name:        "executable timeout",
+			credentials: withSource(map[string]any{"executable": map[string]any{"command": "/usr/local/bin/token", "timeout_millis": 1000}}),
+			env:         map[string]string{allowExecutablesEnvVar: "1"},
+			wantErr:     "timeout_millis must be between",
+		},
+		{
+			name: "aws without region",
+			credentials: withSource(map[string]any{
+				"environment_id":                 "aws1",
+				"regional_cred_verification_url": "https://sts.{region}.amazonaws.com?Action=GetCallerIdentity&Version=2011-06-15",
+			}),
+			env:     map[string]string{"AWS_REGION": "", "AWS_DEFAULT_REGION": ""},
+			wantErr: "no region_url",
+		},
+		{
+			name: "aws without security credentials",
+			credentials: withSource(map[string]any{
+				"environment_id":                 "aws1",
+				"regional_cred_verification_url": "https://sts.{region}.amazonaws.com?Action=GetCallerIdentity&Version=2011-06-15",
+			}),
+			env:     map[string]string{"AWS_REGION": "us-east-1", "AWS_ACCESS_KEY_ID": "", "AWS_SECRET_ACCESS_KEY": ""},
+			wantErr: "no url for the AWS security credentials",
+		},
+		{
+			name: "impersonated service account without source credentials",
+			credentials: map[string]any{
+				"type":                              "impersonated_service_account",
+				"service_account_impersonation_url": server.impersonationURL(),
+			},
+			wantErr: "source_credentials is required",
+		},
+		{
+			name: "impersonated service account with invalid source credentials",
+			credentials: map[string]any{
+				"type":                              "impersonated_service_account",
+				"service_account_impersonation_url": server.impersonationURL(),
+				"source_credentials":                without("subject_token_type"),
+			},
+			wantErr: "source_credentials: invalid external_account credentials: subject_token_type is required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			credentials, ok := tt.credentials.(string)
+			if !ok {
+				credentials = marshal(t, tt.credentials)
+			}
+
+			c := &GcpConnection{Credentials: &credentials}
+			_, err := c.GetClientOptions(context.Background(), StorageAPI)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	server := newFakeTokenServer(t)
+	tokenFile := writeFile(t, "token", testSubjectToken)
+	credentialsFile := writeFile(t, "credentials.json", marshal(t, server.externalAccount(tokenFile, false, "")))
+	missingFile := filepath.Join(t.TempDir(), "missing.json")
+
+	ptr := func(s string) *string { return &s }
+	withoutAuthentication := true
+
+	tests := []struct {
+		name    string
+		conn    GcpConnection
+		wantErr string
+	}{
+		{
+			name: "empty",
+			conn: GcpConnection{},
+		},
+		{
+			name: "valid",
+			conn: GcpConnection{
+				Project:                   ptr("my-project"),
+				QuotaProject:              ptr("example.com:billing-project"),
+				Credentials:               ptr(credentialsFile),
+				ImpersonateServiceAccount: ptr(testServiceAccount),
+			},
+		},
+		{
+			name: "compute default service account",
+			conn: GcpConnection{ImpersonateServiceAccount: ptr("123456789-compute@developer.gserviceaccount.com")},
+		},
+		{
+			name: "both impersonation attributes",
+			conn: GcpConnection{
+				ImpersonateAccessToken:    ptr("ya29.token"),
+				ImpersonateServiceAccount: ptr(testServiceAccount),
+			},
+			wantErr: "impersonate_access_token and impersonate_service_account cannot both be set",
+		},
+		{
+			name: "access token command and file",
+			conn: GcpConnection{
+				AccessTokenCommand: ptr("gcloud auth print-access-token"),
+				AccessTokenFile:    ptr("/var/run/secrets/token"),
+			},
+			wantErr: "access_token_command and access_token_file cannot both be set",
+		},
+		{
+			name:    "empty access token command",
+			conn:    GcpConnection{AccessTokenCommand: ptr("")},
+			wantErr: "access_token_command cannot be empty",
+		},
+		{
+			name:    "universe domain url",
+			conn:    GcpConnection{UniverseDomain: ptr("https://example.com")},
+			wantErr: `invalid universe_domain "https://example.com"`,
+		},
+		{
+			name:    "invalid proxy",
+			conn:    GcpConnection{HttpsProxy: ptr("proxy.example.com:3128")},
+			wantErr: "invalid https_proxy",
+		},
+		{
+			name:    "ca bundle without certificates",
+			conn:    GcpConnection{CaBundle: ptr(writeFile(t, "ca.pem", "not a certificate"))},
+			wantErr: "contains no PEM certificates",
+		},
+		{
+			name:    "invalid project",
+			conn:    GcpConnection{Project: ptr("My_Project")},
+			wantErr: `invalid project "My_Project"`,
+		},
+		{
+			name:    "short project",
+			conn:    GcpConnection{Project: ptr("proj")},
+			wantErr: `invalid project "proj"`,
+		},
+		{
+			name:    "invalid quota project",
+			conn:    GcpConnection{QuotaProject: ptr("billing-project-")},
+			wantErr: `invalid quota_project "billing-project-"`,
+		},
+		{
+			name:    "user email",
+			conn:    GcpConnection{ImpersonateServiceAccount: ptr("me@example.com")},
+			wantErr: `invalid impersonate_service_account "me@example.com"`,
+		},
+		{
+			name:    "missing credentials file",
+			conn:    GcpConnection{Credentials: ptr(missingFile)},
+			wantErr: "invalid credentials: credentials is not the JSON contents or the path of an existing file",
+		},
+		{
+			name:    "credentials not json",
+			conn:    GcpConnection{Credentials: ptr(writeFile(t, "not-json.json", "my-credentials"))},
+			wantErr: "invalid credentials: credentials must be a credentials JSON file or its contents",
+		},
+		{
+			name:    "unknown credentials type",
+			conn:    GcpConnection{Credentials: ptr(`{"type":"api_key"}`)},
+			wantErr: "invalid credentials: unsupported credentials type api_key",
+		},
+		{
+			name: "impersonation chain",
+			conn: GcpConnection{
+				ImpersonateServiceAccount: ptr(testServiceAccount),
+				ImpersonateDelegates:      []string{"broker@my-project.iam.gserviceaccount.com"},
+				ImpersonateTokenLifetime:  ptr("2h"),
+				Scopes:                    []string{"https://www.googleapis.com/auth/logging.read"},
+			},
+		},
+		{
+			name:    "delegates without service account",
+			conn:    GcpConnection{ImpersonateDelegates: []string{"broker@my-project.iam.gserviceaccount.com"}},
+			wantErr: "impersonate_delegates and impersonate_token_lifetime cannot be set without impersonate_service_account",
+		},
+		{
+			name: "invalid delegate",
+			conn: GcpConnection{
+				ImpersonateServiceAccount: ptr(testServiceAccount),
+				ImpersonateDelegates:      []string{"broker"},
+			},
+			wantErr: `invalid impersonate_delegates "broker"`,
+		},
+		{
+			name: "lifetime over maximum",
+			conn: GcpConnection{
+				ImpersonateServiceAccount: ptr(testServiceAccount),
+				ImpersonateTokenLifetime:  ptr("24h"),
+			},
+			wantErr: "invalid impersonate_token_lifetime 24h",
+		},
+		{
+			name: "scopes with access token",
+			conn: GcpConnection{
+				ImpersonateAccessToken: ptr("ya29.token"),
+				Scopes:                 []string{"https://www.googleapis.com/auth/logging.read"},
+			},
+			wantErr: "scopes cannot be set with impersonate_access_token",
+		},
+		{
+			name: "credentials ignored without authentication",
+			conn: GcpConnection{Credentials: ptr(missingFile), WithoutAuthentication: &withoutAuthentication},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.conn.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("got error %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestImpersonatedTokenTimeout(t *testing.T) {
+	// an IAM Credentials endpoint which never responds
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+
+	timeout := impersonateTokenTimeout
+	impersonateTokenTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { impersonateTokenTimeout = timeout })
+
+	source := &impersonatedTokenSource{
+		client:          server.Client(),
+		endpoint:        server.URL,
+		targetPrincipal: testServiceAccount,
+		scopes:          []string{cloudPlatformScope},
+		lifetime:        defaultImpersonateTokenLifetime,
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := source.Token()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "context deadline exceeded") {
+			t.Errorf("Token() error = %v, want a deadline exceeded error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Token() did not time out")
+	}
+}
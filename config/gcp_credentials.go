@@ -0,0 +1,369 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// the credential types which may be set in the credentials argument
+const (
+	credentialsTypeServiceAccount             = "service_account"
+	credentialsTypeAuthorizedUser             = "authorized_user"
+	credentialsTypeExternalAccount            = "external_account"
+	credentialsTypeExternalAccountUser        = "external_account_authorized_user"
+	credentialsTypeImpersonatedServiceAccount = "impersonated_service_account"
+)
+
+const (
+	// executable credential sources are only run if this env var is set to 1
+	allowExecutablesEnvVar = "GOOGLE_EXTERNAL_ACCOUNT_ALLOW_EXECUTABLES"
+	// the range of the executable timeout_millis
+	executableTimeoutMinMillis = 5 * 1000
+	executableTimeoutMaxMillis = 120 * 1000
+)
+
+// the prefixes of the credentials references
+const (
+	// env:NAME - the credentials JSON is the value of the env var
+	credentialsRefEnv = "env:"
+	// file://PATH - the credentials JSON is the contents of the file
+	credentialsRefFile = "file://"
+	// exec:COMMAND - the credentials JSON is the output of the command
+	credentialsRefExec = "exec:"
+)
+
+// the timeout for running the command of an exec: credentials reference
+const credentialsCommandTimeout = time.Minute
+
+var credentialsTypes = []string{credentialsTypeServiceAccount, credentialsTypeAuthorizedUser, credentialsTypeExternalAccount, credentialsTypeExternalAccountUser, credentialsTypeImpersonatedServiceAccount}
+
+// gcpCredentials is the credentials JSON - only the fields which are validated are included
+type gcpCredentials struct {
+	Type string `json:"type"`
+
+	// external_account
+	Audience                       string                 `json:"audience"`
+	SubjectTokenType               string                 `json:"subject_token_type"`
+	TokenURL                       string                 `json:"token_url"`
+	ServiceAccountImpersonationURL string                 `json:"service_account_impersonation_url"`
+	CredentialSource               *externalAccountSource `json:"credential_source"`
+
+	// impersonated_service_account (which also has service_account_impersonation_url)
+	SourceCredentials json.RawMessage `json:"source_credentials"`
+}
+
+// externalAccountSource is the credential_source of external_account credentials, which provides the subject
+// token exchanged for a Google access token - exactly one of file, url, executable or environment_id (AWS) is set
+type externalAccountSource struct {
+	File       string `json:"file"`
+	URL        string `json:"url"`
+	Executable *struct {
+		Command       string `json:"command"`
+		TimeoutMillis int    `json:"timeout_millis"`
+	} `json:"executable"`
+	EnvironmentID               string `json:"environment_id"`
+	RegionURL                   string `json:"region_url"`
+	RegionalCredVerificationURL string `json:"regional_cred_verification_url"`
+	Format                      *struct {
+		Type                  string `json:"type"`
+		SubjectTokenFieldName string `json:"subject_token_field_name"`
+	} `json:"format"`
+}
+
+// getCredentials returns the credentials JSON of the credentials attribute, which is one of:
+//
+//   - env:NAME - the value of the env var
+//   - file://PATH - the contents of the file
+//   - exec:COMMAND - the output of the command
+//   - the path of a file, or the JSON contents
+//
+// The credentials are held in memory only, and they, and the attribute, which may be the JSON contents, are never
+// included in the error.
+func (c *GcpConnection) getCredentials() ([]byte, error) {
+	return resolveCredentials(*c.Credentials)
+}
+
+func resolveCredentials(ref string) ([]byte, error) {
+	var contents []byte
+	switch {
+	case strings.HasPrefix(ref, credentialsRefEnv):
+		name := strings.TrimPrefix(ref, credentialsRefEnv)
+		if name == "" {
+			return nil, fmt.Errorf("no env var name in the %s credentials reference", credentialsRefEnv)
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("env var %s is not set", name)
+		}
+		contents = []byte(value)
+
+	case strings.HasPrefix(ref, credentialsRefFile):
+		path := strings.TrimPrefix(ref, credentialsRefFile)
+		if path == "" {
+			return nil, fmt.Errorf("no path in the %s credentials reference", credentialsRefFile)
+		}
+		var err error
+		contents, err = readCredentialsFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+	case strings.HasPrefix(ref, credentialsRefExec):
+		command := strings.TrimPrefix(ref, credentialsRefExec)
+		if strings.TrimSpace(command) == "" {
+			return nil, fmt.Errorf("no command in the %s credentials reference", credentialsRefExec)
+		}
+		var err error
+		contents, err = runCredentialsCommand(command)
+		if err != nil {
+			return nil, err
+		}
+
+	// the JSON contents
+	case strings.HasPrefix(strings.TrimSpace(ref), "{"):
+		contents = []byte(ref)
+
+	// otherwise the path of a file
+	default:
+		var err error
+		contents, err = readCredentialsFile(ref)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	contents = bytes.TrimSpace(contents)
+	if len(contents) == 0 {
+		return nil, fmt.Errorf("the credentials are empty")
+	}
+	return contents, nil
+}
+
+// credentialsCommandOutputs is the output of each exec: credentials command, so the command is only run once
+// however many sources and clients use the credentials - the output expires after credentialsCommandCacheDuration,
+// so credentials the command mints are refreshed when the next client is created
+var credentialsCommandOutputs = struct {
+	sync.Mutex
+	outputs map[string]*credentialsCommandOutput
+}{outputs: make(map[string]*credentialsCommandOutput)}
+
+// how long the output of an exec: credentials command is used before the command is run again - overridden in tests
+var credentialsCommandCacheDuration = 5 * time.Minute
+
+// credentialsCommandOutput is the output of an exec: credentials command - it has its own lock, so a slow command
+// only blocks the clients waiting for its output
+type credentialsCommandOutput struct {
+	mut     sync.Mutex
+	output  []byte
+	expires time.Time
+}
+
+// runCredentialsCommand runs the exec: credentials command, if its output has not been cached or has expired, and
+// returns its output
+func runCredentialsCommand(command string) ([]byte, error) {
+	credentialsCommandOutputs.Lock()
+	cached, ok := credentialsCommandOutputs.outputs[command]
+	if !ok {
+		cached = &credentialsCommandOutput{}
+		credentialsCommandOutputs.outputs[command] = cached
+	}
+	credentialsCommandOutputs.Unlock()
+
+	cached.mut.Lock()
+	defer cached.mut.Unlock()
+	if cached.output != nil && time.Now().Before(cached.expires) {
+		return cached.output, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), credentialsCommandTimeout)
+	defer cancel()
+	output, err := runCommand(ctx, command)
+	if err != nil {
+		return nil, fmt.Errorf("error running the credentials command: %w", err)
+	}
+	cached.output = output
+	cached.expires = time.Now().Add(credentialsCommandCacheDuration)
+	return output, nil
+}
+
+// readCredentialsFile returns the contents of the credentials file
+// the path may be mistyped credentials contents, so is not included in the error
+func readCredentialsFile(path string) ([]byte, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials file path")
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("credentials is not the JSON contents or the path of an existing file")
+		}
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		return nil, fmt.Errorf("error reading credentials file: %w", err)
+	}
+	return contents, nil
+}
+
+// parseCredentials parses and validates the credentials JSON, returning the credentials type
+func parseCredentials(contents []byte) (string, error) {
+	var creds gcpCredentials
+	if err := json.Unmarshal(contents, &creds); err != nil {
+		// syntax errors include the invalid character, which is part of the credentials
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			err = fmt.Errorf("invalid JSON at offset %d", syntaxErr.Offset)
+		}
+		return "", fmt.Errorf("credentials must be a credentials JSON file or its contents: %w", err)
+	}
+
+	switch creds.Type {
+	case credentialsTypeExternalAccount:
+		if err := creds.validateExternalAccount(); err != nil {
+			return "", fmt.Errorf("invalid %s credentials: %w", creds.Type, err)
+		}
+	case credentialsTypeImpersonatedServiceAccount:
+		if err := creds.validateImpersonatedServiceAccount(); err != nil {
+			return "", fmt.Errorf("invalid %s credentials: %w", creds.Type, err)
+		}
+	case "":
+		return "", fmt.Errorf("credentials have no type, expected one of: %s", strings.Join(credentialsTypes, ", "))
+	default:
+		if !slices.Contains(credentialsTypes, creds.Type) {
+			return "", fmt.Errorf("unsupported credentials type %s, expected one of: %s", creds.Type, strings.Join(credentialsTypes, ", "))
+		}
+	}
+	return creds.Type, nil
+}
+
+func (c *gcpCredentials) validateExternalAccount() error {
+	if c.Audience == "" {
+		return fmt.Errorf("audience is required")
+	}
+	if c.SubjectTokenType == "" {
+		return fmt.Errorf("subject_token_type is required")
+	}
+	if err := validateCredentialsURL("token_url", c.TokenURL); err != nil {
+		return err
+	}
+	if err := validateCredentialsURL("service_account_impersonation_url", c.ServiceAccountImpersonationURL); err != nil {
+		return err
+	}
+	if c.CredentialSource == nil {
+		return fmt.Errorf("credential_source is required")
+	}
+	return c.CredentialSource.validate()
+}
+
+func (s *externalAccountSource) validate() error {
+	// AWS sources may also have a url, for the security credentials
+	sources := 0
+	for _, set := range []bool{s.File != "", s.URL != "" && s.EnvironmentID == "", s.Executable != nil, s.EnvironmentID != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("credential_source must have exactly one of file, url, executable or environment_id")
+	}
+
+	if s.Format != nil {
+		switch s.Format.Type {
+		case "", "text":
+		case "json":
+			if s.Format.SubjectTokenFieldName == "" {
+				return fmt.Errorf("credential_source format subject_token_field_name is required for the json format")
+			}
+		default:
+			return fmt.Errorf("unsupported credential_source format type %s, expected text or json", s.Format.Type)
+		}
+	}
+
+	switch {
+	case s.File != "":
+		// the subject token file is read whenever a token is requested, but it must exist when the connection is used
+		info, err := os.Stat(s.File)
+		if err != nil {
+			return fmt.Errorf("credential_source subject token file %s cannot be read: %w", s.File, err)
+		}
+		if info.IsDir() {
+			return fmt.Errorf("credential_source subject token file %s is a directory", s.File)
+		}
+	case s.URL != "" && s.EnvironmentID == "":
+		return validateCredentialsURL("credential_source url", s.URL)
+	case s.Executable != nil:
+		if s.Executable.Command == "" {
+			return fmt.Errorf("credential_source executable command is required")
+		}
+		if s.Executable.TimeoutMillis != 0 && (s.Executable.TimeoutMillis < executableTimeoutMinMillis || s.Executable.TimeoutMillis > executableTimeoutMaxMillis) {
+			return fmt.Errorf("credential_source executable timeout_millis must be between %d and %d", executableTimeoutMinMillis, executableTimeoutMaxMillis)
+		}
+		if os.Getenv(allowExecutablesEnvVar) != "1" {
+			return fmt.Errorf("credential_source executable requires the %s environment variable to be set to 1", allowExecutablesEnvVar)
+		}
+	case s.EnvironmentID != "":
+		if !strings.HasPrefix(s.EnvironmentID, "aws") {
+			return fmt.Errorf("unsupported credential_source environment_id %s, only AWS (aws1) is supported", s.EnvironmentID)
+		}
+		if s.RegionalCredVerificationURL == "" {
+			return fmt.Errorf("credential_source regional_cred_verification_url is required for AWS")
+		}
+		// outside EC2 there is no metadata server, so the region and credentials must be in the environment
+		if s.RegionURL == "" && os.Getenv("AWS_REGION") == "" && os.Getenv("AWS_DEFAULT_REGION") == "" {
+			return fmt.Errorf("credential_source has no region_url, and neither AWS_REGION nor AWS_DEFAULT_REGION is set")
+		}
+		if s.URL == "" && (os.Getenv("AWS_ACCESS_KEY_ID") == "" || os.Getenv("AWS_SECRET_ACCESS_KEY") == "") {
+			return fmt.Errorf("credential_source has no url for the AWS security credentials, and AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are not set")
+		}
+	}
+	return nil
+}
+
+func (c *gcpCredentials) validateImpersonatedServiceAccount() error {
+	if c.ServiceAccountImpersonationURL == "" {
+		return fmt.Errorf("service_account_impersonation_url is required")
+	}
+	if err := validateCredentialsURL("service_account_impersonation_url", c.ServiceAccountImpersonationURL); err != nil {
+		return err
+	}
+	if len(c.SourceCredentials) == 0 {
+		return fmt.Errorf("source_credentials is required")
+	}
+
+	sourceType, err := parseCredentials(c.SourceCredentials)
+	if err != nil {
+		return fmt.Errorf("source_credentials: %w", err)
+	}
+	switch sourceType {
+	case credentialsTypeServiceAccount, credentialsTypeAuthorizedUser, credentialsTypeExternalAccount:
+		return nil
+	default:
+		return fmt.Errorf("unsupported source_credentials type %s, expected service_account, authorized_user or external_account", sourceType)
+	}
+}
+
+// validateCredentialsURL returns an error if the URL is set and is not an absolute http(s) URL
+func validateCredentialsURL(name, value string) error {
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("%s must be an http or https URL", name)
+	}
+	return nil
+}
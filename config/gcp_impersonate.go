@@ -0,0 +1,145 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+const (
+	// the default lifetime of impersonated service account access tokens
+	defaultImpersonateTokenLifetime = time.Hour
+	// the maximum lifetime - tokens with a lifetime over 1h require the
+	// constraints/iam.allowServiceAccountCredentialLifetimeExtension organization policy
+	maxImpersonateTokenLifetime = 12 * time.Hour
+)
+
+var (
+	// the IAM Service Account Credentials API endpoint, used to generate impersonated service account access tokens
+	iamCredentialsEndpoint = "https://iamcredentials.googleapis.com"
+	// the timeout for generating an impersonated access token, so a hung endpoint fails the token refresh rather than
+	// blocking every request waiting for it - overridden in tests
+	impersonateTokenTimeout = 30 * time.Second
+)
+
+// impersonatedTokenSource is an oauth2.TokenSource which generates access tokens for a service account, optionally
+// through a chain of delegates, using a client authenticated with the base credentials
+type impersonatedTokenSource struct {
+	client          *http.Client
+	endpoint        string
+	targetPrincipal string
+	delegates       []string
+	scopes          []string
+	lifetime        time.Duration
+}
+
+// impersonatedTokenSource returns a token source for impersonate_service_account, using the base client options to
+// authenticate, and the base transport, if set, to make the requests - unlike impersonate.CredentialsTokenSource,
+// tokens are refreshed when they expire, even if a lifetime is set
+func (c *GcpConnection) impersonatedTokenSource(ctx context.Context, baseTransport *http.Transport, baseOpts []option.ClientOption) (oauth2.TokenSource, error) {
+	var client *http.Client
+	var err error
+	if baseTransport != nil {
+		var transport http.RoundTripper
+		transport, err = htransport.NewTransport(ctx, baseTransport, baseOpts...)
+		client = &http.Client{Transport: transport}
+	} else {
+		client, _, err = htransport.NewClient(ctx, baseOpts...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating client to impersonate service account %s: %w", *c.ImpersonateServiceAccount, err)
+	}
+
+	lifetime := defaultImpersonateTokenLifetime
+	if c.ImpersonateTokenLifetime != nil {
+		// the lifetime is validated in the config
+		lifetime, _ = time.ParseDuration(*c.ImpersonateTokenLifetime)
+	}
+
+	return oauth2.ReuseTokenSource(nil, &impersonatedTokenSource{
+		client:          client,
+		endpoint:        c.iamCredentialsEndpoint(),
+		targetPrincipal: *c.ImpersonateServiceAccount,
+		delegates:       c.ImpersonateDelegates,
+		scopes:          c.GetScopes(),
+		lifetime:        lifetime,
+	}), nil
+}
+
+// Token generates an access token for the service account
+// see https://cloud.google.com/iam/docs/reference/credentials/rest/v1/projects.serviceAccounts/generateAccessToken
+func (s *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	request := struct {
+		Delegates []string `json:"delegates,omitempty"`
+		Scope     []string `json:"scope"`
+		Lifetime  string   `json:"lifetime"`
+	}{
+		Scope:    s.scopes,
+		Lifetime: fmt.Sprintf("%ds", int64(s.lifetime.Seconds())),
+	}
+	for _, delegate := range s.delegates {
+		request.Delegates = append(request.Delegates, serviceAccountResourceName(delegate))
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// oauth2.TokenSource has no context, so the request is bounded by the timeout alone
+	ctx, cancel := context.WithTimeout(context.Background(), impersonateTokenTimeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/v1/%s:generateAccessToken", s.endpoint, serviceAccountResourceName(s.targetPrincipal))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error generating access token for service account %s: %w", s.targetPrincipal, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("error generating access token for service account %s: %w", s.targetPrincipal, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error generating access token for service account %s: status %d: %s", s.targetPrincipal, resp.StatusCode, bytes.TrimSpace(respBody))
+	}
+
+	var response struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := json.Unmarshal(respBody, &response); err != nil {
+		return nil, fmt.Errorf("error parsing access token for service account %s: %w", s.targetPrincipal, err)
+	}
+	return &oauth2.Token{
+		AccessToken: response.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      response.ExpireTime,
+	}, nil
+}
+
+// iamCredentialsEndpoint returns the IAM Service Account Credentials API endpoint in the universe domain
+func (c *GcpConnection) iamCredentialsEndpoint() string {
+	if c.UniverseDomain == nil || *c.UniverseDomain == defaultUniverseDomain {
+		return iamCredentialsEndpoint
+	}
+	return "https://iamcredentials." + *c.UniverseDomain
+}
+
+// serviceAccountResourceName returns the IAM resource name of the service account email
+func serviceAccountResourceName(email string) string {
+	return "projects/-/serviceAccounts/" + email
+}
@@ -0,0 +1,188 @@
+package config
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+)
+
+const (
+	// the env var which overrides the host of the metadata server, which also indicates the metadata server is available
+	metadataHostEnvVar = "GCE_METADATA_HOST"
+	// the timeout for reading the project from the metadata server
+	metadataTimeout = 5 * time.Second
+)
+
+// the env vars checked for the project, in order
+var projectEnvVars = []string{"CLOUDSDK_CORE_PROJECT", "GCP_PROJECT", "GOOGLE_CLOUD_PROJECT"}
+
+// GetProject returns the project of the connection, which is resolved from the first of these which is set:
+//
+//  1. the project attribute
+//  2. the CLOUDSDK_CORE_PROJECT, GCP_PROJECT and GOOGLE_CLOUD_PROJECT env vars, in that order
+//  3. the core/project property of the active gcloud configuration
+//  4. the project_id or quota_project_id of the credentials JSON - the credentials attribute,
+//     GOOGLE_APPLICATION_CREDENTIALS or the gcloud application default credentials, in that order
+//  5. the project of the GCE metadata server, when running on Google Cloud
+//
+// An empty string is returned if the project cannot be resolved.
+func (c *GcpConnection) GetProject() string {
+	// return if set
+	if c.Project != nil {
+		return *c.Project
+	}
+
+	// else check environment variables
+	for _, envVar := range projectEnvVars {
+		if val := os.Getenv(envVar); val != "" {
+			slog.Debug("Resolved GCP project from environment variable", "project", val, "env_var", envVar)
+			return val
+		}
+	}
+
+	if project, configName := gcloudProject(); project != "" {
+		slog.Debug("Resolved GCP project from gcloud configuration", "project", project, "configuration", configName)
+		return project
+	}
+
+	if project, source := c.credentialsProject(); project != "" {
+		slog.Debug("Resolved GCP project from credentials", "project", project, "credentials", source)
+		return project
+	}
+
+	if project := metadataProject(); project != "" {
+		slog.Debug("Resolved GCP project from the metadata server", "project", project)
+		return project
+	}
+
+	slog.Debug("Unable to resolve GCP project")
+	return ""
+}
+
+// gcloudConfigDir returns the gcloud configuration directory - CLOUDSDK_CONFIG if set,
+// otherwise ~/.config/gcloud (%APPDATA%\gcloud on Windows)
+func gcloudConfigDir() string {
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return dir
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gcloud")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "gcloud")
+}
+
+// gcloudProject returns the core/project property of the active gcloud configuration, and the configuration name
+func gcloudProject() (string, string) {
+	dir := gcloudConfigDir()
+	if dir == "" {
+		return "", ""
+	}
+
+	// the active configuration is CLOUDSDK_ACTIVE_CONFIG_NAME if set, otherwise the name in the active_config file
+	configName := os.Getenv("CLOUDSDK_ACTIVE_CONFIG_NAME")
+	if configName == "" {
+		data, err := os.ReadFile(filepath.Join(dir, "active_config"))
+		if err != nil {
+			return "", ""
+		}
+		configName = strings.TrimSpace(string(data))
+	}
+	if configName == "" {
+		return "", ""
+	}
+
+	f, err := os.Open(filepath.Join(dir, "configurations", "config_"+configName))
+	if err != nil {
+		return "", ""
+	}
+	defer f.Close()
+
+	// the configuration is an INI file - the project is the project property of the core section
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+		case section == "core":
+			key, value, ok := strings.Cut(line, "=")
+			if ok && strings.TrimSpace(key) == "project" {
+				return strings.TrimSpace(value), configName
+			}
+		}
+	}
+	return "", configName
+}
+
+// credentialsProject returns the project_id, or if not set, the quota_project_id of the credentials JSON,
+// and where the credentials were read from
+func (c *GcpConnection) credentialsProject() (string, string) {
+	var source string
+	var contents []byte
+	switch {
+	case c.Credentials != nil:
+		source = "credentials"
+		var err error
+		contents, err = c.getCredentials()
+		if err != nil {
+			return "", source
+		}
+	default:
+		source = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+		if source == "" {
+			if dir := gcloudConfigDir(); dir != "" {
+				source = filepath.Join(dir, "application_default_credentials.json")
+			}
+		}
+		if source == "" {
+			return "", ""
+		}
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return "", source
+		}
+		contents = data
+	}
+
+	var creds struct {
+		ProjectID      string `json:"project_id"`
+		QuotaProjectID string `json:"quota_project_id"`
+	}
+	if err := json.Unmarshal(contents, &creds); err != nil {
+		return "", source
+	}
+	if creds.ProjectID != "" {
+		return creds.ProjectID, source
+	}
+	return creds.QuotaProjectID, source
+}
+
+// metadataProject returns the project of the GCE metadata server, or an empty string if not running on Google Cloud
+func metadataProject() string {
+	if os.Getenv(metadataHostEnvVar) == "" && !metadata.OnGCE() {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), metadataTimeout)
+	defer cancel()
+	project, err := metadata.ProjectIDWithContext(ctx)
+	if err != nil {
+		slog.Debug("Error reading GCP project from the metadata server", "error", err)
+		return ""
+	}
+	return project
+}
@@ -0,0 +1,157 @@
+package config
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestGetProject(t *testing.T) {
+	// a metadata server stand-in - the project is only returned if the test sets it
+	var metadataProjectId atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		project, _ := metadataProjectId.Load().(string)
+		if r.URL.Path != "/computeMetadata/v1/project/project-id" || project == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Metadata-Flavor", "Google")
+		_, _ = w.Write([]byte(project))
+	}))
+	defer server.Close()
+
+	writeGcloudConfig := func(t *testing.T, dir, activeConfig, contents string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Join(dir, "configurations"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "active_config"), []byte(activeConfig+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "configurations", "config_"+activeConfig), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const gcloudConfig = `[core]
+account = me@example.com
+project = gcloud-project
+
+[compute]
+region = us-central1
+`
+	ptr := func(s string) *string { return &s }
+
+	tests := []struct {
+		name   string
+		conn   GcpConnection
+		env    map[string]string
+		setup  func(t *testing.T, gcloudDir string)
+		server string
+		want   string
+	}{
+		{
+			name: "attribute",
+			conn: GcpConnection{Project: ptr("attribute-project")},
+			env:  map[string]string{"CLOUDSDK_CORE_PROJECT": "env-project"},
+			want: "attribute-project",
+		},
+		{
+			name: "CLOUDSDK_CORE_PROJECT before GOOGLE_CLOUD_PROJECT",
+			env:  map[string]string{"CLOUDSDK_CORE_PROJECT": "sdk-project", "GOOGLE_CLOUD_PROJECT": "cloud-project"},
+			want: "sdk-project",
+		},
+		{
+			name: "GOOGLE_CLOUD_PROJECT",
+			env:  map[string]string{"GOOGLE_CLOUD_PROJECT": "cloud-project"},
+			setup: func(t *testing.T, gcloudDir string) {
+				writeGcloudConfig(t, gcloudDir, "default", gcloudConfig)
+			},
+			want: "cloud-project",
+		},
+		{
+			name: "active gcloud configuration",
+			setup: func(t *testing.T, gcloudDir string) {
+				writeGcloudConfig(t, gcloudDir, "work", gcloudConfig)
+			},
+			want: "gcloud-project",
+		},
+		{
+			name: "CLOUDSDK_ACTIVE_CONFIG_NAME",
+			env:  map[string]string{"CLOUDSDK_ACTIVE_CONFIG_NAME": "other"},
+			setup: func(t *testing.T, gcloudDir string) {
+				writeGcloudConfig(t, gcloudDir, "work", gcloudConfig)
+				writeGcloudConfig(t, gcloudDir, "other", "[core]\nproject = other-project\n")
+			},
+			want: "other-project",
+		},
+		{
+			name: "gcloud configuration without a core project",
+			conn: GcpConnection{Credentials: ptr(`{"type":"service_account","project_id":"credentials-project"}`)},
+			setup: func(t *testing.T, gcloudDir string) {
+				writeGcloudConfig(t, gcloudDir, "default", "[compute]\nproject = not-core\n")
+			},
+			want: "credentials-project",
+		},
+		{
+			name: "quota_project_id of credentials",
+			conn: GcpConnection{Credentials: ptr(`{"type":"authorized_user","quota_project_id":"quota-project"}`)},
+			want: "quota-project",
+		},
+		{
+			name: "GOOGLE_APPLICATION_CREDENTIALS",
+			env:  map[string]string{"GOOGLE_APPLICATION_CREDENTIALS": writeFile(t, "adc.json", `{"type":"service_account","project_id":"adc-project"}`)},
+			want: "adc-project",
+		},
+		{
+			name: "application default credentials",
+			setup: func(t *testing.T, gcloudDir string) {
+				if err := os.WriteFile(filepath.Join(gcloudDir, "application_default_credentials.json"), []byte(`{"type":"authorized_user","quota_project_id":"user-project"}`), 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: "user-project",
+		},
+		{
+			name: "unresolved",
+			want: "",
+		},
+		// the metadata package caches the project, so this must be the last case
+		{
+			name:   "metadata server",
+			server: "metadata-project",
+			want:   "metadata-project",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gcloudDir := t.TempDir()
+			env := map[string]string{
+				"CLOUDSDK_CONFIG":                gcloudDir,
+				"CLOUDSDK_ACTIVE_CONFIG_NAME":    "",
+				"GOOGLE_APPLICATION_CREDENTIALS": "",
+				metadataHostEnvVar:               strings.TrimPrefix(server.URL, "http://"),
+			}
+			for _, envVar := range projectEnvVars {
+				env[envVar] = ""
+			}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+			for name, value := range env {
+				t.Setenv(name, value)
+			}
+			if tt.setup != nil {
+				tt.setup(t, gcloudDir)
+			}
+			metadataProjectId.Store(tt.server)
+
+			if got := tt.conn.GetProject(); got != tt.want {
+				t.Errorf("got project %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ProvenanceMetadataKey is the source enrichment metadata key the provenance of a row is stored in, as JSON
+const ProvenanceMetadataKey = "gcp_provenance"
+
+// Provenance records who collected a row, and where it was collected from
+type Provenance struct {
+	// the identity of the caller the row was collected as - empty if it could not be resolved
+	Identity string `json:"identity,omitempty"`
+
+	// for rows collected from the Cloud Logging API, the API endpoint, the SHA-256 hash of the log filter
+	// (excluding the time range) and the number of the page of entries the row was returned in
+	// (rows streamed in tail mode have no page)
+	Endpoint   string `json:"endpoint,omitempty"`
+	FilterHash string `json:"filter_hash,omitempty"`
+	Page       int    `json:"page,omitempty"`
+
+	// for rows collected from Cloud Storage, the object URI, generation, hashes and time the object was last updated
+	URI        string     `json:"uri,omitempty"`
+	Generation int64      `json:"generation,omitempty"`
+	Md5Hash    string     `json:"md5_hash,omitempty"`
+	Crc32c     string     `json:"crc32c,omitempty"`
+	Updated    *time.Time `json:"updated,omitempty"`
+}
+
+// SetMetadata stores the provenance in the source enrichment metadata
+func (p Provenance) SetMetadata(metadata map[string]string) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("error marshalling provenance: %w", err)
+	}
+	metadata[ProvenanceMetadataKey] = string(data)
+	return nil
+}
+
+// ProvenanceFromMetadata returns the provenance stored in the source enrichment metadata, or nil if there is none
+func ProvenanceFromMetadata(metadata map[string]string) (*Provenance, error) {
+	data, ok := metadata[ProvenanceMetadataKey]
+	if !ok {
+		return nil, nil
+	}
+	var p Provenance
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		return nil, fmt.Errorf("error parsing provenance: %w", err)
+	}
+	return &p, nil
+}
+
+// how long GetIdentity waits for the identity to be resolved, and how long a failure to resolve it is cached for
+// before it is resolved again - overridden in tests
+var (
+	identityTimeout       = 10 * time.Second
+	identityRetryInterval = 5 * time.Minute
+)
+
+// identityEntry is the identity of a connection, which is resolved once done is closed
+type identityEntry struct {
+	done     chan struct{}
+	identity string
+	// if the identity could not be resolved, the time it is next resolved
+	retryAt time.Time
+}
+
+// expired returns whether the identity could not be resolved, and should be resolved again
+func (e *identityEntry) expired() bool {
+	select {
+	case <-e.done:
+		return !e.retryAt.IsZero() && !time.Now().Before(e.retryAt)
+	default:
+		return false
+	}
+}
+
+// identityCache is the cache of the identities resolved by GetIdentity, keyed by the connection cache key
+var identityCache = struct {
+	sync.Mutex
+	entries map[string]*identityEntry
+}{entries: make(map[string]*identityEntry)}
+
+// GetIdentity returns the identity of the caller, as resolved by [GcpConnection.CheckConnection], or an empty string
+// if the connection is without authentication or the identity cannot be resolved
+//
+// The identity is resolved once per connection, by the first caller - other callers wait for it to be resolved,
+// for at most identityTimeout. A failure is logged, and cached for identityRetryInterval, so the sources collecting
+// with the connection in the meantime do not each wait for it to fail.
+func (c *GcpConnection) GetIdentity(ctx context.Context) string {
+	if c.withoutAuthentication() {
+		return ""
+	}
+	key, err := c.cacheKey()
+	if err != nil {
+		slog.Warn("Unable to resolve GCP identity", "error", err)
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, identityTimeout)
+	defer cancel()
+
+	// the cache is only locked to find the entry - the identity is resolved without holding the lock
+	identityCache.Lock()
+	entry, ok := identityCache.entries[key]
+	if !ok || entry.expired() {
+		entry = &identityEntry{done: make(chan struct{})}
+		identityCache.entries[key] = entry
+		identityCache.Unlock()
+		c.resolveIdentity(ctx, entry)
+	} else {
+		identityCache.Unlock()
+	}
+
+	select {
+	case <-entry.done:
+		return entry.identity
+	case <-ctx.Done():
+		slog.Warn("Timed out waiting for GCP identity to be resolved")
+		return ""
+	}
+}
+
+// resolveIdentity resolves the identity of the entry, closing done once it is resolved or has failed
+func (c *GcpConnection) resolveIdentity(ctx context.Context, entry *identityEntry) {
+	defer close(entry.done)
+
+	identity, err := c.getIdentity(ctx)
+	if err != nil {
+		slog.Warn("Unable to resolve GCP identity", "error", err)
+		entry.retryAt = time.Now().Add(identityRetryInterval)
+		return
+	}
+	entry.identity = identity
+}
+
+// GetEndpoint returns the endpoint requests to the API are made to - the endpoint set for the API, otherwise
+// the default endpoint in the universe domain
+func (c *GcpConnection) GetEndpoint(api GcpAPI) string {
+	if endpoint := c.getEndpoint(api); endpoint != "" {
+		return endpoint
+	}
+	universeDomain := defaultUniverseDomain
+	if c.UniverseDomain != nil {
+		universeDomain = *c.UniverseDomain
+	}
+	if api.isGRPC() {
+		return fmt.Sprintf("%s.%s:443", api, universeDomain)
+	}
+	return fmt.Sprintf("https://%s.%s/", api, universeDomain)
+}
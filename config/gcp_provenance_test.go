@@ -0,0 +1,216 @@
+package config
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProvenanceMetadata(t *testing.T) {
+	updated := time.Date(2025, 6, 7, 1, 2, 3, 0, time.UTC)
+	want := Provenance{
+		Identity:   "reader@my-project.iam.gserviceaccount.com",
+		URI:        "gs://my-logs/activity.json",
+		Generation: 1749258123000000,
+		Md5Hash:    "hV21f35g+E6Nohk2fMqfFA==",
+		Crc32c:     "AAAAAA==",
+		Updated:    &updated,
+	}
+
+	metadata := map[string]string{"year": "2025"}
+	if err := want.SetMetadata(metadata); err != nil {
+		t.Fatalf("SetMetadata() error = %v", err)
+	}
+	got, err := ProvenanceFromMetadata(metadata)
+	if err != nil {
+		t.Fatalf("ProvenanceFromMetadata() error = %v", err)
+	}
+	if got == nil || !reflect.DeepEqual(*got, want) {
+		t.Errorf("ProvenanceFromMetadata() = %+v, want %+v", got, want)
+	}
+
+	if got, err := ProvenanceFromMetadata(map[string]string{"year": "2025"}); got != nil || err != nil {
+		t.Errorf("ProvenanceFromMetadata() without provenance = %+v, %v, want nil", got, err)
+	}
+	if _, err := ProvenanceFromMetadata(map[string]string{ProvenanceMetadataKey: "{"}); err == nil {
+		t.Error("ProvenanceFromMetadata() with invalid JSON did not return an error")
+	}
+}
+
+func TestGetEndpoint(t *testing.T) {
+	universeDomain := "example-universe.com"
+	loggingEndpoint := "logging.example.com:443"
+
+	tests := []struct {
+		name string
+		c    *GcpConnection
+		api  GcpAPI
+		want string
+	}{
+		{
+			name: "default logging",
+			c:    &GcpConnection{},
+			api:  LoggingAPI,
+			want: "logging.googleapis.com:443",
+		},
+		{
+			name: "default storage",
+			c:    &GcpConnection{},
+			api:  StorageAPI,
+			want: "https://storage.googleapis.com/",
+		},
+		{
+			name: "universe domain",
+			c:    &GcpConnection{UniverseDomain: &universeDomain},
+			api:  LoggingAPI,
+			want: "logging.example-universe.com:443",
+		},
+		{
+			name: "logging endpoint",
+			c:    &GcpConnection{UniverseDomain: &universeDomain, LoggingEndpoint: &loggingEndpoint},
+			api:  LoggingAPI,
+			want: loggingEndpoint,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.c.GetEndpoint(tt.api); got != tt.want {
+				t.Errorf("GetEndpoint() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// resetIdentityCache clears the identities cached by GetIdentity, before and after the test
+func resetIdentityCache(t *testing.T) {
+	reset := func() {
+		identityCache.Lock()
+		defer identityCache.Unlock()
+		identityCache.entries = make(map[string]*identityEntry)
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestGetIdentity(t *testing.T) {
+	server := newFakePermissionsServer(t, "ya29.token", nil)
+	newConnection := func(token string) *GcpConnection {
+		return &GcpConnection{ImpersonateAccessToken: &token}
+	}
+	tokenInfoRequests := func() int {
+		server.mut.Lock()
+		defer server.mut.Unlock()
+		return server.tokenInfoRequests
+	}
+
+	t.Run("resolved once", func(t *testing.T) {
+		resetIdentityCache(t)
+		before := tokenInfoRequests()
+		for range 2 {
+			if got := newConnection("ya29.token").GetIdentity(context.Background()); got != "reader@my-project.iam.gserviceaccount.com" {
+				t.Errorf("GetIdentity() = %q, want reader@my-project.iam.gserviceaccount.com", got)
+			}
+		}
+		if got := tokenInfoRequests() - before; got != 1 {
+			t.Errorf("made %d tokeninfo requests, want 1", got)
+		}
+	})
+
+	t.Run("failure cached", func(t *testing.T) {
+		resetIdentityCache(t)
+		before := tokenInfoRequests()
+		for range 2 {
+			if got := newConnection("ya29.expired").GetIdentity(context.Background()); got != "" {
+				t.Errorf("GetIdentity() = %q for an invalid token, want none", got)
+			}
+		}
+		if got := tokenInfoRequests() - before; got != 1 {
+			t.Errorf("made %d tokeninfo requests, want 1", got)
+		}
+
+		// once the retry interval has passed, the identity is resolved again
+		identityCache.Lock()
+		for _, entry := range identityCache.entries {
+			entry.retryAt = time.Now()
+		}
+		identityCache.Unlock()
+		newConnection("ya29.expired").GetIdentity(context.Background())
+		if got := tokenInfoRequests() - before; got != 2 {
+			t.Errorf("made %d tokeninfo requests after the retry interval, want 2", got)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		resetIdentityCache(t)
+		prevTimeout := identityTimeout
+		identityTimeout = 100 * time.Millisecond
+		t.Cleanup(func() { identityTimeout = prevTimeout })
+
+		block := make(chan struct{})
+		defer close(block)
+		server.mut.Lock()
+		server.blockedToken, server.tokenInfoBlock = "ya29.slow", block
+		server.mut.Unlock()
+		t.Cleanup(func() {
+			server.mut.Lock()
+			server.blockedToken, server.tokenInfoBlock = "", nil
+			server.mut.Unlock()
+		})
+
+		start := time.Now()
+		if got := newConnection("ya29.slow").GetIdentity(context.Background()); got != "" {
+			t.Errorf("GetIdentity() = %q when tokeninfo does not respond, want none", got)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("GetIdentity() took %s when tokeninfo does not respond, want it to time out", elapsed)
+		}
+	})
+
+	t.Run("other connections not blocked", func(t *testing.T) {
+		resetIdentityCache(t)
+		block := make(chan struct{})
+		server.mut.Lock()
+		server.blockedToken, server.tokenInfoBlock = "ya29.slow", block
+		server.mut.Unlock()
+		t.Cleanup(func() {
+			server.mut.Lock()
+			server.blockedToken, server.tokenInfoBlock = "", nil
+			server.mut.Unlock()
+		})
+
+		slow := make(chan string)
+		go func() { slow <- newConnection("ya29.slow").GetIdentity(context.Background()) }()
+		// wait for the slow identity to be requested
+		for !hasIdentityEntry(newConnection("ya29.slow")) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// the identity of another connection is resolved while the slow identity is being resolved
+		done := make(chan string)
+		go func() { done <- newConnection("ya29.token").GetIdentity(context.Background()) }()
+		select {
+		case got := <-done:
+			if got != "reader@my-project.iam.gserviceaccount.com" {
+				t.Errorf("GetIdentity() = %q, want reader@my-project.iam.gserviceaccount.com", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("GetIdentity() blocked by the identity of another connection being resolved")
+		}
+
+		close(block)
+		<-slow
+	})
+}
+
+// hasIdentityEntry returns whether GetIdentity has started resolving the identity of the connection
+func hasIdentityEntry(c *GcpConnection) bool {
+	key, err := c.cacheKey()
+	if err != nil {
+		return false
+	}
+	identityCache.Lock()
+	defer identityCache.Unlock()
+	_, ok := identityCache.entries[key]
+	return ok
+}
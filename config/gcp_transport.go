@@ -0,0 +1,233 @@
+package config
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"google.golang.org/api/option"
+	"google.golang.org/api/transport"
+	htransport "google.golang.org/api/transport/http"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// the default universe domain of the Google APIs
+const defaultUniverseDomain = "googleapis.com"
+
+// GcpAPI is an API a client is created for, which determines the endpoint, and whether the proxy and CA bundle
+// are applied to an HTTP or gRPC client
+type GcpAPI string
+
+const (
+	// LoggingAPI is the Cloud Logging API (gRPC), used by logadmin and the logging v2 client
+	LoggingAPI GcpAPI = "logging"
+	// StorageAPI is the Cloud Storage JSON API (HTTP)
+	StorageAPI GcpAPI = "storage"
+	// PubSubAPI is the Pub/Sub API (HTTP)
+	PubSubAPI GcpAPI = "pubsub"
+)
+
+func (a GcpAPI) isGRPC() bool {
+	return a == LoggingAPI
+}
+
+// getEndpoint returns the endpoint set for the API, or an empty string to use the default endpoint
+func (c *GcpConnection) getEndpoint(api GcpAPI) string {
+	switch {
+	case api == LoggingAPI && c.LoggingEndpoint != nil:
+		return *c.LoggingEndpoint
+	case api == StorageAPI && c.StorageEndpoint != nil:
+		return *c.StorageEndpoint
+	case api == resourceManagerAPI:
+		return resourceManagerEndpoint
+	}
+	return ""
+}
+
+// baseTransport returns the transport for requests through https_proxy, trusting the ca_bundle,
+// or nil if neither is set
+func (c *GcpConnection) baseTransport() (*http.Transport, error) {
+	if c.HttpsProxy == nil && c.CaBundle == nil {
+		return nil, nil
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	t.TLSClientConfig = tlsConfig
+	if c.HttpsProxy != nil {
+		proxyURL, err := parseProxyURL(*c.HttpsProxy)
+		if err != nil {
+			return nil, err
+		}
+		t.Proxy = http.ProxyURL(proxyURL)
+	}
+	return t, nil
+}
+
+// tlsConfig returns the TLS configuration trusting the system certificates and the ca_bundle, if set
+func (c *GcpConnection) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CaBundle == nil {
+		return tlsConfig, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	path, err := homedir.Expand(*c.CaBundle)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ca_bundle: %w", err)
+	}
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ca_bundle: %w", err)
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("invalid ca_bundle %s, the file contains no PEM certificates", *c.CaBundle)
+	}
+	tlsConfig.RootCAs = pool
+	return tlsConfig, nil
+}
+
+func parseProxyURL(value string) (*url.URL, error) {
+	proxyURL, err := url.Parse(value)
+	if err != nil || (proxyURL.Scheme != "http" && proxyURL.Scheme != "https") || proxyURL.Host == "" {
+		// the URL may contain credentials, so it is not included in the error
+		return nil, fmt.Errorf("invalid https_proxy, expected an http or https URL, e.g. http://proxy.example.com:3128")
+	}
+	return proxyURL, nil
+}
+
+// transportOptions returns the client options to make requests to the API using the base transport
+//
+// The client libraries create their own transport from the options, so for HTTP APIs the authenticated client is
+// created here, and for gRPC APIs the credentials are created here, so that token requests use the base transport,
+// and the dial options connect through the proxy and trust the CA bundle.
+func (c *GcpConnection) transportOptions(ctx context.Context, api GcpAPI, baseTransport *http.Transport, authOpts, settingsOpts []option.ClientOption) ([]option.ClientOption, error) {
+	// the scopes are otherwise set by each client library
+	scopeOpts := []option.ClientOption{option.WithScopes(c.GetScopes()...)}
+
+	if !api.isGRPC() {
+		rt, err := htransport.NewTransport(ctx, baseTransport, slices.Concat(authOpts, scopeOpts, settingsOpts)...)
+		if err != nil {
+			return nil, fmt.Errorf("error creating %s client transport: %w", api, err)
+		}
+		opts := []option.ClientOption{option.WithHTTPClient(&http.Client{Transport: rt})}
+		// the quota project is set by the transport, and cannot be set with an HTTP client
+		if c.UniverseDomain != nil {
+			opts = append(opts, option.WithUniverseDomain(*c.UniverseDomain))
+		}
+		return opts, nil
+	}
+
+	opts := slices.Clone(settingsOpts)
+	if c.withoutAuthentication() {
+		opts = append(opts, authOpts...)
+	} else {
+		creds, err := transport.Creds(ctx, slices.Concat(authOpts, scopeOpts)...)
+		if err != nil {
+			return nil, fmt.Errorf("error creating %s client credentials: %w", api, err)
+		}
+		opts = append(opts, option.WithCredentials(creds))
+	}
+
+	// these dial options are applied after those of the client library, so replace its transport credentials and dialer
+	opts = append(opts, option.WithGRPCDialOption(grpc.WithTransportCredentials(credentials.NewTLS(baseTransport.TLSClientConfig))))
+	if c.HttpsProxy != nil {
+		// the proxy is validated when the base transport is created
+		proxyURL, _ := parseProxyURL(*c.HttpsProxy)
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithContextDialer(proxyDialer(proxyURL, baseTransport.TLSClientConfig))))
+	}
+	return opts, nil
+}
+
+// proxyDialer returns a dialer which connects to the address through an HTTP CONNECT tunnel in the proxy
+func proxyDialer(proxyURL *url.URL, tlsConfig *tls.Config) func(context.Context, string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		proxyAddr := proxyURL.Host
+		if proxyURL.Port() == "" {
+			port := "80"
+			if proxyURL.Scheme == "https" {
+				port = "443"
+			}
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+		}
+
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to https_proxy: %w", err)
+		}
+		if proxyURL.Scheme == "https" {
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname(), RootCAs: tlsConfig.RootCAs, MinVersion: tls.VersionTLS12})
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("error connecting to https_proxy: %w", err)
+			}
+			conn = tlsConn
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			auth := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+			req.Header.Set("Proxy-Authorization", "Basic "+auth)
+		}
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error connecting to %s through https_proxy: %w", addr, err)
+		}
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error connecting to %s through https_proxy: %w", addr, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, fmt.Errorf("error connecting to %s through https_proxy: %s", addr, resp.Status)
+		}
+		_ = conn.SetDeadline(time.Time{})
+
+		// the proxy may have sent data after the response, which is in the reader buffer
+		if br.Buffered() > 0 {
+			return &bufferedConn{Conn: conn, reader: br}, nil
+		}
+		return conn, nil
+	}
+}
+
+// bufferedConn is a net.Conn which reads from a buffered reader of the connection
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
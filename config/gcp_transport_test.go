@@ -0,0 +1,183 @@
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+// connectProxy is an HTTP CONNECT proxy, which records the addresses tunnelled to
+type connectProxy struct {
+	*httptest.Server
+
+	mut   sync.Mutex
+	hosts []string
+}
+
+func newConnectProxy(t *testing.T) *connectProxy {
+	p := &connectProxy{}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		p.mut.Lock()
+		p.hosts = append(p.hosts, r.Host)
+		p.mut.Unlock()
+
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			defer target.Close()
+			_, _ = io.Copy(target, conn)
+		}()
+		go func() {
+			defer conn.Close()
+			_, _ = io.Copy(conn, target)
+		}()
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *connectProxy) tunnelledHosts() []string {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	return p.hosts
+}
+
+// caBundle writes the certificate of the TLS server to a PEM file, returning the path
+func caBundle(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+	return writeFile(t, "ca.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})))
+}
+
+func TestGetClientOptionsProxy(t *testing.T) {
+	proxy := newConnectProxy(t)
+
+	var mut sync.Mutex
+	var header http.Header
+	api := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		header = r.Header.Clone()
+		mut.Unlock()
+		if r.URL.Path != "/storage/v1/b/my-bucket" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"kind": "storage#bucket", "name": "my-bucket"})
+	}))
+	defer api.Close()
+	apiURL, _ := url.Parse(api.URL)
+
+	tokenFile := writeFile(t, "token", "proxy-token")
+	endpoint := api.URL + "/storage/v1/"
+	quotaProject := "billing-project"
+	proxyURL := proxy.URL
+	bundle := caBundle(t, api)
+
+	getBucket := func(c *GcpConnection) (*storage.BucketAttrs, error) {
+		ctx := context.Background()
+		opts, err := c.GetClientOptions(ctx, StorageAPI)
+		if err != nil {
+			return nil, err
+		}
+		client, err := storage.NewClient(ctx, opts...)
+		if err != nil {
+			return nil, err
+		}
+		defer client.Close()
+		return client.Bucket("my-bucket").Attrs(ctx)
+	}
+
+	conn := &GcpConnection{
+		AccessTokenFile: &tokenFile,
+		QuotaProject:    &quotaProject,
+		StorageEndpoint: &endpoint,
+		HttpsProxy:      &proxyURL,
+		CaBundle:        &bundle,
+	}
+	if err := conn.Validate(); err != nil {
+		t.Fatalf("invalid connection: %s", err)
+	}
+	attrs, err := getBucket(conn)
+	if err != nil {
+		t.Fatalf("error getting bucket: %s", err)
+	}
+	if attrs.Name != "my-bucket" {
+		t.Errorf("got bucket %q, want my-bucket", attrs.Name)
+	}
+
+	mut.Lock()
+	if got, want := header.Get("Authorization"), "Bearer proxy-token"; got != want {
+		t.Errorf("got Authorization %q, want %q", got, want)
+	}
+	if got := header.Get("X-Goog-User-Project"); got != quotaProject {
+		t.Errorf("got X-Goog-User-Project %q, want %q", got, quotaProject)
+	}
+	mut.Unlock()
+	if got := proxy.tunnelledHosts(); len(got) == 0 || got[0] != apiURL.Host {
+		t.Errorf("got proxy tunnels to %v, want %s", got, apiURL.Host)
+	}
+
+	// without the CA bundle, the certificate of the endpoint is not trusted
+	conn.CaBundle = nil
+	if _, err := getBucket(conn); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("got error %v, want a certificate error", err)
+	}
+}
+
+func TestProxyDialer(t *testing.T) {
+	proxy := newConnectProxy(t)
+	api := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer api.Close()
+	apiURL, _ := url.Parse(api.URL)
+
+	bundle := caBundle(t, api)
+	proxyURL := proxy.URL
+	c := &GcpConnection{HttpsProxy: &proxyURL, CaBundle: &bundle}
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedProxyURL, err := parseProxyURL(proxyURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// this is the dialer used for gRPC connections, which then make a TLS handshake with the endpoint
+	conn, err := proxyDialer(parsedProxyURL, tlsConfig)(context.Background(), apiURL.Host)
+	if err != nil {
+		t.Fatalf("error dialing through proxy: %s", err)
+	}
+	defer conn.Close()
+	tlsConn := tls.Client(conn, &tls.Config{RootCAs: tlsConfig.RootCAs, ServerName: "example.com", MinVersion: tls.VersionTLS12})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("error making TLS handshake through proxy: %s", err)
+	}
+
+	if got := proxy.tunnelledHosts(); len(got) != 1 || got[0] != apiURL.Host {
+		t.Errorf("got proxy tunnels to %v, want %s", got, apiURL.Host)
+	}
+}
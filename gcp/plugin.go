@@ -1,12 +1,16 @@
 package gcp
 
 import (
+	"context"
+	"errors"
+
 	"github.com/turbot/go-kit/helpers"
 	"github.com/turbot/tailpipe-plugin-gcp/config"
 	"github.com/turbot/tailpipe-plugin-gcp/sources/audit_log_api"
 	"github.com/turbot/tailpipe-plugin-gcp/sources/storage_bucket"
 	"github.com/turbot/tailpipe-plugin-gcp/tables/audit_log"
 	"github.com/turbot/tailpipe-plugin-gcp/tables/billing_report"
+	"github.com/turbot/tailpipe-plugin-gcp/tables/storage_inventory"
 	"github.com/turbot/tailpipe-plugin-sdk/plugin"
 	"github.com/turbot/tailpipe-plugin-sdk/row_source"
 	"github.com/turbot/tailpipe-plugin-sdk/table"
@@ -22,12 +26,18 @@ func init() {
 	// 2. table implementation
 	table.RegisterTable[*audit_log.AuditLog, *audit_log.AuditLogTable]()
 	table.RegisterCustomTable[*billing_report.BillingReportTable]()
+	table.RegisterTable[*storage_inventory.StorageInventory, *storage_inventory.StorageInventoryTable]()
 
 	// register sources
 	row_source.RegisterRowSource[*audit_log_api.AuditLogAPISource]()
 	row_source.RegisterRowSource[*storage_bucket.GcpStorageBucketSource]()
 }
 
+// Shutdown closes the GCP clients shared by the sources
+func (p *Plugin) Shutdown(ctx context.Context) error {
+	return errors.Join(config.CloseClients(), p.PluginImpl.Shutdown(ctx))
+}
+
 func NewPlugin() (_ plugin.TailpipePlugin, err error) {
 	defer func() {
 		if r := recover(); r != nil {
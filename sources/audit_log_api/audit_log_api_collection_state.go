@@ -0,0 +1,169 @@
+package audit_log_api
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/turbot/tailpipe-plugin-sdk/collection_state"
+)
+
+// TailSuppression records log entries which the Logging API omitted from a tail session
+type TailSuppression struct {
+	// the suppression reason reported by the API, e.g. RATE_LIMIT or NOT_CONSUMED
+	Reason string `json:"reason"`
+	// a lower bound on the number of entries omitted
+	Count     int64     `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// TailedTimeRange records the time range of the log entries collected by a tail session
+type TailedTimeRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// Contains returns whether the timestamp is within the tailed time range
+func (r *TailedTimeRange) Contains(timestamp time.Time) bool {
+	return !timestamp.Before(r.From) && timestamp.Before(r.To)
+}
+
+// AuditLogAPICollectionState is a [collection_state.TimeRangeCollectionState] which also records
+// any entries suppressed while tailing, so that gaps in the collected data can be identified.
+//
+// Entries streamed by a tail session are after the end of the collection time range, so are not tracked by the
+// time range state - the state records the tailed time ranges itself, so the entries are not collected again
+// by a later collection.
+type AuditLogAPICollectionState struct {
+	*collection_state.TimeRangeCollectionState
+
+	TailSuppressions []*TailSuppression `json:"tail_suppressions,omitempty"`
+	TailedTimeRanges []*TailedTimeRange `json:"tailed_time_ranges,omitempty"`
+
+	// the active tail session, its end time and the insert ids of the entries it has collected
+	activeTail *TailedTimeRange
+	tailTo     time.Time
+	tailIds    map[string]struct{}
+
+	// the suppressions may be updated while the state is being saved
+	mut sync.Mutex
+}
+
+func NewAuditLogAPICollectionState() collection_state.CollectionState {
+	return &AuditLogAPICollectionState{
+		TimeRangeCollectionState: collection_state.NewTimeRangeCollectionState().(*collection_state.TimeRangeCollectionState),
+	}
+}
+
+// OnSuppressed records that the given number of entries were suppressed for the given reason
+func (s *AuditLogAPICollectionState) OnSuppressed(reason string, count int64, timestamp time.Time) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for _, suppression := range s.TailSuppressions {
+		if suppression.Reason == reason {
+			suppression.Count += count
+			suppression.LastSeen = timestamp
+			return
+		}
+	}
+
+	s.TailSuppressions = append(s.TailSuppressions, &TailSuppression{
+		Reason:    reason,
+		Count:     count,
+		FirstSeen: timestamp,
+		LastSeen:  timestamp,
+	})
+}
+
+// StartTail starts tracking the entries of a tail session collecting the entries between from and to
+func (s *AuditLogAPICollectionState) StartTail(from, to time.Time) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.activeTail = &TailedTimeRange{From: from, To: from}
+	s.tailTo = to
+	s.tailIds = make(map[string]struct{})
+}
+
+// EndTail records that all entries of the active tail session have been collected
+// if the session fails, EndTail is not called and the entries are collected again by the next collection
+func (s *AuditLogAPICollectionState) EndTail() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.activeTail == nil {
+		return
+	}
+	s.activeTail.To = s.tailTo
+	s.TailedTimeRanges = append(s.TailedTimeRanges, s.activeTail)
+	s.activeTail = nil
+	s.tailIds = nil
+}
+
+// ShouldCollect returns whether the entry should be collected
+// entries within the active tail session are collected once, and entries within a completed tail session are skipped
+func (s *AuditLogAPICollectionState) ShouldCollect(id string, timestamp time.Time) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.inActiveTail(timestamp) {
+		_, collected := s.tailIds[id]
+		return !collected
+	}
+	for _, tailedTimeRange := range s.TailedTimeRanges {
+		if tailedTimeRange.Contains(timestamp) {
+			return false
+		}
+	}
+	return s.TimeRangeCollectionState.ShouldCollect(id, timestamp)
+}
+
+// OnCollected records that the entry has been collected
+func (s *AuditLogAPICollectionState) OnCollected(id string, timestamp time.Time) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.inActiveTail(timestamp) {
+		s.tailIds[id] = struct{}{}
+		return nil
+	}
+	return s.TimeRangeCollectionState.OnCollected(id, timestamp)
+}
+
+// Clear clears the time range, and any tailed time ranges which overlap it, so the entries are collected again
+func (s *AuditLogAPICollectionState) Clear(timeRange collection_state.DirectionalTimeRange) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.TimeRangeCollectionState.Clear(timeRange)
+
+	var tailedTimeRanges []*TailedTimeRange
+	for _, tailedTimeRange := range s.TailedTimeRanges {
+		if tailedTimeRange.To.After(timeRange.LowerBoundary) && (timeRange.UpperBoundary.IsZero() || tailedTimeRange.From.Before(timeRange.UpperBoundary)) {
+			continue
+		}
+		tailedTimeRanges = append(tailedTimeRanges, tailedTimeRange)
+	}
+	s.TailedTimeRanges = tailedTimeRanges
+}
+
+func (s *AuditLogAPICollectionState) MarshalJSON() ([]byte, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	return json.Marshal(struct {
+		*collection_state.TimeRangeCollectionState
+		TailSuppressions []*TailSuppression `json:"tail_suppressions,omitempty"`
+		TailedTimeRanges []*TailedTimeRange `json:"tailed_time_ranges,omitempty"`
+	}{
+		TimeRangeCollectionState: s.TimeRangeCollectionState,
+		TailSuppressions:         s.TailSuppressions,
+		TailedTimeRanges:         s.TailedTimeRanges,
+	})
+}
+
+func (s *AuditLogAPICollectionState) inActiveTail(timestamp time.Time) bool {
+	return s.activeTail != nil && !timestamp.Before(s.activeTail.From) && timestamp.Before(s.tailTo)
+}
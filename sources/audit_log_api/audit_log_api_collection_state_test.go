@@ -0,0 +1,98 @@
+package audit_log_api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/turbot/tailpipe-plugin-sdk/collection_state"
+)
+
+func TestCollectionStateTail(t *testing.T) {
+	from := time.Date(2025, 6, 7, 0, 0, 0, 0, time.UTC)
+	tailFrom := from.Add(time.Hour)
+	tailTo := tailFrom.Add(15 * time.Minute)
+
+	newState := func() *AuditLogAPICollectionState {
+		state := NewAuditLogAPICollectionState().(*AuditLogAPICollectionState)
+		state.Init(collection_state.DirectionalTimeRange{
+			LowerBoundary:   from,
+			UpperBoundary:   tailFrom,
+			CollectionOrder: collection_state.CollectionOrderChronological,
+		}, time.Minute)
+		return state
+	}
+
+	state := newState()
+	state.StartTail(tailFrom, tailTo)
+
+	tailed := tailFrom.Add(time.Minute)
+	if !state.ShouldCollect("a", tailed) {
+		t.Fatalf("ShouldCollect() = false for an entry in the active tail session, want true")
+	}
+	if err := state.OnCollected("a", tailed); err != nil {
+		t.Fatalf("OnCollected() error = %v", err)
+	}
+	if state.ShouldCollect("a", tailed) {
+		t.Errorf("ShouldCollect() = true for an entry already tailed, want false")
+	}
+	if !state.ShouldCollect("b", tailed) {
+		t.Errorf("ShouldCollect() = false for another entry in the active tail session, want true")
+	}
+	if state.ShouldCollect("c", tailTo) {
+		t.Errorf("ShouldCollect() = true for an entry after the tail session, want false")
+	}
+	if state.GetToTime().After(tailFrom) {
+		t.Errorf("GetToTime() = %v, want the collection time range to be unchanged by tailing", state.GetToTime())
+	}
+
+	state.EndTail()
+	if state.ShouldCollect("b", tailed) {
+		t.Errorf("ShouldCollect() = true for an entry in a completed tail session, want false")
+	}
+
+	// the tailed time ranges are saved, so a later collection does not collect the entries again
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatalf("MarshalJSON() error = %v", err)
+	}
+	loaded := newState()
+	if err := json.Unmarshal(data, loaded); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	loaded.Init(collection_state.DirectionalTimeRange{
+		LowerBoundary:   tailFrom,
+		UpperBoundary:   tailTo.Add(time.Hour),
+		CollectionOrder: collection_state.CollectionOrderChronological,
+	}, time.Minute)
+	if loaded.ShouldCollect("b", tailed) {
+		t.Errorf("ShouldCollect() = true for an entry tailed by a previous collection, want false")
+	}
+	if !loaded.ShouldCollect("d", tailTo.Add(time.Minute)) {
+		t.Errorf("ShouldCollect() = false for an entry after the tailed time range, want true")
+	}
+
+	// clearing the time range forgets the tailed time range
+	loaded.Clear(collection_state.DirectionalTimeRange{
+		LowerBoundary:   tailFrom,
+		CollectionOrder: collection_state.CollectionOrderChronological,
+	})
+	if len(loaded.TailedTimeRanges) != 0 {
+		t.Errorf("TailedTimeRanges = %v after Clear(), want none", loaded.TailedTimeRanges)
+	}
+}
+
+func TestCollectionStateFailedTail(t *testing.T) {
+	tailFrom := time.Date(2025, 6, 7, 0, 0, 0, 0, time.UTC)
+
+	state := NewAuditLogAPICollectionState().(*AuditLogAPICollectionState)
+	state.StartTail(tailFrom, tailFrom.Add(time.Hour))
+	if err := state.OnCollected("a", tailFrom); err != nil {
+		t.Fatalf("OnCollected() error = %v", err)
+	}
+
+	// a tail session which does not complete is not recorded
+	if len(state.TailedTimeRanges) != 0 {
+		t.Errorf("TailedTimeRanges = %v for an incomplete tail session, want none", state.TailedTimeRanges)
+	}
+}
@@ -0,0 +1,228 @@
+package audit_log_api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"cloud.google.com/go/logging/logadmin"
+	"github.com/googleapis/gax-go/v2"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/turbot/tailpipe-plugin-sdk/collection_state"
+)
+
+// shardPrefetchPages is the number of pages each shard may fetch ahead of the shard currently being collected
+const shardPrefetchPages = 20
+
+// retryableCodes are the gRPC codes returned by entries.list which indicate a transient failure
+// (ResourceExhausted is returned when the per-minute read quota is exceeded)
+var retryableCodes = map[codes.Code]struct{}{
+	codes.ResourceExhausted: {},
+	codes.Unavailable:       {},
+	codes.DeadlineExceeded:  {},
+	codes.Internal:          {},
+	codes.Aborted:           {},
+}
+
+// listEntriesSharded splits the time range into the configured number of windows and fetches them concurrently,
+// calling onPage for each page.
+//
+// All shards share the source rate limiter. Pages are passed to onPage from a single goroutine, in window order,
+// so the collection state always sees entries in chronological order. Each shard may fetch up to
+// shardPrefetchPages pages ahead of the shard currently being passed to onPage.
+func (s *AuditLogAPISource) listEntriesSharded(ctx context.Context, client *logadmin.Client, timeRange collection_state.DirectionalTimeRange, onPage func([]*logging.Entry) error) error {
+	windows := splitTimeRange(timeRange, s.Config.GetShards())
+	if len(windows) == 1 {
+		return s.listEntries(ctx, client, timeRange, onPage)
+	}
+
+	slog.Info("AuditLogAPISource fetching log entries in shards", "shards", len(windows), "from", timeRange.StartTime(), "to", timeRange.EndTime())
+
+	// cancel any running shards if we return early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pageChans := make([]chan []*logging.Entry, len(windows))
+	shardErrors := make([]error, len(windows))
+	var wg sync.WaitGroup
+	for i, window := range windows {
+		pageChans[i] = make(chan []*logging.Entry, shardPrefetchPages)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(pageChans[i])
+			shardErrors[i] = s.listEntries(ctx, client, window, func(entries []*logging.Entry) error {
+				select {
+				case pageChans[i] <- entries:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		}()
+	}
+
+	// collect the shards in order - do not move on to the next shard unless the previous one completed successfully
+	var err error
+	for i := range windows {
+		for entries := range pageChans[i] {
+			if err = onPage(entries); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			// the channel is closed after the shard error is set
+			err = shardErrors[i]
+		}
+		if err != nil {
+			err = fmt.Errorf("error fetching log entries from %s to %s, %w", windows[i].StartTime().Format(time.RFC3339), windows[i].EndTime().Format(time.RFC3339), err)
+			break
+		}
+	}
+
+	// stop any remaining shards and wait for them to exit
+	cancel()
+	wg.Wait()
+
+	return err
+}
+
+// splitTimeRange splits the time range into (at most) n contiguous windows of equal length
+func splitTimeRange(timeRange collection_state.DirectionalTimeRange, n int) []collection_state.DirectionalTimeRange {
+	start, end := timeRange.LowerBoundary, timeRange.UpperBoundary
+	// we cannot split an open-ended range
+	if n <= 1 || end.IsZero() || !end.After(start) {
+		return []collection_state.DirectionalTimeRange{timeRange}
+	}
+
+	windowLength := end.Sub(start) / time.Duration(n)
+	if windowLength <= 0 {
+		return []collection_state.DirectionalTimeRange{timeRange}
+	}
+
+	windows := make([]collection_state.DirectionalTimeRange, 0, n)
+	for i := 0; i < n; i++ {
+		window := collection_state.DirectionalTimeRange{
+			LowerBoundary:   start.Add(time.Duration(i) * windowLength),
+			UpperBoundary:   start.Add(time.Duration(i+1) * windowLength),
+			CollectionOrder: timeRange.CollectionOrder,
+		}
+		// the final window ends at the end of the range
+		if i == n-1 {
+			window.UpperBoundary = end
+		}
+		windows = append(windows, window)
+	}
+	return windows
+}
+
+// listEntries fetches the log entries for the given time range a page at a time, calling onPage for each page.
+//
+// Every request waits on the source rate limiter. Retryable errors are retried with exponential backoff,
+// resuming from the last page token. If a page token is rejected (e.g. because it has expired),
+// the request is restarted from the timestamp of the last entry received - the collection state
+// ensures entries at that timestamp are not collected twice.
+func (s *AuditLogAPISource) listEntries(ctx context.Context, client *logadmin.Client, timeRange collection_state.DirectionalTimeRange, onPage func([]*logging.Entry) error) error {
+	maxRetries := s.Config.GetMaxRetries()
+	backoff := newEntriesBackoff()
+
+	var pageToken string
+	var lastTimestamp time.Time
+	retries := 0
+	for {
+		entries, nextPageToken, err := s.fetchPage(ctx, client, timeRange, pageToken)
+		if err != nil {
+			code := status.Code(err)
+			tokenRejected := isPageTokenRejected(err, pageToken, lastTimestamp)
+			if (!isRetryable(err) && !tokenRejected) || retries >= maxRetries {
+				return fmt.Errorf("error fetching log entries after %d retries, %w", retries, err)
+			}
+
+			retries++
+			atomic.AddInt64(&s.retryCount, 1)
+			if tokenRejected {
+				slog.Warn("AuditLogAPISource page token rejected, resuming from last entry timestamp", "timestamp", lastTimestamp, "attempt", retries, "error", err)
+				pageToken = ""
+				timeRange.LowerBoundary = lastTimestamp
+				continue
+			}
+
+			pause := backoff.Pause()
+			slog.Warn("AuditLogAPISource retrying log entries request", "code", code.String(), "attempt", retries, "max_retries", maxRetries, "backoff", pause, "error", err)
+			if err := gax.Sleep(ctx, pause); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// the request succeeded - reset the retries
+		retries = 0
+		backoff = newEntriesBackoff()
+
+		if len(entries) > 0 {
+			lastTimestamp = entries[len(entries)-1].Timestamp
+			if err := onPage(entries); err != nil {
+				return err
+			}
+		}
+
+		if nextPageToken == "" {
+			return nil
+		}
+		pageToken = nextPageToken
+	}
+}
+
+// isRetryable returns whether the entries.list error indicates a transient failure, so the request can be retried
+func isRetryable(err error) bool {
+	_, ok := retryableCodes[status.Code(err)]
+	return ok
+}
+
+// isPageTokenRejected returns whether the entries.list request was rejected because of its page token - an expired
+// page token is reported as an invalid argument, so the request can be restarted from the last timestamp received
+func isPageTokenRejected(err error, pageToken string, lastTimestamp time.Time) bool {
+	return status.Code(err) == codes.InvalidArgument && pageToken != "" && !lastTimestamp.IsZero()
+}
+
+// fetchPage makes a single rate limited entries.list request, returning the entries and the next page token
+func (s *AuditLogAPISource) fetchPage(ctx context.Context, client *logadmin.Client, timeRange collection_state.DirectionalTimeRange, pageToken string) ([]*logging.Entry, string, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, "", fmt.Errorf("error acquiring rate limiter: %w", err)
+	}
+	defer s.limiter.Release()
+
+	pageSize := s.Config.GetPageSize()
+	opts := []logadmin.EntriesOption{
+		logadmin.Filter(s.getLogFilter(s.project, s.Config.LogTypes, timeRange)),
+		logadmin.PageSize(int32(pageSize)), //nolint:gosec // page size is validated to be at most 1000
+	}
+	if len(s.Config.ResourceNames) > 0 {
+		opts = append(opts, logadmin.ResourceNames(s.Config.ResourceNames))
+	}
+
+	var entries []*logging.Entry
+	pager := iterator.NewPager(client.Entries(ctx, opts...), pageSize, pageToken)
+	nextPageToken, err := pager.NextPage(&entries)
+	if err != nil {
+		return nil, "", err
+	}
+	return entries, nextPageToken, nil
+}
+
+// newEntriesBackoff returns the backoff used between retries of a failed entries.list request
+// the maximum pause matches the one minute quota window
+func newEntriesBackoff() gax.Backoff {
+	return gax.Backoff{
+		Initial:    time.Second,
+		Max:        time.Minute,
+		Multiplier: 2,
+	}
+}
@@ -0,0 +1,377 @@
+package audit_log_api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"cloud.google.com/go/logging/apiv2/loggingpb"
+	"cloud.google.com/go/logging/logadmin"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/turbot/tailpipe-plugin-sdk/collection_state"
+	"github.com/turbot/tailpipe-plugin-sdk/rate_limiter"
+)
+
+var (
+	filterFromRegex = regexp.MustCompile(`timestamp >= "([^"]+)"`)
+	filterToRegex   = regexp.MustCompile(`timestamp < "([^"]+)"`)
+)
+
+// fakeLoggingServer serves entries.list for the entries with the given timestamps, filtering them by the time range
+// of the request filter - the page token is the offset of the next entry in the matching entries
+type fakeLoggingServer struct {
+	loggingpb.UnimplementedLoggingServiceV2Server
+
+	mut        sync.Mutex
+	timestamps []time.Time
+	// errors returned by the next requests, in order
+	errs []error
+	// if true, the first request with a page token is rejected as if the token had expired
+	rejectPageToken bool
+	// if set, the time to wait before responding to a request for entries from the time
+	delay func(from time.Time) time.Duration
+}
+
+func (f *fakeLoggingServer) ListLogEntries(ctx context.Context, req *loggingpb.ListLogEntriesRequest) (*loggingpb.ListLogEntriesResponse, error) {
+	f.mut.Lock()
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		f.mut.Unlock()
+		return nil, err
+	}
+	if f.rejectPageToken && req.PageToken != "" {
+		f.rejectPageToken = false
+		f.mut.Unlock()
+		return nil, status.Error(codes.InvalidArgument, "page token has expired")
+	}
+	f.mut.Unlock()
+
+	from, to := parseFilterTime(filterFromRegex, req.Filter), parseFilterTime(filterToRegex, req.Filter)
+	if f.delay != nil {
+		select {
+		case <-time.After(f.delay(from)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	var entries []*loggingpb.LogEntry
+	for i, ts := range f.timestamps {
+		if ts.Before(from) || (!to.IsZero() && !ts.Before(to)) {
+			continue
+		}
+		entries = append(entries, &loggingpb.LogEntry{
+			LogName:   "projects/p/logs/cloudaudit.googleapis.com%2Factivity",
+			InsertId:  strconv.Itoa(i),
+			Timestamp: timestamppb.New(ts),
+			Payload:   &loggingpb.LogEntry_TextPayload{TextPayload: "entry"},
+		})
+	}
+
+	offset, _ := strconv.Atoi(req.PageToken)
+	end := min(offset+int(req.PageSize), len(entries))
+	resp := &loggingpb.ListLogEntriesResponse{Entries: entries[offset:end]}
+	if end < len(entries) {
+		resp.NextPageToken = strconv.Itoa(end)
+	}
+	return resp, nil
+}
+
+func parseFilterTime(re *regexp.Regexp, filter string) time.Time {
+	match := re.FindStringSubmatch(filter)
+	if match == nil {
+		return time.Time{}
+	}
+	t, _ := time.Parse(time.RFC3339Nano, match[1])
+	return t
+}
+
+// newFakeLoggingClient starts the fake server, returning a logadmin client connected to it
+func newFakeLoggingClient(t *testing.T, f *fakeLoggingServer) *logadmin.Client {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	loggingpb.RegisterLoggingServiceV2Server(server, f)
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := logadmin.NewClient(context.Background(), "projects/p", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+// newTestSource returns a source with the config, which is not rate limited
+func newTestSource(config *AuditLogAPISourceConfig) *AuditLogAPISource {
+	s := &AuditLogAPISource{project: "p"}
+	s.Config = config
+	s.limiter = rate_limiter.NewAPILimiter(&rate_limiter.Definition{
+		Name:       "test",
+		FillRate:   rate.Inf,
+		BucketSize: 1,
+	})
+	return s
+}
+
+// minuteTimestamps returns n timestamps a minute apart from start
+func minuteTimestamps(start time.Time, n int) []time.Time {
+	timestamps := make([]time.Time, n)
+	for i := range timestamps {
+		timestamps[i] = start.Add(time.Duration(i) * time.Minute)
+	}
+	return timestamps
+}
+
+// collectTimestamps returns a page callback which records the timestamps of the entries in each page
+func collectTimestamps(got *[]time.Time) func([]*logging.Entry) error {
+	return func(entries []*logging.Entry) error {
+		for _, entry := range entries {
+			*got = append(*got, entry.Timestamp)
+		}
+		return nil
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: status.Error(codes.ResourceExhausted, "quota exceeded"), want: true},
+		{err: status.Error(codes.Unavailable, "unavailable"), want: true},
+		{err: status.Error(codes.DeadlineExceeded, "deadline exceeded"), want: true},
+		{err: status.Error(codes.Internal, "internal"), want: true},
+		{err: status.Error(codes.Aborted, "aborted"), want: true},
+		{err: status.Error(codes.InvalidArgument, "invalid filter"), want: false},
+		{err: status.Error(codes.PermissionDenied, "permission denied"), want: false},
+		{err: status.Error(codes.Unauthenticated, "unauthenticated"), want: false},
+		{err: status.Error(codes.NotFound, "not found"), want: false},
+		{err: errors.New("not a grpc error"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(status.Code(tt.err).String(), func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPageTokenRejected(t *testing.T) {
+	invalidArgument := status.Error(codes.InvalidArgument, "page token has expired")
+	lastTimestamp := time.Date(2025, 6, 7, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		err           error
+		pageToken     string
+		lastTimestamp time.Time
+		want          bool
+	}{
+		{name: "invalid page token", err: invalidArgument, pageToken: "token", lastTimestamp: lastTimestamp, want: true},
+		{name: "first page", err: invalidArgument, pageToken: "", lastTimestamp: time.Time{}, want: false},
+		{name: "no entries received", err: invalidArgument, pageToken: "token", lastTimestamp: time.Time{}, want: false},
+		{name: "other error", err: status.Error(codes.Unavailable, "unavailable"), pageToken: "token", lastTimestamp: lastTimestamp, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPageTokenRejected(tt.err, tt.pageToken, tt.lastTimestamp); got != tt.want {
+				t.Errorf("isPageTokenRejected() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListEntries(t *testing.T) {
+	start := time.Date(2025, 6, 7, 0, 0, 0, 0, time.UTC)
+	timestamps := minuteTimestamps(start, 10)
+	timeRange := collection_state.DirectionalTimeRange{LowerBoundary: start, UpperBoundary: start.Add(time.Hour)}
+	pageSize := 3
+
+	tests := []struct {
+		name            string
+		errs            []error
+		rejectPageToken bool
+		maxRetries      int
+		want            []time.Time
+		wantErr         codes.Code
+	}{
+		{
+			name: "pages",
+			want: timestamps,
+		},
+		{
+			// (the client retries Unavailable, DeadlineExceeded and Internal itself, so ResourceExhausted
+			// is used to test the source retries)
+			name:       "retryable error",
+			errs:       []error{status.Error(codes.ResourceExhausted, "quota exceeded")},
+			maxRetries: 1,
+			want:       timestamps,
+		},
+		{
+			name:       "retries exhausted",
+			errs:       []error{status.Error(codes.ResourceExhausted, "quota exceeded")},
+			maxRetries: 0,
+			wantErr:    codes.ResourceExhausted,
+		},
+		{
+			name:       "non-retryable error",
+			errs:       []error{status.Error(codes.PermissionDenied, "permission denied")},
+			maxRetries: 5,
+			wantErr:    codes.PermissionDenied,
+		},
+		{
+			// the request is restarted from the last timestamp received, so the last entry of the
+			// page before is received again - the collection state does not collect it twice
+			name:            "page token rejected",
+			rejectPageToken: true,
+			maxRetries:      1,
+			want:            append(append(append([]time.Time{}, timestamps[:3]...), timestamps[2]), timestamps[3:]...),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeLoggingClient(t, &fakeLoggingServer{timestamps: timestamps, errs: tt.errs, rejectPageToken: tt.rejectPageToken})
+			s := newTestSource(&AuditLogAPISourceConfig{MaxRetries: &tt.maxRetries, PageSize: &pageSize})
+
+			var got []time.Time
+			err := s.listEntries(context.Background(), client, timeRange, collectTimestamps(&got))
+			if tt.wantErr != codes.OK {
+				if status.Code(err) != tt.wantErr {
+					t.Fatalf("listEntries() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("listEntries() error = %v", err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("listEntries() entries = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitTimeRange(t *testing.T) {
+	start := time.Date(2025, 6, 7, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		timeRange collection_state.DirectionalTimeRange
+		n         int
+		want      [][2]time.Time
+	}{
+		{
+			name:      "single shard",
+			timeRange: collection_state.DirectionalTimeRange{LowerBoundary: start, UpperBoundary: start.Add(time.Hour)},
+			n:         1,
+			want:      [][2]time.Time{{start, start.Add(time.Hour)}},
+		},
+		{
+			name:      "equal windows",
+			timeRange: collection_state.DirectionalTimeRange{LowerBoundary: start, UpperBoundary: start.Add(3 * time.Hour)},
+			n:         3,
+			want:      [][2]time.Time{{start, start.Add(time.Hour)}, {start.Add(time.Hour), start.Add(2 * time.Hour)}, {start.Add(2 * time.Hour), start.Add(3 * time.Hour)}},
+		},
+		{
+			// the remainder is added to the final window
+			name:      "uneven windows",
+			timeRange: collection_state.DirectionalTimeRange{LowerBoundary: start, UpperBoundary: start.Add(10 * time.Nanosecond)},
+			n:         3,
+			want:      [][2]time.Time{{start, start.Add(3)}, {start.Add(3), start.Add(6)}, {start.Add(6), start.Add(10)}},
+		},
+		{
+			name:      "open-ended",
+			timeRange: collection_state.DirectionalTimeRange{LowerBoundary: start},
+			n:         4,
+			want:      [][2]time.Time{{start, {}}},
+		},
+		{
+			name:      "shorter than the number of shards",
+			timeRange: collection_state.DirectionalTimeRange{LowerBoundary: start, UpperBoundary: start.Add(2)},
+			n:         4,
+			want:      [][2]time.Time{{start, start.Add(2)}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			windows := splitTimeRange(tt.timeRange, tt.n)
+			got := make([][2]time.Time, len(windows))
+			for i, window := range windows {
+				got[i] = [2]time.Time{window.LowerBoundary, window.UpperBoundary}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("splitTimeRange() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListEntriesSharded(t *testing.T) {
+	start := time.Date(2025, 6, 7, 0, 0, 0, 0, time.UTC)
+	timestamps := minuteTimestamps(start, 60)
+	timeRange := collection_state.DirectionalTimeRange{LowerBoundary: start, UpperBoundary: start.Add(time.Hour)}
+	pageSize, shards := 4, 4
+
+	// the earliest windows are the slowest to respond, so the later shards complete first
+	client := newFakeLoggingClient(t, &fakeLoggingServer{
+		timestamps: timestamps,
+		delay: func(from time.Time) time.Duration {
+			return time.Duration(start.Add(time.Hour).Sub(from).Minutes()) * time.Millisecond
+		},
+	})
+	s := newTestSource(&AuditLogAPISourceConfig{PageSize: &pageSize, Shards: &shards})
+
+	var got []time.Time
+	if err := s.listEntriesSharded(context.Background(), client, timeRange, collectTimestamps(&got)); err != nil {
+		t.Fatalf("listEntriesSharded() error = %v", err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(timestamps) {
+		t.Errorf("listEntriesSharded() entries = %v, want %v", got, timestamps)
+	}
+
+	t.Run("shard error", func(t *testing.T) {
+		maxRetries := 0
+		client := newFakeLoggingClient(t, &fakeLoggingServer{
+			timestamps: timestamps,
+			errs:       []error{status.Error(codes.PermissionDenied, "permission denied")},
+		})
+		s := newTestSource(&AuditLogAPISourceConfig{PageSize: &pageSize, Shards: &shards, MaxRetries: &maxRetries})
+
+		var got []time.Time
+		err := s.listEntriesSharded(context.Background(), client, timeRange, collectTimestamps(&got))
+		if err == nil || !strings.Contains(err.Error(), "permission denied") {
+			t.Fatalf("listEntriesSharded() error = %v, want permission denied", err)
+		}
+		// whichever shard failed, no entries after it are collected
+		if len(got) > len(timestamps) || fmt.Sprint(got) != fmt.Sprint(timestamps[:len(got)]) {
+			t.Errorf("listEntriesSharded() collected entries after the failed shard: %v", got)
+		}
+	})
+}
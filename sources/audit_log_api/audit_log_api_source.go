@@ -2,17 +2,22 @@ package audit_log_api
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log/slog"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/logging"
 	"cloud.google.com/go/logging/logadmin"
-	"google.golang.org/api/iterator"
+	"golang.org/x/time/rate"
 
 	"github.com/turbot/tailpipe-plugin-gcp/config"
 	"github.com/turbot/tailpipe-plugin-sdk/collection_state"
+	"github.com/turbot/tailpipe-plugin-sdk/rate_limiter"
 	"github.com/turbot/tailpipe-plugin-sdk/row_source"
 	"github.com/turbot/tailpipe-plugin-sdk/schema"
 	"github.com/turbot/tailpipe-plugin-sdk/types"
@@ -23,14 +28,51 @@ const AuditLogAPISourceIdentifier = "gcp_audit_log_api"
 // AuditLogAPISource source is responsible for collecting audit logs from GCP
 type AuditLogAPISource struct {
 	row_source.RowSourceImpl[*AuditLogAPISourceConfig, *config.GcpConnection]
+
+	project string
+	// limits the rate of entries.list requests
+	limiter *rate_limiter.APILimiter
+	// the number of requests retried during the collection
+	retryCount int64
+	// in tail mode, the time range in which entries are streamed
+	tailFrom time.Time
+	tailTo   time.Time
 }
 
 func (s *AuditLogAPISource) Init(ctx context.Context, params *row_source.RowSourceParams, opts ...row_source.RowSourceOption) error {
 	// set the collection state ctor
-	s.NewCollectionStateFunc = collection_state.NewTimeRangeCollectionState
+	s.NewCollectionStateFunc = NewAuditLogAPICollectionState
 
 	// call base init
-	return s.RowSourceImpl.Init(ctx, params, opts...)
+	if err := s.RowSourceImpl.Init(ctx, params, opts...); err != nil {
+		return err
+	}
+
+	requestsPerMinute := s.Config.GetRequestsPerMinute()
+	s.limiter = rate_limiter.NewAPILimiter(&rate_limiter.Definition{
+		Name:       "gcp_logging_entries_list",
+		FillRate:   rate.Limit(float64(requestsPerMinute) / 60),
+		BucketSize: 1,
+	})
+
+	// in tail mode, entries are streamed from the end of the collection time range for the tail duration
+	// the collection time range is unchanged - the streamed entries are tracked by the collection state separately
+	if s.Config.GetMode() == ModeTail {
+		s.tailFrom = s.CollectionTimeRange.UpperBoundary
+		if s.tailFrom.IsZero() {
+			s.tailFrom = time.Now()
+		}
+		s.tailTo = s.tailFrom.Add(s.Config.GetTailDuration())
+		slog.Info("AuditLogAPISource tail mode", "tail_from", s.tailFrom, "tail_to", s.tailTo)
+	}
+
+	if err := s.checkPermissions(ctx); err != nil {
+		return err
+	}
+
+	slog.Info("Initialized AuditLogAPISource", "requests_per_minute", requestsPerMinute, "max_retries", s.Config.GetMaxRetries(), "page_size", s.Config.GetPageSize(), "shards", s.Config.GetShards())
+
+	return nil
 }
 
 func (s *AuditLogAPISource) Identifier() string {
@@ -38,90 +80,194 @@ func (s *AuditLogAPISource) Identifier() string {
 }
 
 func (s *AuditLogAPISource) Collect(ctx context.Context) error {
-	project := s.Connection.GetProject()
-	var logTypes []string
-	if s.Config != nil && s.Config.LogTypes != nil {
-		logTypes = s.Config.LogTypes
-	}
+	s.project = s.Connection.GetProject()
+	resourceNames := s.Config.ResourceNames
 
-	client, err := s.getClient(ctx, project)
+	client, err := s.getClient(ctx, s.project, resourceNames)
 	if err != nil {
 		return err
 	}
-	defer client.Close()
+
+	// the source location is the project, unless we are reading from specific log views
+	sourceLocation := s.project
+	if len(resourceNames) > 0 {
+		sourceLocation = strings.Join(resourceNames, ",")
+	}
 
 	sourceName := AuditLogAPISourceIdentifier
 	sourceEnrichmentFields := &schema.SourceEnrichment{
 		CommonFields: schema.CommonFields{
 			TpSourceName:     &sourceName,
 			TpSourceType:     AuditLogAPISourceIdentifier,
-			TpSourceLocation: &project,
+			TpSourceLocation: &sourceLocation,
 		},
 	}
 
-	// build the filter to fetch the logs for the given project, log types and time range
-	filter := s.getLogFilter(project, logTypes, s.CollectionTimeRange)
+	// every row records the identity it was collected as, and the request it was returned by
+	provenance := config.Provenance{
+		Identity:   s.Connection.GetIdentity(ctx),
+		Endpoint:   s.Connection.GetEndpoint(config.LoggingAPI),
+		FilterHash: s.getFilterHash(),
+	}
+	tailEnrichmentFields, err := withProvenance(sourceEnrichmentFields, provenance)
+	if err != nil {
+		return err
+	}
 
-	// TODO: #ratelimit implement rate limiting
-	var logEntry *logging.Entry
-	it := client.Entries(ctx, logadmin.Filter(filter), logadmin.PageSize(250))
-	for {
-		logEntry, err = it.Next()
-		if err != nil && errors.Is(err, iterator.Done) {
-			break
-		}
+	var pageCount int
+	onPage := func(entries []*logging.Entry) error {
+		pageCount++
+		pageProvenance := provenance
+		pageProvenance.Page = pageCount
+		pageEnrichmentFields, err := withProvenance(sourceEnrichmentFields, pageProvenance)
 		if err != nil {
-			return fmt.Errorf("error fetching log entries, %w", err)
+			return err
 		}
-
-		if logEntry != nil {
-			if s.CollectionState.ShouldCollect(logEntry.InsertID, logEntry.Timestamp) {
-				row := &types.RowData{
-					Data:             *logEntry,
-					SourceEnrichment: sourceEnrichmentFields,
-				}
-
-				if err = s.CollectionState.OnCollected(logEntry.InsertID, logEntry.Timestamp); err != nil {
-					return fmt.Errorf("error updating collection state: %w", err)
-				}
-				if err = s.OnRow(ctx, row); err != nil {
-					return fmt.Errorf("error processing row: %w", err)
-				}
+		for _, logEntry := range entries {
+			if logEntry == nil {
+				continue
+			}
+			if err := s.collectEntry(ctx, logEntry.InsertID, logEntry.Timestamp, *logEntry, pageEnrichmentFields); err != nil {
+				return err
 			}
 		}
+		return nil
 	}
 
-	return nil
+	// in tail mode, list the entries up to the point we start tailing
+	listTimeRange := s.CollectionTimeRange
+	if s.Config.GetMode() == ModeTail {
+		listTimeRange.UpperBoundary = s.tailFrom
+	}
+
+	err = s.listEntriesSharded(ctx, client, listTimeRange, onPage)
+	if err == nil && s.Config.GetMode() == ModeTail {
+		err = s.collectTail(ctx, client, s.tailFrom, s.tailTo, onPage, tailEnrichmentFields)
+	}
+	// requests rejected as unauthenticated are usually caused by an expired token
+	err = s.Connection.AuthError(err)
+
+	slog.Info("AuditLogAPISource collection complete", "pages", pageCount, "retries", atomic.LoadInt64(&s.retryCount), "error", err)
+	return err
 }
 
-func (s *AuditLogAPISource) getClient(ctx context.Context, project string) (*logadmin.Client, error) {
-	opts, err := s.Connection.GetClientOptions(ctx)
-	if err != nil {
+// withProvenance returns a copy of the source enrichment with the provenance added to the metadata - each page has its
+// own copy, as the rows of earlier pages may still be being enriched
+func withProvenance(sourceEnrichmentFields *schema.SourceEnrichment, provenance config.Provenance) (*schema.SourceEnrichment, error) {
+	res := &schema.SourceEnrichment{
+		CommonFields: sourceEnrichmentFields.CommonFields,
+		Metadata:     make(map[string]string, len(sourceEnrichmentFields.Metadata)+1),
+	}
+	for k, v := range sourceEnrichmentFields.Metadata {
+		res.Metadata[k] = v
+	}
+	if err := provenance.SetMetadata(res.Metadata); err != nil {
 		return nil, err
 	}
+	return res, nil
+}
 
-	if project == "" {
-		return nil, errors.New("unable to determine active project, please set project in configuration or env var CLOUDSDK_CORE_PROJECT / GCP_PROJECT")
+// getFilterHash returns the SHA-256 hash of the log filter without the time range, which identifies the entries
+// requested, so is the same for every page, shard and tail session of the collection
+func (s *AuditLogAPISource) getFilterHash() string {
+	hash := sha256.Sum256([]byte(strings.TrimSpace(s.buildLogFilter(s.project, s.Config.LogTypes, ""))))
+	return hex.EncodeToString(hash[:])
+}
+
+// checkPermissions checks the connection can list log entries in the project, or the projects of the resource names,
+// so a misconfigured partition fails before collecting
+// the permissions on organizations, folders, billing accounts and log views are not checked
+func (s *AuditLogAPISource) checkPermissions(ctx context.Context) error {
+	var checks []config.PermissionCheck
+	if len(s.Config.ResourceNames) == 0 {
+		checks = append(checks, config.ProjectPermissions(s.Connection.GetProject(), config.LoggingReadPermissions...))
+	}
+	for _, resourceName := range s.Config.ResourceNames {
+		parts := strings.Split(resourceName, "/")
+		if len(parts) == 2 && parts[0] == "projects" {
+			checks = append(checks, config.ProjectPermissions(parts[1], config.LoggingReadPermissions...))
+		}
 	}
 
-	client, err := logadmin.NewClient(ctx, project, opts...)
+	result, err := s.Connection.CheckConnection(ctx, checks...)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("error checking GCP connection: %w", err)
+	}
+	return result.Err()
+}
+
+// collectEntry checks with the collection state whether the entry should be collected, and if so raises a row event
+func (s *AuditLogAPISource) collectEntry(ctx context.Context, insertId string, timestamp time.Time, data any, sourceEnrichmentFields *schema.SourceEnrichment) error {
+	if !s.CollectionState.ShouldCollect(insertId, timestamp) {
+		return nil
+	}
+
+	row := &types.RowData{
+		Data:             data,
+		SourceEnrichment: sourceEnrichmentFields,
+	}
+
+	if err := s.CollectionState.OnCollected(insertId, timestamp); err != nil {
+		return fmt.Errorf("error updating collection state: %w", err)
+	}
+	if err := s.OnRow(ctx, row); err != nil {
+		return fmt.Errorf("error processing row: %w", err)
+	}
+	return nil
+}
+
+// getClient returns the logadmin client of the connection for the parent of the project or resource names
+// the client is shared by all sources using the connection, so is not closed by the source
+func (s *AuditLogAPISource) getClient(ctx context.Context, project string, resourceNames []string) (*logadmin.Client, error) {
+	// if we are reading from log views, the client parent can be derived from the first resource name
+	// (e.g. projects/my-project/locations/global/buckets/my-bucket/views/my-view -> projects/my-project)
+	parent := project
+	if parent == "" && len(resourceNames) > 0 {
+		parent = strings.Join(strings.SplitN(resourceNames[0], "/", 3)[:2], "/")
 	}
 
-	return client, nil
+	if parent == "" {
+		return nil, errors.New("unable to determine active project, please set project in configuration or env var CLOUDSDK_CORE_PROJECT / GCP_PROJECT")
+	}
+
+	return config.GetClient(ctx, s.Connection, "logadmin/"+parent, func(ctx context.Context) (*logadmin.Client, error) {
+		opts, err := s.Connection.GetClientOptions(ctx, config.LoggingAPI)
+		if err != nil {
+			return nil, err
+		}
+		return logadmin.NewClient(ctx, parent, opts...)
+	})
 }
 
 func (s *AuditLogAPISource) getLogFilter(projectId string, logTypes []string, timeRange collection_state.DirectionalTimeRange) string {
-	activity := fmt.Sprintf(`"projects/%s/logs/cloudaudit.googleapis.com%sactivity"`, projectId, "%2F")
-	dataAccess := fmt.Sprintf(`"projects/%s/logs/cloudaudit.googleapis.com%sdata_access"`, projectId, "%2F")
-	systemEvent := fmt.Sprintf(`"projects/%s/logs/cloudaudit.googleapis.com%ssystem_event"`, projectId, "%2F")
-	policyDenied := fmt.Sprintf(`"projects/%s/logs/cloudaudit.googleapis.com%spolicy"`, projectId, "%2F")
 	// construct filter for time range
 	timePart := fmt.Sprintf(`AND (timestamp >= "%s") AND (timestamp < "%s")`,
 		timeRange.StartTime().Format(time.RFC3339Nano),
 		timeRange.EndTime().Format(time.RFC3339Nano))
 
+	return s.buildLogFilter(projectId, logTypes, timePart)
+}
+
+// getTailLogFilter returns the filter for a tail session - as entries are streamed as they are written,
+// the filter only has a lower time bound
+func (s *AuditLogAPISource) getTailLogFilter(projectId string, logTypes []string, from time.Time) string {
+	timePart := fmt.Sprintf(`AND (timestamp >= "%s")`, from.Format(time.RFC3339Nano))
+
+	return s.buildLogFilter(projectId, logTypes, timePart)
+}
+
+func (s *AuditLogAPISource) buildLogFilter(projectId string, logTypes []string, timePart string) string {
+	// log views in a centralized log bucket can contain entries routed from many projects,
+	// so match on the log ID rather than the fully qualified log name
+	if s.Config != nil && len(s.Config.ResourceNames) > 0 {
+		return s.getLogIdFilter(logTypes, timePart)
+	}
+
+	activity := fmt.Sprintf(`"projects/%s/logs/cloudaudit.googleapis.com%sactivity"`, projectId, "%2F")
+	dataAccess := fmt.Sprintf(`"projects/%s/logs/cloudaudit.googleapis.com%sdata_access"`, projectId, "%2F")
+	systemEvent := fmt.Sprintf(`"projects/%s/logs/cloudaudit.googleapis.com%ssystem_event"`, projectId, "%2F")
+	policyDenied := fmt.Sprintf(`"projects/%s/logs/cloudaudit.googleapis.com%spolicy"`, projectId, "%2F")
+
 	// short-circuit default
 	if len(logTypes) == 0 {
 		return fmt.Sprintf("logName=(%s OR %s OR %s OR %s) %s", activity, dataAccess, systemEvent, policyDenied, timePart)
@@ -150,3 +296,17 @@ func (s *AuditLogAPISource) getLogFilter(projectId string, logTypes []string, ti
 		return fmt.Sprintf("logName=(%s) %s", strings.Join(selected, " OR "), timePart)
 	}
 }
+
+func (s *AuditLogAPISource) getLogIdFilter(logTypes []string, timePart string) string {
+	// default to all log types
+	if len(logTypes) == 0 {
+		logTypes = []string{"activity", "data_access", "system_event", "policy"}
+	}
+
+	var selected []string
+	for _, logType := range logTypes {
+		selected = append(selected, fmt.Sprintf(`log_id("cloudaudit.googleapis.com/%s")`, logType))
+	}
+
+	return fmt.Sprintf("(%s) %s", strings.Join(selected, " OR "), timePart)
+}
@@ -2,16 +2,48 @@ package audit_log_api
 
 import (
 	"fmt"
+	"regexp"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/hcl/v2"
 )
 
+// resourceNameRegex matches the resource names accepted by the Logging API entries.list method, either a parent
+// resource (e.g. projects/my-project) or a log view (e.g. projects/my-project/locations/global/buckets/my-bucket/views/_AllLogs)
+var resourceNameRegex = regexp.MustCompile(`^(projects|organizations|folders|billingAccounts)/[^/]+(/locations/[^/]+/buckets/[^/]+/views/[^/]+)?$`)
+
+const (
+	// the Logging API entries.list quota is 60 requests per minute per project
+	defaultRequestsPerMinute = 60
+	defaultMaxRetries        = 5
+	defaultPageSize          = 250
+	// the maximum page size supported by entries.list
+	maxPageSize   = 1000
+	defaultShards = 1
+
+	// ModeList collects the log entries for the collection time range using entries.list
+	ModeList = "list"
+	// ModeTail collects the log entries for the collection time range using entries.list,
+	// then streams new log entries using entries.tail for the configured tail duration
+	ModeTail            = "tail"
+	defaultTailDuration = 15 * time.Minute
+	// tail collections are limited to one hour
+	maxTailDuration = time.Hour
+)
+
 type AuditLogAPISourceConfig struct {
 	// required to allow partial decoding
-	Remain   hcl.Body `hcl:",remain" json:"-"`
-	LogTypes []string `hcl:"log_types,optional" json:"log_types"`
+	Remain            hcl.Body `hcl:",remain" json:"-"`
+	LogTypes          []string `hcl:"log_types,optional" json:"log_types"`
+	ResourceNames     []string `hcl:"resource_names,optional" json:"resource_names"`
+	RequestsPerMinute *int     `hcl:"requests_per_minute,optional" json:"requests_per_minute"`
+	MaxRetries        *int     `hcl:"max_retries,optional" json:"max_retries"`
+	PageSize          *int     `hcl:"page_size,optional" json:"page_size"`
+	Shards            *int     `hcl:"shards,optional" json:"shards"`
+	Mode              *string  `hcl:"mode,optional" json:"mode"`
+	TailDuration      *string  `hcl:"tail_duration,optional" json:"tail_duration"`
 }
 
 func (a *AuditLogAPISourceConfig) Validate() error {
@@ -22,9 +54,95 @@ func (a *AuditLogAPISourceConfig) Validate() error {
 			return fmt.Errorf("invalid log type %s, valid log types are %s", logType, strings.Join(validLogTypes, ", "))
 		}
 	}
+
+	for _, resourceName := range a.ResourceNames {
+		if !resourceNameRegex.MatchString(resourceName) {
+			return fmt.Errorf("invalid resource name %s, expected a project, organization, folder or billing account, e.g. projects/<project>, or a log view in the format projects/<project>/locations/<location>/buckets/<bucket>/views/<view>", resourceName)
+		}
+	}
+
+	if a.RequestsPerMinute != nil && *a.RequestsPerMinute <= 0 {
+		return fmt.Errorf("requests_per_minute must be greater than 0")
+	}
+
+	if a.MaxRetries != nil && *a.MaxRetries < 0 {
+		return fmt.Errorf("max_retries cannot be negative")
+	}
+
+	if a.PageSize != nil && (*a.PageSize <= 0 || *a.PageSize > maxPageSize) {
+		return fmt.Errorf("page_size must be between 1 and %d", maxPageSize)
+	}
+
+	if a.Shards != nil && *a.Shards <= 0 {
+		return fmt.Errorf("shards must be greater than 0")
+	}
+
+	if mode := a.GetMode(); mode != ModeList && mode != ModeTail {
+		return fmt.Errorf("invalid mode %s, valid modes are %s", mode, strings.Join([]string{ModeList, ModeTail}, ", "))
+	}
+
+	if a.TailDuration != nil {
+		tailDuration, err := time.ParseDuration(*a.TailDuration)
+		if err != nil {
+			return fmt.Errorf("invalid tail_duration %s, %w", *a.TailDuration, err)
+		}
+		if tailDuration <= 0 || tailDuration > maxTailDuration {
+			return fmt.Errorf("tail_duration must be greater than 0 and at most %s", maxTailDuration)
+		}
+	}
 	return nil
 }
 
+// GetRequestsPerMinute returns the maximum number of entries.list requests to make per minute
+func (a *AuditLogAPISourceConfig) GetRequestsPerMinute() int {
+	if a.RequestsPerMinute == nil {
+		return defaultRequestsPerMinute
+	}
+	return *a.RequestsPerMinute
+}
+
+// GetMaxRetries returns the number of times a failed entries.list request is retried before the collection fails
+func (a *AuditLogAPISourceConfig) GetMaxRetries() int {
+	if a.MaxRetries == nil {
+		return defaultMaxRetries
+	}
+	return *a.MaxRetries
+}
+
+// GetPageSize returns the number of entries to request in each entries.list request
+func (a *AuditLogAPISourceConfig) GetPageSize() int {
+	if a.PageSize == nil {
+		return defaultPageSize
+	}
+	return *a.PageSize
+}
+
+// GetShards returns the number of time windows the collection time range is split into and fetched concurrently
+func (a *AuditLogAPISourceConfig) GetShards() int {
+	if a.Shards == nil {
+		return defaultShards
+	}
+	return *a.Shards
+}
+
+// GetMode returns the collection mode, either list or tail
+func (a *AuditLogAPISourceConfig) GetMode() string {
+	if a.Mode == nil {
+		return ModeList
+	}
+	return *a.Mode
+}
+
+// GetTailDuration returns how long to stream new log entries for in tail mode
+func (a *AuditLogAPISourceConfig) GetTailDuration() time.Duration {
+	if a.TailDuration == nil {
+		return defaultTailDuration
+	}
+	// the duration is checked in Validate
+	tailDuration, _ := time.ParseDuration(*a.TailDuration)
+	return tailDuration
+}
+
 func (a *AuditLogAPISourceConfig) Identifier() string {
 	return AuditLogAPISourceIdentifier
 }
@@ -0,0 +1,38 @@
+package audit_log_api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateResourceNames(t *testing.T) {
+	tests := []struct {
+		name         string
+		resourceName string
+		wantErr      bool
+	}{
+		{name: "project", resourceName: "projects/my-project"},
+		{name: "organization", resourceName: "organizations/123456789012"},
+		{name: "folder", resourceName: "folders/123456789012"},
+		{name: "billing account", resourceName: "billingAccounts/012345-6789AB-CDEF01"},
+		{name: "log view", resourceName: "projects/my-project/locations/global/buckets/audit-logs/views/_AllLogs"},
+		{name: "folder log view", resourceName: "folders/123/locations/europe-west1/buckets/audit-logs/views/security"},
+		{name: "unknown parent", resourceName: "users/me", wantErr: true},
+		{name: "no parent id", resourceName: "projects/", wantErr: true},
+		{name: "log bucket", resourceName: "projects/my-project/locations/global/buckets/audit-logs", wantErr: true},
+		{name: "log name", resourceName: "projects/my-project/logs/cloudaudit.googleapis.com%2Factivity", wantErr: true},
+		{name: "trailing slash", resourceName: "projects/my-project/", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &AuditLogAPISourceConfig{ResourceNames: []string{tt.resourceName}}
+			err := c.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "projects/<project>") {
+				t.Errorf("Validate() error = %v, want the accepted formats", err)
+			}
+		})
+	}
+}
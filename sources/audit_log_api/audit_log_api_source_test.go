@@ -0,0 +1,53 @@
+package audit_log_api
+
+import (
+	"testing"
+)
+
+func TestBuildLogFilter(t *testing.T) {
+	timePart := `AND (timestamp >= "2025-06-07T00:00:00Z")`
+
+	tests := []struct {
+		name          string
+		logTypes      []string
+		resourceNames []string
+		want          string
+	}{
+		{
+			name:     "all log types",
+			logTypes: nil,
+			want:     `logName=("projects/p/logs/cloudaudit.googleapis.com%2Factivity" OR "projects/p/logs/cloudaudit.googleapis.com%2Fdata_access" OR "projects/p/logs/cloudaudit.googleapis.com%2Fsystem_event" OR "projects/p/logs/cloudaudit.googleapis.com%2Fpolicy") ` + timePart,
+		},
+		{
+			name:     "single log type",
+			logTypes: []string{"activity"},
+			want:     `logName="projects/p/logs/cloudaudit.googleapis.com%2Factivity" ` + timePart,
+		},
+		{
+			name:     "multiple log types",
+			logTypes: []string{"activity", "policy"},
+			want:     `logName=("projects/p/logs/cloudaudit.googleapis.com%2Factivity" OR "projects/p/logs/cloudaudit.googleapis.com%2Fpolicy") ` + timePart,
+		},
+		{
+			name:          "resource names match the log ID",
+			logTypes:      nil,
+			resourceNames: []string{"projects/central/locations/global/buckets/audit-logs/views/_AllLogs"},
+			want:          `(log_id("cloudaudit.googleapis.com/activity") OR log_id("cloudaudit.googleapis.com/data_access") OR log_id("cloudaudit.googleapis.com/system_event") OR log_id("cloudaudit.googleapis.com/policy")) ` + timePart,
+		},
+		{
+			name:          "resource names with log types",
+			logTypes:      []string{"data_access"},
+			resourceNames: []string{"organizations/123"},
+			want:          `(log_id("cloudaudit.googleapis.com/data_access")) ` + timePart,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &AuditLogAPISource{}
+			s.Config = &AuditLogAPISourceConfig{ResourceNames: tt.resourceNames}
+			if got := s.buildLogFilter("p", tt.logTypes, timePart); got != tt.want {
+				t.Errorf("buildLogFilter() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package audit_log_api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"cloud.google.com/go/logging"
+	vkit "cloud.google.com/go/logging/apiv2"
+	"cloud.google.com/go/logging/apiv2/loggingpb"
+	"cloud.google.com/go/logging/logadmin"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/turbot/tailpipe-plugin-gcp/config"
+	"github.com/turbot/tailpipe-plugin-sdk/collection_state"
+	"github.com/turbot/tailpipe-plugin-sdk/schema"
+)
+
+// tailBufferWindow is the amount of time the Logging API buffers streamed entries for, to return them in timestamp order
+// (the collection state will not collect an entry older than the last entry collected)
+const tailBufferWindow = 10 * time.Second
+
+// tailDisconnectedError is returned by tailEntries if the stream fails - the caller may catch up and reconnect
+type tailDisconnectedError struct {
+	err error
+}
+
+func (e *tailDisconnectedError) Error() string {
+	return fmt.Sprintf("tail stream disconnected, %s", e.err.Error())
+}
+
+func (e *tailDisconnectedError) Unwrap() error {
+	return e.err
+}
+
+// collectTail streams the log entries written between from and to using entries.tail.
+//
+// Before the stream is started, and whenever it disconnects, any entries written since the last entry received
+// are caught up using entries.list. A final catch-up is made when the tail duration has elapsed, to collect any
+// entries which were not delivered by the stream. Once the final catch-up completes, the tailed time range is
+// recorded in the collection state, so a later collection does not collect the entries again.
+func (s *AuditLogAPISource) collectTail(ctx context.Context, client *logadmin.Client, from, to time.Time, onPage func([]*logging.Entry) error, sourceEnrichmentFields *schema.SourceEnrichment) error {
+	tailClient, err := s.getTailClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	resourceNames := s.Config.ResourceNames
+	if len(resourceNames) == 0 {
+		resourceNames = []string{fmt.Sprintf("projects/%s", s.project)}
+	}
+
+	// the entries are after the end of the collection time range, so the collection state tracks them separately
+	state, ok := s.CollectionState.State.(*AuditLogAPICollectionState)
+	if !ok {
+		return fmt.Errorf("unexpected collection state type %T", s.CollectionState.State)
+	}
+	state.StartTail(from, to)
+
+	lastTimestamp := from
+	catchUp := func(until time.Time) error {
+		catchUpRange := collection_state.DirectionalTimeRange{
+			LowerBoundary:   lastTimestamp,
+			UpperBoundary:   until,
+			CollectionOrder: s.CollectionTimeRange.CollectionOrder,
+		}
+		return s.listEntries(ctx, client, catchUpRange, func(entries []*logging.Entry) error {
+			lastTimestamp = entries[len(entries)-1].Timestamp
+			return onPage(entries)
+		})
+	}
+
+	onEntry := func(entry *loggingpb.LogEntry) error {
+		timestamp := entry.GetTimestamp().AsTime()
+		if err := s.collectEntry(ctx, entry.GetInsertId(), timestamp, entry, sourceEnrichmentFields); err != nil {
+			return err
+		}
+		if timestamp.After(lastTimestamp) {
+			lastTimestamp = timestamp
+		}
+		return nil
+	}
+
+	maxRetries := s.Config.GetMaxRetries()
+	disconnects := 0
+	for time.Now().Before(to) {
+		if err := catchUp(time.Now()); err != nil {
+			return fmt.Errorf("error catching up log entries before tailing, %w", err)
+		}
+
+		err := s.tailEntries(ctx, tailClient, resourceNames, lastTimestamp, to, onEntry)
+		if err == nil {
+			break
+		}
+
+		var disconnectedErr *tailDisconnectedError
+		if !errors.As(err, &disconnectedErr) || ctx.Err() != nil {
+			return err
+		}
+		if disconnects >= maxRetries {
+			return fmt.Errorf("error tailing log entries after %d reconnects, %w", disconnects, err)
+		}
+		disconnects++
+		slog.Warn("AuditLogAPISource tail stream disconnected, catching up using entries.list", "last_timestamp", lastTimestamp, "attempt", disconnects, "max_retries", maxRetries, "error", err)
+	}
+
+	if err := catchUp(to); err != nil {
+		return fmt.Errorf("error catching up log entries after tailing, %w", err)
+	}
+	state.EndTail()
+	return nil
+}
+
+// tailEntries streams log entries with a timestamp on or after from until the deadline, calling onEntry for each entry.
+// It returns nil when the deadline is reached, and a tailDisconnectedError if the stream fails.
+// Suppression info returned by the API is logged and recorded in the collection state.
+func (s *AuditLogAPISource) tailEntries(ctx context.Context, tailClient *vkit.Client, resourceNames []string, from, deadline time.Time, onEntry func(*loggingpb.LogEntry) error) error {
+	tailCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	// the deadline being reached is the expected way for the stream to end
+	deadlineReached := func() bool {
+		return tailCtx.Err() != nil && ctx.Err() == nil
+	}
+
+	stream, err := tailClient.TailLogEntries(tailCtx)
+	if err != nil {
+		if deadlineReached() {
+			return nil
+		}
+		return &tailDisconnectedError{err: err}
+	}
+
+	err = stream.Send(&loggingpb.TailLogEntriesRequest{
+		ResourceNames: resourceNames,
+		Filter:        s.getTailLogFilter(s.project, s.Config.LogTypes, from),
+		BufferWindow:  durationpb.New(tailBufferWindow),
+	})
+	if err != nil {
+		if deadlineReached() {
+			return nil
+		}
+		return &tailDisconnectedError{err: err}
+	}
+
+	state, _ := s.CollectionState.State.(*AuditLogAPICollectionState)
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			if deadlineReached() {
+				return nil
+			}
+			if errors.Is(err, io.EOF) {
+				err = errors.New("stream closed by server")
+			}
+			return &tailDisconnectedError{err: err}
+		}
+
+		for _, suppression := range resp.GetSuppressionInfo() {
+			slog.Warn("AuditLogAPISource tail entries suppressed", "reason", suppression.GetReason().String(), "count", suppression.GetSuppressedCount())
+			if state != nil {
+				state.OnSuppressed(suppression.GetReason().String(), int64(suppression.GetSuppressedCount()), time.Now())
+			}
+		}
+
+		for _, entry := range resp.GetEntries() {
+			if err := onEntry(entry); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// getTailClient returns the logging client of the connection, which is shared by all sources using the connection,
+// so is not closed by the source
+func (s *AuditLogAPISource) getTailClient(ctx context.Context) (*vkit.Client, error) {
+	return config.GetClient(ctx, s.Connection, "logging", func(ctx context.Context) (*vkit.Client, error) {
+		opts, err := s.Connection.GetClientOptions(ctx, config.LoggingAPI)
+		if err != nil {
+			return nil, err
+		}
+
+		client, err := vkit.NewClient(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCP Logging client: %w", err)
+		}
+		return client, nil
+	})
+}
@@ -0,0 +1,336 @@
+package storage_bucket
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/turbot/tailpipe-plugin-sdk/collection_state"
+)
+
+// ObjectGeneration records a generation of an object which has been collected
+type ObjectGeneration struct {
+	Generation     int64 `json:"generation"`
+	Metageneration int64 `json:"metageneration"`
+	// the timestamp of the artifact the generation was collected as - zero if the layout has no timestamp
+	Timestamp time.Time `json:"timestamp,omitzero"`
+}
+
+// listedObject is an object version discovered by the underway collection
+type listedObject struct {
+	name       string
+	generation ObjectGeneration
+}
+
+// StorageBucketCollectionState is a [collection_state.ArtifactCollectionState] which also records:
+//   - the name of the last object collected from each directory whose objects are written in name order, so that
+//     later collections can list the directory from that point
+//   - if object generations are tracked, the generations collected for each object, so that an object which is
+//     rewritten is collected again - objects whose timestamps are before the time range of a collection cannot be
+//     collected by it, so their generations are removed when the state is initialized, and the state does not grow
+//     without bound
+type StorageBucketCollectionState struct {
+	*collection_state.ArtifactCollectionState
+
+	// map of directory (in the form gs://bucket/prefix) to the name of the last object collected from it
+	LastObjectNames map[string]string `json:"last_object_names,omitempty"`
+	// map of object URL (in the form gs://bucket/object) to the generations of the object collected
+	ObjectGenerations map[string][]ObjectGeneration `json:"object_generations,omitempty"`
+
+	// map of artifact path to the object version, for the objects discovered by the underway collection
+	listedObjects map[string]listedObject
+	// the artifacts being collected because they are a new generation of an object which was already collected
+	// (these are not passed to the artifact collection state, as their timestamps are before its end time)
+	rewrittenObjects map[string]struct{}
+	// the artifacts being streamed - these are only recorded as collected once they have been read to the end
+	streamingObjects map[string]struct{}
+
+	// the state is updated by concurrent discovery and downloads, and may be updated while it is being saved -
+	// the artifact collection state is not safe for concurrent use (the SDK does not lock it when registering paths),
+	// so it is only accessed while this is locked
+	mut sync.Mutex
+}
+
+func NewStorageBucketCollectionState() collection_state.CollectionState {
+	return &StorageBucketCollectionState{
+		ArtifactCollectionState: collection_state.NewArtifactCollectionState().(*collection_state.ArtifactCollectionState),
+		LastObjectNames:         make(map[string]string),
+		ObjectGenerations:       make(map[string][]ObjectGeneration),
+		listedObjects:           make(map[string]listedObject),
+		rewrittenObjects:        make(map[string]struct{}),
+		streamingObjects:        make(map[string]struct{}),
+	}
+}
+
+// Init initializes the state for the collection time range, removing the generations of objects whose timestamps
+// are before it
+func (s *StorageBucketCollectionState) Init(collectionTimeRange collection_state.DirectionalTimeRange, granularity time.Duration) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.ArtifactCollectionState.Init(collectionTimeRange, granularity)
+	s.pruneObjectGenerations(collectionTimeRange.LowerBoundary)
+}
+
+// pruneObjectGenerations removes the generations of objects collected with a timestamp before the time - objects
+// without a timestamp are always kept, as they are considered by every collection
+// NOTE: this assumes the mutex is already locked by the caller
+func (s *StorageBucketCollectionState) pruneObjectGenerations(before time.Time) {
+	if before.IsZero() {
+		return
+	}
+	for objectName, generations := range s.ObjectGenerations {
+		expired := !slices.ContainsFunc(generations, func(g ObjectGeneration) bool {
+			return g.Timestamp.IsZero() || !g.Timestamp.Before(before)
+		})
+		if expired {
+			delete(s.ObjectGenerations, objectName)
+		}
+	}
+}
+
+// OnObjectListed registers the object version discovered as the artifact path
+func (s *StorageBucketCollectionState) OnObjectListed(path, objectName string, generation, metageneration int64) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.listedObjects[path] = listedObject{
+		name:       objectName,
+		generation: ObjectGeneration{Generation: generation, Metageneration: metageneration},
+	}
+}
+
+// AddObjectGeneration records that the generation of the object has been collected as an artifact with the timestamp
+func (s *StorageBucketCollectionState) AddObjectGeneration(objectName string, generation, metageneration int64, timestamp time.Time) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.addObjectGeneration(objectName, ObjectGeneration{Generation: generation, Metageneration: metageneration, Timestamp: timestamp})
+}
+
+// addObjectGeneration records the generation - if it is already recorded, the metageneration and timestamp are updated
+// NOTE: this assumes the mutex is already locked by the caller
+func (s *StorageBucketCollectionState) addObjectGeneration(objectName string, generation ObjectGeneration) {
+	generations := s.ObjectGenerations[objectName]
+	for i := range generations {
+		if generations[i].Generation == generation.Generation {
+			generations[i].Metageneration = generation.Metageneration
+			generations[i].Timestamp = generation.Timestamp
+			return
+		}
+	}
+	s.ObjectGenerations[objectName] = append(generations, generation)
+}
+
+// RegisterPath registers a directory with the artifact collection state, which uses it to identify trunks
+// the root of each bucket is always a trunk, used for any objects which are not under a trunk directory
+// (the artifact collection state removes any trunk which is a prefix of a new trunk, so this is prevented for the root)
+func (s *StorageBucketCollectionState) RegisterPath(path string, metadata map[string]string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	bucket, _ := parseObjectURL(path)
+	root := objectURL(bucket, "")
+	rootState, hasRoot := s.TrunkStates[root]
+
+	if path == root {
+		if !hasRoot {
+			// add nil as a placeholder, as the artifact collection state does for other trunks
+			s.TrunkStates[root] = nil
+		}
+		return
+	}
+
+	s.ArtifactCollectionState.RegisterPath(path, metadata)
+
+	if hasRoot {
+		s.TrunkStates[root] = rootState
+	}
+}
+
+// ShouldCollect returns whether the artifact should be collected
+//
+// For an object version discovered by the underway collection:
+//   - if the generation has been collected, it is not collected again
+//   - if a different generation of the object has been collected (i.e. the object has been rewritten),
+//     it is collected, regardless of its timestamp
+//
+// Otherwise, the artifact collection state decides, based on the artifact timestamp.
+func (s *StorageBucketCollectionState) ShouldCollect(id string, timestamp time.Time) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if listed, ok := s.listedObjects[id]; ok {
+		collected := s.ObjectGenerations[listed.name]
+		if slices.ContainsFunc(collected, func(g ObjectGeneration) bool { return g.Generation == listed.generation.Generation }) {
+			return false
+		}
+		if len(collected) > 0 {
+			s.rewrittenObjects[id] = struct{}{}
+			return true
+		}
+	}
+
+	return s.ArtifactCollectionState.ShouldCollect(id, timestamp)
+}
+
+// OnStreamStarted registers the artifact as being streamed - the artifact is not recorded as collected when it is
+// passed to the loader, but by the OnCollected call made once OnStreamCompleted has been called
+func (s *StorageBucketCollectionState) OnStreamStarted(id string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.streamingObjects[id] = struct{}{}
+}
+
+// OnStreamCompleted records that the streamed artifact has been read to the end, so can be recorded as collected
+func (s *StorageBucketCollectionState) OnStreamCompleted(id string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	delete(s.streamingObjects, id)
+}
+
+// OnStreamFailed records that the streamed artifact could not be read to the end - it is not recorded as collected,
+// so it is collected again by the next collection
+func (s *StorageBucketCollectionState) OnStreamFailed(id string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	delete(s.streamingObjects, id)
+	delete(s.listedObjects, id)
+	delete(s.rewrittenObjects, id)
+}
+
+// OnCollected records the generation of the object collected, and updates the artifact collection state
+// (streamed artifacts are not recorded until they have been read to the end)
+func (s *StorageBucketCollectionState) OnCollected(id string, timestamp time.Time) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if _, streaming := s.streamingObjects[id]; streaming {
+		return nil
+	}
+	if listed, ok := s.listedObjects[id]; ok {
+		generation := listed.generation
+		generation.Timestamp = timestamp
+		s.addObjectGeneration(listed.name, generation)
+		delete(s.listedObjects, id)
+	}
+	_, rewritten := s.rewrittenObjects[id]
+	delete(s.rewrittenObjects, id)
+
+	if rewritten {
+		return nil
+	}
+	return s.ArtifactCollectionState.OnCollected(id, timestamp)
+}
+
+// GetLastObjectName returns the name of the last object collected from the directory
+func (s *StorageBucketCollectionState) GetLastObjectName(dir string) string {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	return s.LastObjectNames[dir]
+}
+
+// SetLastObjectName sets the name of the last object collected from the directory,
+// if it is after the currently stored name
+func (s *StorageBucketCollectionState) SetLastObjectName(dir, objectName string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if objectName > s.LastObjectNames[dir] {
+		s.LastObjectNames[dir] = objectName
+	}
+}
+
+// MigrateObjectPaths migrates state saved when artifacts were identified by object name, rather than by object URL
+// (in the form gs://bucket/object), to the object URLs in the bucket - including the root trunk, used for objects
+// which are not under a trunk directory
+func (s *StorageBucketCollectionState) MigrateObjectPaths(bucket string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	migratePath := func(p string) (string, bool) {
+		switch {
+		case strings.HasPrefix(p, "gs://"):
+			return p, false
+		case p == "/":
+			return objectURL(bucket, ""), true
+		default:
+			return objectURL(bucket, p), true
+		}
+	}
+
+	for trunk, trunkState := range s.TrunkStates {
+		migrated, ok := migratePath(trunk)
+		if !ok {
+			continue
+		}
+		delete(s.TrunkStates, trunk)
+		s.TrunkStates[migrated] = trunkState
+
+		if trunkState == nil {
+			continue
+		}
+		for _, timeRange := range trunkState.TimeRanges {
+			endObjects := make(map[string]struct{}, len(timeRange.EndObjects))
+			for id := range timeRange.EndObjects {
+				id, _ = migratePath(id)
+				endObjects[id] = struct{}{}
+			}
+			timeRange.EndObjects = endObjects
+		}
+	}
+
+	for objectName, generations := range s.ObjectGenerations {
+		if migrated, ok := migratePath(objectName); ok {
+			delete(s.ObjectGenerations, objectName)
+			s.ObjectGenerations[migrated] = generations
+		}
+	}
+}
+
+func (s *StorageBucketCollectionState) IsEmpty() bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	return s.ArtifactCollectionState.IsEmpty() && len(s.LastObjectNames) == 0 && len(s.ObjectGenerations) == 0
+}
+
+// Clear clears the state for the time range - as we cannot know which objects were collected for the time range,
+// the last object names and object generations are cleared, so the next collection lists and collects all objects
+func (s *StorageBucketCollectionState) Clear(timeRange collection_state.DirectionalTimeRange) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.ArtifactCollectionState.Clear(timeRange)
+	s.LastObjectNames = make(map[string]string)
+	s.ObjectGenerations = make(map[string][]ObjectGeneration)
+}
+
+func (s *StorageBucketCollectionState) MarshalJSON() ([]byte, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	// do not save trunks with no state - the SDK only trims these for an ArtifactCollectionState
+	trunkStates := make(map[string]*collection_state.TimeRangeCollectionState)
+	for trunk, trunkState := range s.TrunkStates {
+		if trunkState != nil {
+			trunkStates[trunk] = trunkState
+		}
+	}
+
+	return json.Marshal(struct {
+		TrunkStates       map[string]*collection_state.TimeRangeCollectionState `json:"trunk_states,omitempty"`
+		LastObjectNames   map[string]string                                     `json:"last_object_names,omitempty"`
+		ObjectGenerations map[string][]ObjectGeneration                         `json:"object_generations,omitempty"`
+	}{
+		TrunkStates:       trunkStates,
+		LastObjectNames:   s.LastObjectNames,
+		ObjectGenerations: s.ObjectGenerations,
+	})
+}
@@ -0,0 +1,77 @@
+package storage_bucket
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/turbot/tailpipe-plugin-sdk/collection_state"
+)
+
+// TestCollectionStateConcurrentDiscovery registers paths and collects artifacts from several locations at once,
+// as concurrent discovery and downloads do - this relies on the race detector to find unsynchronized access
+func TestCollectionStateConcurrentDiscovery(t *testing.T) {
+	from := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	state := NewStorageBucketCollectionState().(*StorageBucketCollectionState)
+	state.Init(collection_state.DirectionalTimeRange{
+		LowerBoundary:   from,
+		UpperBoundary:   from.Add(30 * 24 * time.Hour),
+		CollectionOrder: collection_state.CollectionOrderChronological,
+	}, time.Hour)
+
+	var wg sync.WaitGroup
+	for location := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bucket := fmt.Sprintf("bucket-%d", location)
+			state.RegisterPath(objectURL(bucket, ""), nil)
+			for day := range 10 {
+				dir := objectURL(bucket, fmt.Sprintf("logs/2025/06/%02d/", day+1))
+				state.RegisterPath(dir, map[string]string{"year": "2025", "month": "06", "day": fmt.Sprintf("%02d", day+1)})
+
+				id := dir + "00:00:00_00:59:59_S0.json"
+				timestamp := from.Add(time.Duration(day) * 24 * time.Hour)
+				state.OnObjectListed(id, id, 1, 1)
+				if !state.ShouldCollect(id, timestamp) {
+					t.Errorf("ShouldCollect(%s) = false, want true", id)
+					continue
+				}
+				if err := state.OnCollected(id, timestamp); err != nil {
+					t.Errorf("OnCollected(%s) error = %v", id, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := len(state.ObjectGenerations); got != 40 {
+		t.Errorf("recorded generations of %d objects, want 40", got)
+	}
+}
+
+func TestCollectionStatePruneObjectGenerations(t *testing.T) {
+	from := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	state := NewStorageBucketCollectionState().(*StorageBucketCollectionState)
+	state.AddObjectGeneration("gs://b/old.json", 1, 1, from.Add(-time.Hour))
+	state.AddObjectGeneration("gs://b/rewritten.json", 1, 1, from.Add(-time.Hour))
+	state.AddObjectGeneration("gs://b/rewritten.json", 2, 1, from.Add(time.Hour))
+	state.AddObjectGeneration("gs://b/new.json", 1, 1, from)
+	state.AddObjectGeneration("gs://b/undated.json", 1, 1, time.Time{})
+
+	// the generations of objects whose timestamps are before the collection time range are removed
+	state.Init(collection_state.DirectionalTimeRange{
+		LowerBoundary:   from,
+		UpperBoundary:   from.Add(30 * 24 * time.Hour),
+		CollectionOrder: collection_state.CollectionOrderChronological,
+	}, time.Hour)
+
+	got := slices.Sorted(maps.Keys(state.ObjectGenerations))
+	want := []string{"gs://b/new.json", "gs://b/rewritten.json", "gs://b/undated.json"}
+	if !slices.Equal(got, want) {
+		t.Errorf("object generations recorded for %v, want %v", got, want)
+	}
+}
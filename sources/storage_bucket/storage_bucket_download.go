@@ -0,0 +1,185 @@
+package storage_bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/gax-go/v2"
+	"github.com/turbot/tailpipe-plugin-sdk/artifact_loader"
+	"github.com/turbot/tailpipe-plugin-sdk/types"
+)
+
+const DownloadedObjectLoaderIdentifier = "gcp_storage_downloaded_object_loader"
+
+const (
+	// objects are downloaded in parts of this size - the parts after the first are downloaded concurrently
+	downloadPartSize = 32 * 1024 * 1024
+	// the number of times a failed read of an object (or part of an object) is retried
+	maxDownloadRetries = 3
+)
+
+// downloadObject downloads the object to the local file, returning the number of bytes written and the attributes
+// of the object read.
+//
+// The first part of the object is read, which also returns the object size. If the object is larger than a
+// single part, the remaining parts are read concurrently using ranged reads of the same object generation.
+// (Objects which are decompressed by Cloud Storage when read are always served whole, so are read in one part.)
+// Each read waits for the download limiter, and is retried if it fails with a transient error.
+func (s *GcpStorageBucketSource) downloadObject(ctx context.Context, obj *storage.ObjectHandle, outFile *os.File) (int64, storage.ReaderObjectAttrs, error) {
+	var attrs storage.ReaderObjectAttrs
+	err := s.readWithRetry(ctx, obj.ObjectName(), func() error {
+		// if this is a retry, discard any data written by the previous attempt
+		if err := outFile.Truncate(0); err != nil {
+			return err
+		}
+		var err error
+		attrs, err = s.readRange(ctx, obj, outFile, 0, downloadPartSize)
+		return err
+	})
+	if err != nil {
+		return 0, attrs, err
+	}
+
+	// if the object was served whole, or fits in a single part, we are done
+	if attrs.Decompressed || attrs.Size <= downloadPartSize {
+		info, err := outFile.Stat()
+		if err != nil {
+			return 0, attrs, err
+		}
+		return info.Size(), attrs, nil
+	}
+
+	// ensure the remaining parts are read from the same generation of the object
+	if attrs.Generation > 0 {
+		obj = obj.Generation(attrs.Generation)
+	}
+
+	slog.Debug("Downloading object in parts", "object", obj.ObjectName(), "size", attrs.Size, "parts", (attrs.Size+downloadPartSize-1)/downloadPartSize)
+
+	partCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var errMut sync.Mutex
+	var partErrors []error
+	for offset := int64(downloadPartSize); offset < attrs.Size; offset += downloadPartSize {
+		length := min(int64(downloadPartSize), attrs.Size-offset)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.readWithRetry(partCtx, obj.ObjectName(), func() error {
+				_, err := s.readRange(partCtx, obj, outFile, offset, length)
+				return err
+			})
+			if err != nil {
+				errMut.Lock()
+				partErrors = append(partErrors, fmt.Errorf("error reading bytes %d-%d, %w", offset, offset+length-1, err))
+				errMut.Unlock()
+				// there is no point reading the remaining parts
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(partErrors) > 0 {
+		return 0, attrs, errors.Join(partErrors...)
+	}
+	return attrs.Size, attrs, nil
+}
+
+// readRange reads length bytes of the object from offset, writing them at the same offset of the file
+func (s *GcpStorageBucketSource) readRange(ctx context.Context, obj *storage.ObjectHandle, outFile *os.File, offset, length int64) (storage.ReaderObjectAttrs, error) {
+	if err := s.downloadLimiter.Wait(ctx); err != nil {
+		return storage.ReaderObjectAttrs{}, fmt.Errorf("error acquiring download limiter: %w", err)
+	}
+	defer s.downloadLimiter.Release()
+
+	reader, err := obj.NewRangeReader(ctx, offset, length)
+	if rpErr := s.requesterPaysError(obj.BucketName(), err); rpErr != nil {
+		return storage.ReaderObjectAttrs{}, rpErr
+	}
+	if err != nil {
+		return storage.ReaderObjectAttrs{}, fmt.Errorf("failed to get object reader: %w", err)
+	}
+	defer reader.Close()
+
+	if _, err := io.Copy(io.NewOffsetWriter(outFile, offset), reader); err != nil {
+		return storage.ReaderObjectAttrs{}, fmt.Errorf("failed to write data to file, %w", err)
+	}
+	return reader.Attrs, nil
+}
+
+// readWithRetry calls read, retrying up to maxDownloadRetries times if it fails with a transient error
+// (the client retries and resumes reads itself, so this only retries errors it has given up on)
+func (s *GcpStorageBucketSource) readWithRetry(ctx context.Context, objectName string, read func() error) error {
+	backoff := newDownloadBackoff()
+	for attempt := 0; ; attempt++ {
+		err := read()
+		if err == nil || attempt >= maxDownloadRetries || !storage.ShouldRetry(err) {
+			return err
+		}
+
+		pause := backoff.Pause()
+		slog.Warn("Retrying object download", "object", objectName, "attempt", attempt+1, "pause", pause, "error", err)
+		if err := gax.Sleep(ctx, pause); err != nil {
+			return err
+		}
+	}
+}
+
+// newDownloadBackoff returns the backoff used between retries of a failed object read
+func newDownloadBackoff() gax.Backoff {
+	return gax.Backoff{
+		Initial:    time.Second,
+		Max:        30 * time.Second,
+		Multiplier: 2,
+	}
+}
+
+// downloadedObjectLoader is an [artifact_loader.Loader] which loads objects downloaded to temp files with the SDK
+// loader for their extension, as the SDK does if the table has no loader - the SDK caches the loaders it creates in
+// a map it creates when the first artifact is loaded, which is not safe when artifacts are loaded concurrently, so
+// the source sets this loader instead, which creates a loader for each object
+type downloadedObjectLoader struct {
+	rowPerLine bool
+}
+
+func (l *downloadedObjectLoader) Identifier() string {
+	return DownloadedObjectLoaderIdentifier
+}
+
+func (l *downloadedObjectLoader) Load(ctx context.Context, info *types.DownloadedArtifactInfo, dataChan chan *types.RowData) error {
+	var loader artifact_loader.Loader
+	switch filepath.Ext(info.LocalName) {
+	case ".gz":
+		loader = artifact_loader.NewGzipLoader()
+		if l.rowPerLine {
+			loader = artifact_loader.NewGzipRowLoader()
+		}
+	case ".zst":
+		loader = artifact_loader.NewZstdLoader()
+		if l.rowPerLine {
+			loader = artifact_loader.NewZstdRowLoader()
+		}
+	case ".zip":
+		loader = artifact_loader.NewZipLoader()
+		if l.rowPerLine {
+			loader = artifact_loader.NewZipRowLoader()
+		}
+	default:
+		loader = artifact_loader.NewFileLoader()
+		if l.rowPerLine {
+			loader = artifact_loader.NewFileRowLoader()
+		}
+	}
+	return loader.Load(ctx, info, dataChan)
+}
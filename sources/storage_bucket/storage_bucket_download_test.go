@@ -0,0 +1,400 @@
+package storage_bucket
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+
+	"github.com/turbot/tailpipe-plugin-sdk/rate_limiter"
+	"github.com/turbot/tailpipe-plugin-sdk/types"
+)
+
+// fakeObjectServer serves a single object using the Cloud Storage XML API, recording the ranges requested -
+// it also serves the attributes of its bucket, and restores soft-deleted generations of the object
+type fakeObjectServer struct {
+	*httptest.Server
+	content    []byte
+	generation int64
+
+	mut sync.Mutex
+	// the requested ranges, in the form start-end, and the generations requested
+	ranges      []string
+	generations []string
+	// map of range start to the number of reads of the range which are dropped part way through
+	dropped map[int64]int
+	// map of range start to the number of reads of the range which fail with a transient error
+	unavailable map[int64]int
+	// map of range start to the status returned for reads of the range
+	failed map[int64]int
+	// the generations deleted
+	deleted []string
+	// the bucket attributes returned, as JSON
+	bucketAttrs string
+	// the soft-deleted generations restored
+	restored []string
+}
+
+func newFakeObjectServer(t *testing.T, content []byte, generation int64) *fakeObjectServer {
+	f := &fakeObjectServer{content: content, generation: generation, dropped: make(map[int64]int), unavailable: make(map[int64]int), failed: make(map[int64]int)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeObjectServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/storage/v1/b/") && !strings.Contains(strings.TrimPrefix(r.URL.Path, "/storage/v1/b/"), "/") {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(cmp.Or(f.bucketAttrs, `{"name":"b"}`)))
+		return
+	}
+	if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/restore") {
+		f.mut.Lock()
+		f.restored = append(f.restored, r.URL.Query().Get("generation"))
+		f.mut.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"bucket":"b","name":"o","generation":"%d","metageneration":"1"}`, f.generation)))
+		return
+	}
+	if r.Method == http.MethodDelete {
+		f.mut.Lock()
+		f.deleted = append(f.deleted, r.URL.Query().Get("generation"))
+		f.mut.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	start, end := int64(0), int64(len(f.content)-1)
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		parts := strings.SplitN(strings.TrimPrefix(rangeHeader, "bytes="), "-", 2)
+		start, _ = strconv.ParseInt(parts[0], 10, 64)
+		if parts[1] != "" {
+			end, _ = strconv.ParseInt(parts[1], 10, 64)
+		}
+		end = min(end, int64(len(f.content)-1))
+	}
+
+	f.mut.Lock()
+	f.ranges = append(f.ranges, fmt.Sprintf("%d-%d", start, end))
+	f.generations = append(f.generations, r.URL.Query().Get("generation"))
+	status := f.failed[start]
+	if f.unavailable[start] > 0 {
+		f.unavailable[start]--
+		status = http.StatusServiceUnavailable
+	}
+	drop := f.dropped[start] > 0
+	if drop {
+		f.dropped[start]--
+	}
+	f.mut.Unlock()
+
+	if status != 0 {
+		http.Error(w, "read failed", status)
+		return
+	}
+
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(f.generation, 10))
+	w.Header().Set("X-Goog-Metageneration", "1")
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(f.content)))
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	if drop {
+		// send half the range, then drop the connection
+		_, _ = w.Write(f.content[start : start+(end-start+1)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	_, _ = w.Write(f.content[start : end+1])
+}
+
+// newDownloadTestSource returns a source which reads from the fake server
+func newDownloadTestSource(t *testing.T, server *fakeObjectServer) *GcpStorageBucketSource {
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(server.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	return &GcpStorageBucketSource{
+		client: client,
+		downloadLimiter: rate_limiter.NewAPILimiter(&rate_limiter.Definition{
+			Name:           "test",
+			MaxConcurrency: defaultMaxConcurrentDownloads,
+		}),
+	}
+}
+
+// objectContent returns content of the given size which differs in every part
+func objectContent(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	return content
+}
+
+func TestDownloadObject(t *testing.T) {
+	tests := []struct {
+		name        string
+		size        int
+		dropped     map[int64]int
+		unavailable map[int64]int
+		failed      map[int64]int
+		// the ranges requested, in any order
+		wantRanges []string
+		wantErr    string
+	}{
+		{
+			name:       "single part",
+			size:       1024,
+			wantRanges: []string{"0-1023"},
+		},
+		{
+			name: "parts",
+			size: 2*downloadPartSize + 1024,
+			wantRanges: []string{
+				fmt.Sprintf("0-%d", downloadPartSize-1),
+				fmt.Sprintf("%d-%d", downloadPartSize, 2*downloadPartSize-1),
+				fmt.Sprintf("%d-%d", 2*downloadPartSize, 2*downloadPartSize+1023),
+			},
+		},
+		{
+			// the client resumes the read from the last byte received
+			name:    "part dropped and resumed",
+			size:    downloadPartSize + 1024,
+			dropped: map[int64]int{downloadPartSize: 1},
+			wantRanges: []string{
+				fmt.Sprintf("0-%d", downloadPartSize-1),
+				fmt.Sprintf("%d-%d", downloadPartSize, downloadPartSize+1023),
+				fmt.Sprintf("%d-%d", downloadPartSize+512, downloadPartSize+1023),
+			},
+		},
+		{
+			name:        "part unavailable and retried",
+			size:        downloadPartSize + 1024,
+			unavailable: map[int64]int{downloadPartSize: 1},
+			wantRanges: []string{
+				fmt.Sprintf("0-%d", downloadPartSize-1),
+				fmt.Sprintf("%d-%d", downloadPartSize, downloadPartSize+1023),
+				fmt.Sprintf("%d-%d", downloadPartSize, downloadPartSize+1023),
+			},
+		},
+		{
+			name:    "part failed",
+			size:    downloadPartSize + 1024,
+			failed:  map[int64]int{downloadPartSize: http.StatusForbidden},
+			wantErr: fmt.Sprintf("error reading bytes %d-%d", downloadPartSize, downloadPartSize+1023),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := objectContent(tt.size)
+			server := newFakeObjectServer(t, content, 7)
+			for start, count := range tt.dropped {
+				server.dropped[start] = count
+			}
+			for start, count := range tt.unavailable {
+				server.unavailable[start] = count
+			}
+			for start, status := range tt.failed {
+				server.failed[start] = status
+			}
+			s := newDownloadTestSource(t, server)
+
+			outFile, err := os.Create(filepath.Join(t.TempDir(), "object"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer outFile.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			n, attrs, err := s.downloadObject(ctx, s.client.Bucket("b").Object("o"), outFile)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("downloadObject() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("downloadObject() error = %v", err)
+			}
+
+			if n != int64(tt.size) || attrs.Generation != 7 {
+				t.Errorf("downloadObject() = %d, generation %d, want %d, generation 7", n, attrs.Generation, tt.size)
+			}
+			got, err := os.ReadFile(outFile.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("downloaded content differs from the object content")
+			}
+
+			server.mut.Lock()
+			defer server.mut.Unlock()
+			gotRanges := slices.Sorted(slices.Values(server.ranges))
+			if !slices.Equal(gotRanges, slices.Sorted(slices.Values(tt.wantRanges))) {
+				t.Errorf("requested ranges %v, want %v", server.ranges, tt.wantRanges)
+			}
+			// the parts after the first are read from the generation the first part was read from
+			for i, generation := range server.generations {
+				if server.ranges[i] != tt.wantRanges[0] && generation != "7" {
+					t.Errorf("range %s read from generation %q, want 7", server.ranges[i], generation)
+				}
+			}
+		})
+	}
+}
+
+func TestReadWithRetry(t *testing.T) {
+	s := &GcpStorageBucketSource{}
+	errPermanent := errors.New("permanent")
+
+	tests := []struct {
+		name string
+		// the errors returned by successive reads, after which reads succeed
+		errs      []error
+		cancelled bool
+		wantReads int
+		wantErr   error
+	}{
+		{name: "success", wantReads: 1},
+		{name: "transient errors", errs: []error{io.ErrUnexpectedEOF, io.ErrUnexpectedEOF}, wantReads: 3},
+		{name: "permanent error", errs: []error{errPermanent}, wantReads: 1, wantErr: errPermanent},
+		{name: "cancelled", errs: []error{io.ErrUnexpectedEOF}, cancelled: true, wantReads: 1, wantErr: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancelled {
+				cancel()
+			}
+
+			reads := 0
+			err := s.readWithRetry(ctx, "o", func() error {
+				reads++
+				if reads <= len(tt.errs) {
+					return tt.errs[reads-1]
+				}
+				return nil
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("readWithRetry() error = %v, want %v", err, tt.wantErr)
+			}
+			if reads != tt.wantReads {
+				t.Errorf("readWithRetry() read %d times, want %d", reads, tt.wantReads)
+			}
+		})
+	}
+}
+
+func TestDeleteRestoredObject(t *testing.T) {
+	server := newFakeObjectServer(t, nil, 0)
+	s := newDownloadTestSource(t, server)
+
+	// the live object is not deleted
+	live := &types.ArtifactInfo{Name: "gs://b/live"}
+	s.objectVersions.Store(live.Name, objectVersion{bucket: "b", name: "live", generation: 5})
+	if err := s.deleteRestoredObject(context.Background(), live); err != nil {
+		t.Fatalf("deleteRestoredObject() error = %v", err)
+	}
+
+	// the generation restored to read a soft-deleted object is deleted
+	softDeleted := &types.ArtifactInfo{Name: "gs://b/o#5"}
+	s.objectVersions.Store(softDeleted.Name, objectVersion{bucket: "b", name: "o", generation: 5, softDeleted: true, restoredGeneration: 9})
+	if err := s.deleteRestoredObject(context.Background(), softDeleted); err != nil {
+		t.Fatalf("deleteRestoredObject() error = %v", err)
+	}
+
+	if !slices.Equal(server.deleted, []string{"9"}) {
+		t.Errorf("deleted generations %v, want [9]", server.deleted)
+	}
+}
+
+func TestRestoreSoftDeletedObject(t *testing.T) {
+	tests := []struct {
+		name         string
+		bucketAttrs  string
+		version      objectVersion
+		wantErr      string
+		wantRestored []string
+	}{
+		{
+			name:         "restored",
+			version:      objectVersion{bucket: "b", name: "o", generation: 5, softDeleted: true},
+			wantRestored: []string{"5"},
+		},
+		{
+			name:         "expired object retention",
+			version:      objectVersion{bucket: "b", name: "o", generation: 5, softDeleted: true, retainUntil: time.Now().Add(-time.Hour)},
+			wantRestored: []string{"5"},
+		},
+		{
+			name:        "bucket retention policy",
+			bucketAttrs: `{"name":"b","retentionPolicy":{"retentionPeriod":"86400","effectiveTime":"2025-01-01T00:00:00Z","isLocked":true}}`,
+			version:     objectVersion{bucket: "b", name: "o", generation: 5, softDeleted: true},
+			wantErr:     "soft-deleted objects in bucket b are not restored: the bucket has a locked retention policy of 24h0m0s",
+		},
+		{
+			name:        "bucket default event-based hold",
+			bucketAttrs: `{"name":"b","defaultEventBasedHold":true}`,
+			version:     objectVersion{bucket: "b", name: "o", generation: 5, softDeleted: true},
+			wantErr:     "the bucket places an event-based hold on new objects",
+		},
+		{
+			name:    "object temporary hold",
+			version: objectVersion{bucket: "b", name: "o", generation: 5, softDeleted: true, temporaryHold: true},
+			wantErr: "soft-deleted object gs://b/o#5 is not restored: it has a temporary hold",
+		},
+		{
+			name:    "object retention",
+			version: objectVersion{bucket: "b", name: "o", generation: 5, softDeleted: true, retainUntil: time.Now().Add(time.Hour)},
+			wantErr: "soft-deleted object gs://b/o#5 is not restored: it is retained until",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeObjectServer(t, nil, 9)
+			server.bucketAttrs = tt.bucketAttrs
+			s := newDownloadTestSource(t, server)
+			restoreSoftDeleted := true
+			s.Config = &GcpStorageBucketSourceConfig{RestoreSoftDeleted: &restoreSoftDeleted}
+			info := &types.ArtifactInfo{Name: tt.version.path()}
+			s.objectVersions.Store(info.Name, tt.version)
+
+			// the bucket is checked when soft-deleted objects are discovered, and the object when it is restored
+			err := s.checkRestoreAllowed(context.Background(), "b")
+			if err == nil {
+				_, err = s.getObjectHandle(context.Background(), info)
+			}
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			if !slices.Equal(server.restored, tt.wantRestored) {
+				t.Errorf("restored generations %v, want %v", server.restored, tt.wantRestored)
+			}
+		})
+	}
+}
@@ -0,0 +1,390 @@
+package storage_bucket
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+
+	"github.com/turbot/pipe-fittings/v2/filter"
+)
+
+// the suffix of the manifest written alongside the shards of each inventory report
+const inventoryManifestSuffix = "_manifest.json"
+
+// inventoryManifest is the manifest of a Storage Insights inventory report
+// (only the fields used to read the report are included)
+type inventoryManifest struct {
+	ReportConfig struct {
+		Name       string `json:"name"`
+		CsvOptions *struct {
+			Delimiter      string `json:"delimiter"`
+			HeaderRequired bool   `json:"headerRequired"`
+		} `json:"csvOptions"`
+		ObjectMetadataReportOptions struct {
+			MetadataFields []string `json:"metadataFields"`
+			StorageFilters struct {
+				Bucket string `json:"bucket"`
+			} `json:"storageFilters"`
+		} `json:"objectMetadataReportOptions"`
+	} `json:"report_config"`
+	RecordsProcessed      int64     `json:"records_processed"`
+	SnapshotTime          time.Time `json:"snapshot_time"`
+	ShardCount            int       `json:"shard_count"`
+	ReportShardsFileNames []string  `json:"report_shards_file_names"`
+}
+
+// csvOptions returns the options for reading the CSV shards of the report - if the report has no header row,
+// the columns are the metadata fields of the report configuration
+func (m *inventoryManifest) csvOptions() inventoryCsvOptions {
+	var options inventoryCsvOptions
+	if csvOptions := m.ReportConfig.CsvOptions; csvOptions != nil {
+		options.delimiter = csvOptions.Delimiter
+		if !csvOptions.HeaderRequired {
+			options.columns = m.ReportConfig.ObjectMetadataReportOptions.MetadataFields
+		}
+	}
+	return options
+}
+
+// discoverFromInventoryReport discovers artifacts from the latest Storage Insights inventory report,
+// rather than by listing the bucket locations.
+//
+// Each shard of the report is downloaded and read in turn, and the live objects in the bucket locations are written
+// to a run file, sorted by name - so only a single shard is held in memory. The runs are then merged, and the objects
+// passed to WalkNode in name order as they are read, along with their parent directories, so the layout, filters and
+// collection state are applied exactly as they are when walking the bucket (the collection state requires the
+// objects of each location to be discovered in time order, which the shards are not).
+// Objects created after the report snapshot are not discovered until the next report is generated.
+func (s *GcpStorageBucketSource) discoverFromInventoryReport(ctx context.Context, locations []BucketLocation, filterMap map[string]*filter.SqlFilter) error {
+	report := s.Config.InventoryReport
+
+	manifestName, manifest, err := s.getLatestInventoryManifest(ctx)
+	if err != nil {
+		return err
+	}
+	if report.MaxAge != nil {
+		// the max age is validated in the config
+		maxAge, _ := time.ParseDuration(*report.MaxAge)
+		if age := time.Since(manifest.SnapshotTime); age > maxAge {
+			return fmt.Errorf("the latest inventory report %s has a snapshot time of %s, which is older than max_age %s", objectURL(report.Bucket, manifestName), manifest.SnapshotTime.Format(time.RFC3339), *report.MaxAge)
+		}
+	}
+
+	slog.Info("Reading Storage Insights inventory report", "manifest", objectURL(report.Bucket, manifestName), "snapshot_time", manifest.SnapshotTime, "shards", len(manifest.ReportShardsFileNames), "records", manifest.RecordsProcessed)
+
+	var runPaths []string
+	defer func() {
+		for _, runPath := range runPaths {
+			_ = os.Remove(runPath)
+		}
+	}()
+	objectCount := 0
+
+	// the shards are written to the same folder as the manifest
+	dir := path.Dir(manifestName)
+	for _, shardName := range manifest.ReportShardsFileNames {
+		if dir != "." {
+			shardName = path.Join(dir, shardName)
+		}
+		localPath, err := s.downloadInventoryShard(ctx, shardName)
+		if err != nil {
+			return err
+		}
+
+		runPath, count, err := s.writeInventoryRun(ctx, localPath, manifest, locations)
+		// the shard is no longer needed once it has been read
+		_ = os.Remove(localPath)
+		if err != nil {
+			return fmt.Errorf("error reading inventory report %s, %w", objectURL(report.Bucket, shardName), err)
+		}
+		runPaths = append(runPaths, runPath)
+		objectCount += count
+	}
+
+	slog.Info("Discovered objects from Storage Insights inventory report", "manifest", objectURL(report.Bucket, manifestName), "objects", objectCount)
+
+	return s.walkInventoryRuns(ctx, locations, runPaths, filterMap)
+}
+
+// inventoryObject is a live object in a bucket location, read from an inventory report shard
+type inventoryObject struct {
+	// the index of the location containing the object
+	Location       int       `json:"location"`
+	Bucket         string    `json:"bucket"`
+	Name           string    `json:"name"`
+	Generation     int64     `json:"generation,omitempty"`
+	Metageneration int64     `json:"metageneration,omitempty"`
+	Md5Hash        string    `json:"md5_hash,omitempty"`
+	Crc32c         string    `json:"crc32c,omitempty"`
+	Updated        time.Time `json:"updated,omitzero"`
+}
+
+// compareInventoryObjects orders inventory objects by location, then name
+func compareInventoryObjects(a, b *inventoryObject) int {
+	if a.Location != b.Location {
+		return a.Location - b.Location
+	}
+	return strings.Compare(a.Name, b.Name)
+}
+
+func (o *inventoryObject) version() objectVersion {
+	return objectVersion{
+		bucket:         o.Bucket,
+		name:           o.Name,
+		generation:     o.Generation,
+		metageneration: o.Metageneration,
+		md5Hash:        o.Md5Hash,
+		crc32c:         o.Crc32c,
+		updated:        o.Updated,
+	}
+}
+
+// writeInventoryRun reads the downloaded shard, and writes the live objects in the bucket locations which satisfy
+// the object filters to a run file alongside it, as JSON lines sorted by location and name
+// returns the path of the run file and the number of objects written to it
+func (s *GcpStorageBucketSource) writeInventoryRun(ctx context.Context, localPath string, manifest *inventoryManifest, locations []BucketLocation) (string, int, error) {
+	var objects []*inventoryObject
+	err := readInventoryReport(ctx, localPath, manifest.csvOptions(), func(record *InventoryRecord) error {
+		// the report only includes the bucket field if it was selected - otherwise the report is for a single bucket
+		bucket := record.Bucket
+		if bucket == "" {
+			bucket = manifest.ReportConfig.ObjectMetadataReportOptions.StorageFilters.Bucket
+		}
+		// only live objects are collected
+		if record.SoftDeleteTime != nil || record.TimeDeleted != nil {
+			return nil
+		}
+		idx := locationIndex(locations, bucket, record.Name)
+		if idx < 0 {
+			return nil
+		}
+		if s.Config.HasObjectFilters() && !s.Config.ObjectSatisfiesFilters(getInventoryObjectAttrs(bucket, record)) {
+			return nil
+		}
+
+		object := &inventoryObject{Location: idx, Bucket: bucket, Name: record.Name, Md5Hash: record.Md5Hash, Crc32c: record.Crc32c}
+		if record.Generation != nil {
+			object.Generation = *record.Generation
+		}
+		if record.Metageneration != nil {
+			object.Metageneration = *record.Metageneration
+		}
+		if record.Updated != nil {
+			object.Updated = *record.Updated
+		}
+		objects = append(objects, object)
+		return nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	slices.SortFunc(objects, compareInventoryObjects)
+
+	runPath := localPath + ".run"
+	runFile, err := os.Create(runPath)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create file, %w", err)
+	}
+	defer runFile.Close()
+
+	writer := bufio.NewWriter(runFile)
+	encoder := json.NewEncoder(writer)
+	for _, object := range objects {
+		if err := encoder.Encode(object); err != nil {
+			return "", 0, fmt.Errorf("failed to write inventory objects, %w", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return "", 0, fmt.Errorf("failed to write inventory objects, %w", err)
+	}
+	return runPath, len(objects), nil
+}
+
+// inventoryRun reads the objects of a run file in order
+type inventoryRun struct {
+	decoder *json.Decoder
+	// the next object of the run, or nil once the run has been read
+	next *inventoryObject
+}
+
+// advance reads the next object of the run
+func (r *inventoryRun) advance() error {
+	var object inventoryObject
+	err := r.decoder.Decode(&object)
+	if errors.Is(err, io.EOF) {
+		r.next = nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read inventory objects, %w", err)
+	}
+	r.next = &object
+	return nil
+}
+
+// walkInventoryRuns merges the run files, walking the objects of each location in name order with an objectWalker
+func (s *GcpStorageBucketSource) walkInventoryRuns(ctx context.Context, locations []BucketLocation, runPaths []string, filterMap map[string]*filter.SqlFilter) error {
+	runs := make([]*inventoryRun, 0, len(runPaths))
+	for _, runPath := range runPaths {
+		runFile, err := os.Open(runPath)
+		if err != nil {
+			return fmt.Errorf("failed to open file, %w", err)
+		}
+		defer runFile.Close()
+
+		run := &inventoryRun{decoder: json.NewDecoder(bufio.NewReader(runFile))}
+		if err := run.advance(); err != nil {
+			return err
+		}
+		runs = append(runs, run)
+	}
+
+	var walker *objectWalker
+	var previous *inventoryObject
+	for {
+		// the next object is the first of the next objects of the runs
+		var next *inventoryRun
+		for _, run := range runs {
+			if run.next != nil && (next == nil || compareInventoryObjects(run.next, next.next) < 0) {
+				next = run
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		object := next.next
+		if err := next.advance(); err != nil {
+			return err
+		}
+
+		// an object which is in more than one shard is only walked once
+		if previous != nil && compareInventoryObjects(object, previous) == 0 {
+			continue
+		}
+		if previous == nil || object.Location != previous.Location {
+			location := locations[object.Location]
+			g, err := s.newGrok()
+			if err != nil {
+				return err
+			}
+			s.registerBucket(location.Bucket)
+			walker = s.newObjectWalker(location.getPrefix(), s.getLayouts(location), filterMap, g)
+		}
+		previous = object
+
+		if err := walker.walk(ctx, object.version()); err != nil {
+			return err
+		}
+	}
+}
+
+// getLatestInventoryManifest returns the name and contents of the manifest of the most recently written
+// inventory report in the inventory_report destination (for the report configuration, if set)
+func (s *GcpStorageBucketSource) getLatestInventoryManifest(ctx context.Context) (string, *inventoryManifest, error) {
+	report := s.Config.InventoryReport
+
+	query := &storage.Query{
+		Prefix:    report.getPrefix(),
+		MatchGlob: "**" + inventoryManifestSuffix,
+	}
+	if err := query.SetAttrSelection([]string{"Name", "Created"}); err != nil {
+		return "", nil, err
+	}
+
+	var latest *storage.ObjectAttrs
+	it := s.bucket(report.Bucket).Objects(ctx, query)
+	for {
+		objAttrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			if rpErr := s.requesterPaysError(report.Bucket, err); rpErr != nil {
+				return "", nil, rpErr
+			}
+			return "", nil, fmt.Errorf("error listing inventory report manifests in %s, %w", objectURL(report.Bucket, report.getPrefix()), err)
+		}
+		// manifest names start with the ID of the report configuration
+		if report.ReportConfigId != nil && !strings.HasPrefix(path.Base(objAttrs.Name), *report.ReportConfigId+"_") {
+			continue
+		}
+		if latest == nil || objAttrs.Created.After(latest.Created) {
+			latest = objAttrs
+		}
+	}
+	if latest == nil {
+		return "", nil, fmt.Errorf("no inventory reports found in %s", objectURL(report.Bucket, report.getPrefix()))
+	}
+
+	reader, err := s.bucket(report.Bucket).Object(latest.Name).NewReader(ctx)
+	if err != nil {
+		if rpErr := s.requesterPaysError(report.Bucket, err); rpErr != nil {
+			return "", nil, rpErr
+		}
+		return "", nil, fmt.Errorf("error reading inventory report manifest %s, %w", objectURL(report.Bucket, latest.Name), err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return "", nil, fmt.Errorf("error reading inventory report manifest %s, %w", objectURL(report.Bucket, latest.Name), err)
+	}
+	var manifest inventoryManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return "", nil, fmt.Errorf("error parsing inventory report manifest %s, %w", objectURL(report.Bucket, latest.Name), err)
+	}
+	return latest.Name, &manifest, nil
+}
+
+// downloadInventoryShard downloads a shard of the inventory report to the temp dir, returning the local path
+func (s *GcpStorageBucketSource) downloadInventoryShard(ctx context.Context, shardName string) (string, error) {
+	report := s.Config.InventoryReport
+
+	localPath := path.Join(s.TempDir, "inventory_report", path.Base(shardName))
+	if err := os.MkdirAll(path.Dir(localPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory for file, %w", err)
+	}
+	outFile, err := os.Create(localPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create file, %w", err)
+	}
+	defer outFile.Close()
+
+	if _, _, err := s.downloadObject(ctx, s.bucket(report.Bucket).Object(shardName), outFile); err != nil {
+		return "", fmt.Errorf("failed to download inventory report %s, %w", objectURL(report.Bucket, shardName), err)
+	}
+	return localPath, nil
+}
+
+// getInventoryObjectAttrs returns the attributes of the object in the report, used to apply the object filters
+// (reports do not include custom metadata, so metadata filters cannot be used with inventory reports)
+func getInventoryObjectAttrs(bucket string, record *InventoryRecord) *storage.ObjectAttrs {
+	attrs := &storage.ObjectAttrs{
+		Bucket:       bucket,
+		Name:         record.Name,
+		ContentType:  record.ContentType,
+		StorageClass: record.StorageClass,
+	}
+	if record.Size != nil {
+		attrs.Size = *record.Size
+	}
+	if record.TimeCreated != nil {
+		attrs.Created = *record.TimeCreated
+	}
+	if record.Updated != nil {
+		attrs.Updated = *record.Updated
+	}
+	return attrs
+}
@@ -0,0 +1,344 @@
+package storage_bucket
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet/file"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+
+	"github.com/turbot/tailpipe-plugin-sdk/types"
+)
+
+const (
+	InventoryReportLoaderIdentifier = "gcp_storage_inventory_report_loader"
+
+	// the number of rows read from a Parquet inventory report at a time
+	inventoryParquetBatchSize = 1024
+)
+
+// InventoryRecord is an object in a Storage Insights inventory report
+// only the metadata fields selected in the report configuration are set
+type InventoryRecord struct {
+	Project                 string
+	Bucket                  string
+	Name                    string
+	Location                string
+	Size                    *int64
+	Generation              *int64
+	Metageneration          *int64
+	StorageClass            string
+	ContentType             string
+	ContentEncoding         string
+	ContentLanguage         string
+	Etag                    string
+	Md5Hash                 string
+	Crc32c                  string
+	KmsKeyName              string
+	ComponentCount          *int64
+	TimeCreated             *time.Time
+	Updated                 *time.Time
+	TimeDeleted             *time.Time
+	TimeStorageClassUpdated *time.Time
+	CustomTime              *time.Time
+	RetentionExpirationTime *time.Time
+	TemporaryHold           *bool
+	EventBasedHold          *bool
+	SoftDeleteTime          *time.Time
+	HardDeleteTime          *time.Time
+}
+
+// newInventoryRecord creates an InventoryRecord from the fields of a report row, keyed by column name
+// column names are matched ignoring case and underscores, so both timeCreated and time_created are recognised,
+// and unknown columns are ignored
+func newInventoryRecord(fields map[string]string) (*InventoryRecord, error) {
+	r := &InventoryRecord{}
+	var err error
+	for column, value := range fields {
+		if value == "" {
+			continue
+		}
+		switch strings.ToLower(strings.ReplaceAll(column, "_", "")) {
+		case "project":
+			r.Project = value
+		case "bucket":
+			r.Bucket = value
+		case "name":
+			r.Name = value
+		case "location":
+			r.Location = value
+		case "size":
+			r.Size, err = parseInventoryInt(value)
+		case "generation":
+			r.Generation, err = parseInventoryInt(value)
+		case "metageneration":
+			r.Metageneration, err = parseInventoryInt(value)
+		case "storageclass":
+			r.StorageClass = value
+		case "contenttype":
+			r.ContentType = value
+		case "contentencoding":
+			r.ContentEncoding = value
+		case "contentlanguage":
+			r.ContentLanguage = value
+		case "etag":
+			r.Etag = value
+		case "md5hash":
+			r.Md5Hash = value
+		case "crc32c":
+			r.Crc32c = value
+		case "kmskeyname":
+			r.KmsKeyName = value
+		case "componentcount":
+			r.ComponentCount, err = parseInventoryInt(value)
+		case "timecreated":
+			r.TimeCreated, err = parseInventoryTime(value)
+		case "updated":
+			r.Updated, err = parseInventoryTime(value)
+		case "timedeleted":
+			r.TimeDeleted, err = parseInventoryTime(value)
+		case "timestorageclassupdated":
+			r.TimeStorageClassUpdated, err = parseInventoryTime(value)
+		case "customtime":
+			r.CustomTime, err = parseInventoryTime(value)
+		case "retentionexpirationtime":
+			r.RetentionExpirationTime, err = parseInventoryTime(value)
+		case "temporaryhold":
+			r.TemporaryHold, err = parseInventoryBool(value)
+		case "eventbasedhold":
+			r.EventBasedHold, err = parseInventoryBool(value)
+		case "softdeletetime":
+			r.SoftDeleteTime, err = parseInventoryTime(value)
+		case "harddeletetime":
+			r.HardDeleteTime, err = parseInventoryTime(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q, %w", column, value, err)
+		}
+	}
+	if r.Name == "" {
+		return nil, fmt.Errorf("row has no object name")
+	}
+	return r, nil
+}
+
+// the time formats used by inventory reports - CSV reports use RFC 3339,
+// and Parquet timestamps are converted to RFC 3339 when read
+var inventoryTimeFormats = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02 15:04:05.999999999Z07:00", "2006-01-02 15:04:05.999999999"}
+
+func parseInventoryTime(value string) (*time.Time, error) {
+	for _, format := range inventoryTimeFormats {
+		if t, err := time.Parse(format, value); err == nil {
+			t = t.UTC()
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("expected an RFC 3339 time")
+}
+
+func parseInventoryInt(value string) (*int64, error) {
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &i, nil
+}
+
+func parseInventoryBool(value string) (*bool, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// inventoryCsvOptions are the options of a CSV inventory report
+type inventoryCsvOptions struct {
+	// the field delimiter - defaults to a comma
+	delimiter string
+	// the columns of the report, if the report has no header row
+	columns []string
+}
+
+// readInventoryReport reads the inventory report file at the path, calling fn for each object in it
+// the format is determined from the file extension (.csv or .parquet)
+func readInventoryReport(ctx context.Context, path string, csvOptions inventoryCsvOptions, fn func(*InventoryRecord) error) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("error opening %s: %w", path, err)
+		}
+		defer f.Close()
+		return readInventoryCsv(ctx, f, csvOptions, fn)
+	case ".parquet":
+		return readInventoryParquet(ctx, path, fn)
+	default:
+		return fmt.Errorf("unsupported inventory report format %s, expected .csv or .parquet", filepath.Ext(path))
+	}
+}
+
+func readInventoryCsv(ctx context.Context, r io.Reader, options inventoryCsvOptions, fn func(*InventoryRecord) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	if options.delimiter != "" {
+		delimiter := []rune(options.delimiter)
+		if len(delimiter) != 1 {
+			return fmt.Errorf("unsupported inventory report delimiter %q, expected a single character", options.delimiter)
+		}
+		reader.Comma = delimiter[0]
+	}
+
+	columns := options.columns
+	if len(columns) == 0 {
+		header, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading inventory report header, %w", err)
+		}
+		// the reader reuses the record slice, so copy the header
+		columns = slices.Clone(header)
+	}
+
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading inventory report, %w", err)
+		}
+
+		fields := make(map[string]string, len(columns))
+		for i, column := range columns {
+			if i < len(row) {
+				fields[column] = row[i]
+			}
+		}
+		record, err := newInventoryRecord(fields)
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return fmt.Errorf("error reading inventory report line %d, %w", line, err)
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
+
+func readInventoryParquet(ctx context.Context, path string, fn func(*InventoryRecord) error) error {
+	pf, err := file.OpenParquetFile(path, false)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", path, err)
+	}
+	defer pf.Close()
+
+	fr, err := pqarrow.NewFileReader(pf, pqarrow.ArrowReadProperties{BatchSize: inventoryParquetBatchSize}, memory.DefaultAllocator)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+	rr, err := fr.GetRecordReader(ctx, nil, nil)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+	defer rr.Release()
+
+	for rr.Next() {
+		batch := rr.Record()
+		schema := batch.Schema()
+		for row := 0; row < int(batch.NumRows()); row++ {
+			fields := make(map[string]string, batch.NumCols())
+			for col, column := range batch.Columns() {
+				if value, ok := arrowValueString(column, row); ok {
+					fields[schema.Field(col).Name] = value
+				}
+			}
+			record, err := newInventoryRecord(fields)
+			if err != nil {
+				return fmt.Errorf("error reading inventory report row, %w", err)
+			}
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+	}
+	if err := rr.Err(); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+	return nil
+}
+
+// arrowValueString returns the value in the column as a string, in the form expected by newInventoryRecord
+// returns false if the value is null
+func arrowValueString(column arrow.Array, row int) (string, bool) {
+	if column.IsNull(row) {
+		return "", false
+	}
+	switch c := column.(type) {
+	case *array.Timestamp:
+		unit := c.DataType().(*arrow.TimestampType).Unit
+		return c.Value(row).ToTime(unit).UTC().Format(time.RFC3339Nano), true
+	case *array.String:
+		return c.Value(row), true
+	case *array.LargeString:
+		return c.Value(row), true
+	default:
+		return column.ValueStr(row), true
+	}
+}
+
+// InventoryReportLoader is an [artifact_loader.Loader] which loads the objects in a Storage Insights inventory report,
+// in CSV (with a header row) or Parquet format - each object is passed to the mapper as an *InventoryRecord
+type InventoryReportLoader struct {
+}
+
+func NewInventoryReportLoader() *InventoryReportLoader {
+	return &InventoryReportLoader{}
+}
+
+func (l *InventoryReportLoader) Identifier() string {
+	return InventoryReportLoaderIdentifier
+}
+
+func (l *InventoryReportLoader) Load(ctx context.Context, info *types.DownloadedArtifactInfo, dataChan chan *types.RowData) error {
+	// check the format before starting to read, so an unsupported artifact fails the load
+	switch strings.ToLower(filepath.Ext(info.LocalName)) {
+	case ".csv", ".parquet":
+	default:
+		return fmt.Errorf("unsupported inventory report format %s, expected .csv or .parquet", filepath.Ext(info.LocalName))
+	}
+
+	go func() {
+		defer close(dataChan)
+
+		err := readInventoryReport(ctx, info.LocalName, inventoryCsvOptions{}, func(record *InventoryRecord) error {
+			dataChan <- &types.RowData{
+				Data: record,
+			}
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Error reading inventory report", "report", info.LocalName, "error", err)
+		}
+	}()
+	return nil
+}
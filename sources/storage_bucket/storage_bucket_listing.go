@@ -0,0 +1,477 @@
+package storage_bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/elastic/go-grok"
+	"google.golang.org/api/iterator"
+
+	"github.com/turbot/pipe-fittings/v2/filter"
+	"github.com/turbot/tailpipe-plugin-sdk/constants"
+)
+
+// grok patterns which never match a "/" - these are converted to a single segment glob wildcard
+var singleSegmentPatterns = []string{"YEAR", "MONTHNUM", "MONTHNUM2", "MONTHDAY", "HOUR", "MINUTE", "SECOND", "WORD", "INT", "NUMBER", "POSINT", "NONNEGINT"}
+
+// bucketListing is a listing of the bucket, starting from a prefix
+// if matchGlob is set, the objects under the prefix are listed (flat) and filtered with the glob,
+// otherwise the directories under the prefix are walked
+type bucketListing struct {
+	bucket    string
+	prefix    string
+	matchGlob string
+	// if set, only objects with names at or after this are listed - only set for a listing within a single
+	// directory at the listing offset depth, see listingOffsetDepth
+	startOffset string
+}
+
+// getListings determines the listings required to discover all objects which may match the layouts.
+//
+// Each listing starts from the longest literal prefix of a layout, rather than from the root of the bucket.
+// If the collection time range fixes one or more of the date segments of a layout (e.g. the collection is
+// within a single month), the layout is converted to a glob, with the date segments resolved, and the objects
+// are listed using the glob. Otherwise, the directories under the literal prefix are walked.
+//
+// Listings which overlap are merged, so each object is only listed once.
+func getListings(prefix string, layouts []string, from, to time.Time) []bucketListing {
+	var listings []bucketListing
+	for _, layout := range layouts {
+		listing, ok := getListing(prefix, layout, from, to)
+		if ok {
+			listings = append(listings, listing)
+		}
+	}
+
+	// sort by prefix, so any listing whose prefix starts with the prefix of another listing follows it
+	slices.SortFunc(listings, func(a, b bucketListing) int {
+		return strings.Compare(a.prefix, b.prefix)
+	})
+
+	var merged []bucketListing
+	for _, listing := range listings {
+		if len(merged) > 0 {
+			previous := &merged[len(merged)-1]
+			if strings.HasPrefix(listing.prefix, previous.prefix) {
+				// the previous listing covers this one - if they do not use the same glob, we must walk
+				if listing.matchGlob != previous.matchGlob {
+					previous.matchGlob = ""
+				}
+				continue
+			}
+		}
+		merged = append(merged, listing)
+	}
+
+	// if no layout can match an object under the prefix, just walk the prefix
+	// (the layouts will be applied to each object as usual)
+	if len(merged) == 0 {
+		merged = append(merged, bucketListing{prefix: prefix})
+	}
+	return merged
+}
+
+// getListing returns the listing for a single layout
+// returns false if the layout cannot match any object under the prefix
+func getListing(prefix, layout string, from, to time.Time) (bucketListing, bool) {
+	listing := bucketListing{}
+
+	glob, datesResolved, ok := layoutToGlob(layout, from, to)
+	if ok {
+		listing.prefix = literalPrefix(glob, "*?[{\\")
+		if datesResolved {
+			listing.matchGlob = glob
+		}
+	} else {
+		listing.prefix = literalPrefix(layout, "%()[]{}\\*+?|^$")
+	}
+
+	// the listing must be under the configured prefix
+	switch {
+	case strings.HasPrefix(listing.prefix, prefix):
+		// nothing to do
+	case strings.HasPrefix(prefix, listing.prefix):
+		listing.prefix = prefix
+		// the glob cannot be used if it does not match the prefix
+		if listing.matchGlob != "" && !strings.HasPrefix(listing.matchGlob, prefix) {
+			listing.matchGlob = ""
+		}
+	default:
+		// the layout cannot match any object under the prefix
+		return listing, false
+	}
+
+	return listing, true
+}
+
+// literalPrefix returns the portion of the pattern before the first special character
+func literalPrefix(pattern string, specialChars string) string {
+	if idx := strings.IndexAny(pattern, specialChars); idx >= 0 {
+		return pattern[:idx]
+	}
+	return pattern
+}
+
+// layoutToGlob converts a file layout grok pattern to a Cloud Storage glob.
+//
+// Date fields (year, month, day and hour) which have the same value for the whole of the time range are replaced
+// with that value. All other grok fields are replaced with a wildcard. Dots in the layout are assumed to be literal.
+// Returns whether any date fields were resolved, and false if the layout cannot be converted
+// (e.g. it contains regular expression syntax).
+func layoutToGlob(layout string, from, to time.Time) (string, bool, bool) {
+	// the date fields which are constant over the time range
+	resolvedDates := make(map[string]string)
+	if !from.IsZero() {
+		if to.IsZero() {
+			to = time.Now()
+		}
+		from, to = from.UTC(), to.UTC()
+		if from.Year() == to.Year() {
+			resolvedDates[constants.TemplateFieldYear] = fmt.Sprintf("%04d", from.Year())
+			if from.Month() == to.Month() {
+				resolvedDates[constants.TemplateFieldMonth] = paddedGlobValue(int(from.Month()))
+				if from.Day() == to.Day() {
+					resolvedDates[constants.TemplateFieldDay] = paddedGlobValue(from.Day())
+					if from.Hour() == to.Hour() {
+						resolvedDates[constants.TemplateFieldHour] = paddedGlobValue(from.Hour())
+					}
+				}
+			}
+		}
+	}
+
+	var sb strings.Builder
+	datesResolved := false
+	for i := 0; i < len(layout); i++ {
+		c := layout[i]
+		if c == '%' && i+1 < len(layout) && layout[i+1] == '{' {
+			end := strings.IndexByte(layout[i:], '}')
+			if end < 0 {
+				return "", false, false
+			}
+			// the field is in the form PATTERN:name (optionally followed by :type)
+			parts := strings.Split(layout[i+2:i+end], ":")
+			i += end
+
+			if len(parts) > 1 {
+				if value, ok := resolvedDates[parts[1]]; ok {
+					sb.WriteString(value)
+					datesResolved = true
+					continue
+				}
+			}
+			if slices.Contains(singleSegmentPatterns, parts[0]) {
+				sb.WriteString("*")
+			} else {
+				sb.WriteString("**")
+			}
+			continue
+		}
+
+		// any other regex or glob syntax means the layout cannot be converted
+		if strings.IndexByte("()[]{}\\*+?|^$", c) >= 0 {
+			return "", false, false
+		}
+		sb.WriteByte(c)
+	}
+
+	return sb.String(), datesResolved, true
+}
+
+// paddedGlobValue returns a glob matching the value with or without a leading zero
+func paddedGlobValue(value int) string {
+	if value < 10 {
+		return fmt.Sprintf("{%d,0%d}", value, value)
+	}
+	return fmt.Sprintf("%d", value)
+}
+
+// discoverListing discovers the artifacts in a single listing of the bucket location
+// if restoreSoftDeleted is true, soft-deleted objects are also discovered
+func (s *GcpStorageBucketSource) discoverListing(ctx context.Context, location BucketLocation, listing bucketListing, restoreSoftDeleted bool, layouts []string, filterMap map[string]*filter.SqlFilter, g *grok.Grok) error {
+	prefix := location.getPrefix()
+
+	// soft-deleted objects are listed separately, as a listing returns either live or soft-deleted objects
+	if restoreSoftDeleted {
+		walker := s.newObjectWalker(prefix, layouts, filterMap, g)
+		if err := s.listMatchingObjectsFromOffsets(ctx, location, listing, true, walker.walk); err != nil {
+			return err
+		}
+	}
+
+	// if we can list using a glob, walk the matching objects as they are listed
+	if listing.matchGlob != "" {
+		walker := s.newObjectWalker(prefix, layouts, filterMap, g)
+		return s.listMatchingObjectsFromOffsets(ctx, location, listing, false, walker.walk)
+	}
+
+	// otherwise walk the directories from the listing prefix - first walking the directories above it,
+	// so the layout and filters are applied to them exactly as they would be when walking from the root
+	for _, dir := range parentDirs(listing.prefix, prefix) {
+		if err := s.WalkNode(ctx, objectURL(listing.bucket, dir), objectURL(listing.bucket, ""), layouts, true, g, filterMap); err != nil {
+			if errors.Is(err, fs.SkipDir) {
+				return nil
+			}
+			return fmt.Errorf("error walking node, %w", err)
+		}
+	}
+	return s.walk(ctx, location, listing.prefix, layouts, filterMap, g)
+}
+
+// listMatchingObjectsFromOffsets lists the objects matching the listing as listMatchingObjects does - if incremental
+// listing is enabled, each directory at the listing offset depth is listed separately, from the last object collected
+// from it
+func (s *GcpStorageBucketSource) listMatchingObjectsFromOffsets(ctx context.Context, location BucketLocation, listing bucketListing, softDeleted bool, fn func(context.Context, objectVersion) error) error {
+	if !s.Config.GetIncrementalListing() {
+		return s.listMatchingObjects(ctx, listing, softDeleted, fn)
+	}
+
+	listings, err := s.splitListing(ctx, location, listing, softDeleted, fn)
+	if err != nil {
+		return err
+	}
+	for _, listing := range listings {
+		slog.Debug("Listing GCP storage bucket directory", "bucket", listing.bucket, "prefix", listing.prefix, "match_glob", listing.matchGlob, "start_offset", listing.startOffset)
+		if err := s.listMatchingObjects(ctx, listing, softDeleted, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitListing splits the listing into a listing of each directory under its prefix at the listing offset depth,
+// each starting from the last object collected from the directory - the directories are found by walking the
+// listing prefix, and any objects above them are passed to fn
+func (s *GcpStorageBucketSource) splitListing(ctx context.Context, location BucketLocation, listing bucketListing, softDeleted bool, fn func(context.Context, objectVersion) error) ([]bucketListing, error) {
+	if _, ok := s.offsetDir(location, listing.prefix); ok {
+		listing.startOffset = s.getStartOffset(location, listing.prefix)
+		return []bucketListing{listing}, nil
+	}
+
+	query, err := s.objectQuery(bucketListing{prefix: listing.prefix}, softDeleted)
+	if err != nil {
+		return nil, err
+	}
+	query.Delimiter = "/"
+
+	var listings []bucketListing
+	it := s.bucket(listing.bucket).Objects(ctx, query)
+	for {
+		objAttrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return listings, nil
+		}
+		if err != nil {
+			if rpErr := s.requesterPaysError(listing.bucket, err); rpErr != nil {
+				return nil, rpErr
+			}
+			return nil, fmt.Errorf("error listing directories in %s, %w", objectURL(listing.bucket, listing.prefix), err)
+		}
+
+		if objAttrs.Prefix != "" {
+			dirListing := listing
+			dirListing.prefix = objAttrs.Prefix
+			dirListings, err := s.splitListing(ctx, location, dirListing, softDeleted, fn)
+			if err != nil {
+				return nil, err
+			}
+			listings = append(listings, dirListings...)
+			continue
+		}
+
+		if !s.Config.ObjectSatisfiesFilters(objAttrs) {
+			continue
+		}
+		if err := fn(ctx, newObjectVersion(listing.bucket, objAttrs, softDeleted)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// listMatchingObjects lists the objects under the listing prefix which match the listing glob (if any), passing
+// each to fn as it is listed, in name order - so objects are discovered while the rest of the listing is read,
+// and the listing is never held in memory
+// if softDeleted is true, only soft-deleted objects are listed
+func (s *GcpStorageBucketSource) listMatchingObjects(ctx context.Context, listing bucketListing, softDeleted bool, fn func(context.Context, objectVersion) error) error {
+	query, err := s.objectQuery(listing, softDeleted)
+	if err != nil {
+		return err
+	}
+
+	it := s.bucket(listing.bucket).Objects(ctx, query)
+	for {
+		objAttrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			if rpErr := s.requesterPaysError(listing.bucket, err); rpErr != nil {
+				return rpErr
+			}
+			return fmt.Errorf("error listing objects matching %s, %w", objectURL(listing.bucket, listing.matchGlob), err)
+		}
+		if !s.Config.ObjectSatisfiesFilters(objAttrs) {
+			continue
+		}
+		if err := fn(ctx, newObjectVersion(listing.bucket, objAttrs, softDeleted)); err != nil {
+			return err
+		}
+	}
+}
+
+// objectQuery returns the query listing the objects of the listing
+func (s *GcpStorageBucketSource) objectQuery(listing bucketListing, softDeleted bool) (*storage.Query, error) {
+	query := &storage.Query{
+		Prefix:      listing.prefix,
+		MatchGlob:   listing.matchGlob,
+		StartOffset: listing.startOffset,
+		Versions:    s.Config.GetIncludeNoncurrentVersions(),
+		SoftDeleted: softDeleted,
+	}
+	// we only need the object names, versions and provenance, and any attributes used by the object filters
+	attrSelection := []string{"Name", "Generation", "Metageneration", "Deleted", "MD5", "CRC32C", "Updated"}
+	if s.Config.HasObjectFilters() {
+		attrSelection = append(attrSelection, objectFilterAttrs...)
+	}
+	// soft-deleted objects are only restored if the restored copy could be deleted
+	if softDeleted {
+		attrSelection = append(attrSelection, "EventBasedHold", "TemporaryHold", "Retention")
+	}
+	if err := query.SetAttrSelection(attrSelection); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+// objectWalker passes objects to WalkNode, along with the directories containing them (below the prefix),
+// so the layout, filters and collection state are applied exactly as they are when walking the bucket
+// the objects must be in a single bucket, and walked in name order
+type objectWalker struct {
+	source    *GcpStorageBucketSource
+	prefix    string
+	layouts   []string
+	filterMap map[string]*filter.SqlFilter
+	g         *grok.Grok
+	// whether each directory has been walked successfully, so each is only registered once
+	dirSatisfied map[string]bool
+}
+
+func (s *GcpStorageBucketSource) newObjectWalker(prefix string, layouts []string, filterMap map[string]*filter.SqlFilter, g *grok.Grok) *objectWalker {
+	return &objectWalker{
+		source:       s,
+		prefix:       prefix,
+		layouts:      layouts,
+		filterMap:    filterMap,
+		g:            g,
+		dirSatisfied: make(map[string]bool),
+	}
+}
+
+// walk walks the directories containing the object which have not already been walked, and if they all satisfy
+// the layout and filters, the object
+func (w *objectWalker) walk(ctx context.Context, version objectVersion) error {
+	for _, dir := range parentDirs(version.name, w.prefix) {
+		satisfied, ok := w.dirSatisfied[dir]
+		if !ok {
+			err := w.source.WalkNode(ctx, objectURL(version.bucket, dir), objectURL(version.bucket, ""), w.layouts, true, w.g, w.filterMap)
+			if err != nil && !errors.Is(err, fs.SkipDir) {
+				return fmt.Errorf("error walking node, %w", err)
+			}
+			satisfied = err == nil
+			w.dirSatisfied[dir] = satisfied
+		}
+		if !satisfied {
+			return nil
+		}
+	}
+
+	if err := w.source.walkObject(ctx, version, w.layouts, w.filterMap, w.g); err != nil {
+		w.source.addError(fmt.Errorf("error parsing object %s, %w", version.path(), err))
+	}
+	return nil
+}
+
+// walkObjects walks the objects with an objectWalker
+// the objects must be in a single bucket, and sorted by name
+func (s *GcpStorageBucketSource) walkObjects(ctx context.Context, versions []objectVersion, prefix string, layouts []string, filterMap map[string]*filter.SqlFilter, g *grok.Grok) error {
+	walker := s.newObjectWalker(prefix, layouts, filterMap, g)
+	for _, version := range versions {
+		if err := walker.walk(ctx, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the layout fields which order the objects written to a directory by the time they are written
+var dateFields = []string{constants.TemplateFieldYear, constants.TemplateFieldMonth, constants.TemplateFieldDay, constants.TemplateFieldHour, constants.TemplateFieldMinute, constants.TemplateFieldSecond}
+
+// listingOffsetDepth returns the depth of the directories whose objects are written in name order, so each can be
+// listed from the last object collected from it: the number of directories before the first date field of the
+// layout (or its first field, if it has no date fields), e.g. for audit logs this is the directory of each log type
+// the deepest of the layouts is returned, so objects in different directories are never listed from the same offset
+func listingOffsetDepth(layouts []string) int {
+	depth := 0
+	for _, layout := range layouts {
+		end := len(layout)
+		if first := strings.Index(layout, "%{"); first >= 0 {
+			end = first
+		}
+		for i := 0; i < len(layout); i++ {
+			if !strings.HasPrefix(layout[i:], "%{") {
+				continue
+			}
+			fieldEnd := strings.IndexByte(layout[i:], '}')
+			if fieldEnd < 0 {
+				break
+			}
+			// the field is in the form PATTERN:name (optionally followed by :type)
+			parts := strings.Split(layout[i+2:i+fieldEnd], ":")
+			if len(parts) > 1 && slices.Contains(dateFields, parts[1]) {
+				end = i
+				break
+			}
+			i += fieldEnd
+		}
+		depth = max(depth, strings.Count(layout[:end], "/"))
+	}
+	return depth
+}
+
+// offsetDir returns the directory at the listing offset depth of the location which contains the object or
+// directory name - or the location prefix, if it is below that depth - and false if the name is above that depth
+func (s *GcpStorageBucketSource) offsetDir(location BucketLocation, name string) (string, bool) {
+	prefix := location.getPrefix()
+	if !strings.HasPrefix(name, prefix) {
+		return "", false
+	}
+	end := 0
+	for range s.listingOffsetDepths[location.url()] {
+		idx := strings.IndexByte(name[end:], '/')
+		if idx < 0 {
+			return "", false
+		}
+		end += idx + 1
+	}
+	return name[:max(end, len(prefix))], true
+}
+
+// parentDirs returns the directories containing the object which are below the prefix, outermost first,
+// in the form returned when listing the bucket with a "/" delimiter
+// e.g. for the object a/b/c.json and an empty prefix, this returns [a/, a/b/]
+func parentDirs(objectName, prefix string) []string {
+	var dirs []string
+	for i := len(prefix); i < len(objectName); i++ {
+		if objectName[i] == '/' {
+			dirs = append(dirs, objectName[:i+1])
+		}
+	}
+	return dirs
+}
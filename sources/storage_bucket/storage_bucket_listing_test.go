@@ -0,0 +1,220 @@
+package storage_bucket
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLiteralPrefix(t *testing.T) {
+	tests := []struct {
+		pattern      string
+		specialChars string
+		want         string
+	}{
+		{pattern: "logs/%{YEAR:year}/", specialChars: "%", want: "logs/"},
+		{pattern: "logs/2025/*", specialChars: "*?[{\\", want: "logs/2025/"},
+		{pattern: "logs/2025/{6,06}/*", specialChars: "*?[{\\", want: "logs/2025/"},
+		{pattern: "logs/2025/", specialChars: "*?[{\\", want: "logs/2025/"},
+		{pattern: "*", specialChars: "*?[{\\", want: ""},
+	}
+	for _, tt := range tests {
+		if got := literalPrefix(tt.pattern, tt.specialChars); got != tt.want {
+			t.Errorf("literalPrefix(%q) = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestPaddedGlobValue(t *testing.T) {
+	tests := map[int]string{
+		0:  "{0,00}",
+		6:  "{6,06}",
+		10: "10",
+		23: "23",
+	}
+	for value, want := range tests {
+		if got := paddedGlobValue(value); got != want {
+			t.Errorf("paddedGlobValue(%d) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestLayoutToGlob(t *testing.T) {
+	layout := "logs/%{WORD:type}/%{YEAR:year}/%{MONTHNUM:month}/%{MONTHDAY:day}/%{HOUR:hour}/%{DATA:name}.json"
+
+	tests := []struct {
+		name              string
+		layout            string
+		from, to          time.Time
+		want              string
+		wantDatesResolved bool
+		wantOk            bool
+	}{
+		{
+			name:   "no time range",
+			layout: layout,
+			want:   "logs/*/*/*/*/*/**.json",
+			wantOk: true,
+		},
+		{
+			name:              "single year",
+			layout:            layout,
+			from:              time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			to:                time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC),
+			want:              "logs/*/2025/*/*/*/**.json",
+			wantDatesResolved: true,
+			wantOk:            true,
+		},
+		{
+			name:              "single month",
+			layout:            layout,
+			from:              time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC),
+			to:                time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC),
+			want:              "logs/*/2025/{6,06}/*/*/**.json",
+			wantDatesResolved: true,
+			wantOk:            true,
+		},
+		{
+			name:              "single hour",
+			layout:            layout,
+			from:              time.Date(2025, 6, 17, 10, 0, 0, 0, time.UTC),
+			to:                time.Date(2025, 6, 17, 10, 30, 0, 0, time.UTC),
+			want:              "logs/*/2025/{6,06}/17/10/**.json",
+			wantDatesResolved: true,
+			wantOk:            true,
+		},
+		{
+			name:              "time range in another time zone",
+			layout:            layout,
+			from:              time.Date(2025, 7, 1, 1, 0, 0, 0, time.FixedZone("CEST", 2*60*60)),
+			to:                time.Date(2025, 6, 30, 23, 30, 0, 0, time.UTC),
+			want:              "logs/*/2025/{6,06}/30/23/**.json",
+			wantDatesResolved: true,
+			wantOk:            true,
+		},
+		{
+			name:   "spans years",
+			layout: layout,
+			from:   time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC),
+			to:     time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			want:   "logs/*/*/*/*/*/**.json",
+			wantOk: true,
+		},
+		{
+			name:   "unterminated field",
+			layout: "logs/%{YEAR:year",
+		},
+		{
+			name:   "regular expression syntax",
+			layout: "logs/(activity|data_access)/%{YEAR:year}/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, datesResolved, ok := layoutToGlob(tt.layout, tt.from, tt.to)
+			if ok != tt.wantOk {
+				t.Fatalf("layoutToGlob() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if got != tt.want || datesResolved != tt.wantDatesResolved {
+				t.Errorf("layoutToGlob() = %q, %v, want %q, %v", got, datesResolved, tt.want, tt.wantDatesResolved)
+			}
+		})
+	}
+}
+
+func TestGetListings(t *testing.T) {
+	from := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		prefix  string
+		layouts []string
+		want    []bucketListing
+	}{
+		{
+			name:    "glob",
+			layouts: []string{"logs/%{YEAR:year}/%{MONTHNUM:month}/%{DATA}.json"},
+			want:    []bucketListing{{prefix: "logs/2025/", matchGlob: "logs/2025/{6,06}/**.json"}},
+		},
+		{
+			name:    "overlapping listings are merged and walked",
+			layouts: []string{"logs/%{YEAR:year}/%{DATA}.json", "logs/%{YEAR:year}/%{MONTHNUM:month}/%{DATA}.json"},
+			want:    []bucketListing{{prefix: "logs/2025/"}},
+		},
+		{
+			name:    "separate listings",
+			layouts: []string{"activity/%{YEAR:year}/%{DATA}.json", "data_access/%{YEAR:year}/%{DATA}.json"},
+			want: []bucketListing{
+				{prefix: "activity/2025/", matchGlob: "activity/2025/**.json"},
+				{prefix: "data_access/2025/", matchGlob: "data_access/2025/**.json"},
+			},
+		},
+		{
+			name:    "prefix longer than the literal prefix",
+			prefix:  "logs/2025/06/",
+			layouts: []string{"logs/%{YEAR:year}/%{MONTHNUM:month}/%{DATA}.json"},
+			want:    []bucketListing{{prefix: "logs/2025/06/"}},
+		},
+		{
+			name:    "layout outside the prefix",
+			prefix:  "other/",
+			layouts: []string{"logs/%{YEAR:year}/%{DATA}.json"},
+			want:    []bucketListing{{prefix: "other/"}},
+		},
+		{
+			name:    "layout with regular expression syntax",
+			layouts: []string{"logs/(a|b)/%{DATA}.json"},
+			want:    []bucketListing{{prefix: "logs/"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := getListings(tt.prefix, tt.layouts, from, to)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("getListings() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListingOffsetDepth(t *testing.T) {
+	tests := []struct {
+		name    string
+		layouts []string
+		want    int
+	}{
+		{
+			name:    "audit logs",
+			layouts: []string{"cloudaudit.googleapis.com/%{DATA:type}/%{YEAR:year}/%{MONTHNUM:month}/%{MONTHDAY:day}/%{HOUR:hour}:%{MINUTE:minute}:%{SECOND:second}_%{DATA:end_time}_%{DATA:suffix}.json"},
+			want:    2,
+		},
+		{
+			name:    "date in the object name",
+			layouts: []string{"%{DATA:export_name}/%{YEAR:year}-%{MONTHNUM:month}-%{MONTHDAY:day}.csv"},
+			want:    1,
+		},
+		{
+			name:    "no date fields",
+			layouts: []string{"exports/%{DATA:name}.csv"},
+			want:    1,
+		},
+		{
+			name:    "no fields",
+			layouts: []string{"exports/report.csv"},
+			want:    1,
+		},
+		{
+			name:    "deepest layout",
+			layouts: []string{"%{YEAR:year}/%{DATA}.json", "logs/%{YEAR:year}/%{DATA}.json"},
+			want:    1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := listingOffsetDepth(tt.layouts); got != tt.want {
+				t.Errorf("listingOffsetDepth() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
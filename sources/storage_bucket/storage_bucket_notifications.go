@@ -0,0 +1,396 @@
+package storage_bucket
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+	"google.golang.org/api/pubsub/v1"
+
+	"github.com/turbot/pipe-fittings/v2/filter"
+	"github.com/turbot/tailpipe-plugin-gcp/config"
+)
+
+const (
+	// the maximum number of messages to request in a single pull
+	notificationPullMaxMessages = 1000
+	// a pull with no messages available blocks until this timeout, at which point we assume the subscription is drained
+	notificationPullTimeout = 10 * time.Second
+	// the ack deadline set on pulled messages (the maximum Pub/Sub allows), so they are not redelivered while the
+	// collection runs
+	notificationAckDeadline = 10 * time.Minute
+	// how often the ack deadline of the pulled messages is extended
+	notificationAckExtendInterval = notificationAckDeadline / 2
+	// the Cloud Storage notification event type for a newly created (or overwritten) object
+	eventTypeObjectFinalize = "OBJECT_FINALIZE"
+	// the notification payload format which includes the object resource
+	payloadFormatJson = "JSON_API_V1"
+)
+
+// discoverFromNotifications discovers artifacts from the Cloud Storage notifications in the configured Pub/Sub subscription,
+// rather than by listing the bucket.
+//
+// The subscription is pulled until it is drained, or max_notifications messages have been pulled. Objects created
+// in the bucket locations are passed to WalkNode in name order, along with their parent directories, so the layout,
+// filters and collection state are applied exactly as they are when walking the bucket.
+// The pulled messages are leased until the collection completes - their ack deadline is extended while the collection
+// runs, and they are then acknowledged, or released to be redelivered if any artifacts failed to download.
+// Messages delivered more than once are only processed once.
+func (s *GcpStorageBucketSource) discoverFromNotifications(ctx context.Context, locations []BucketLocation, filterMap map[string]*filter.SqlFilter) error {
+	subscription := *s.Config.NotificationSubscription
+
+	svc, err := s.getPubSubService(ctx)
+	if err != nil {
+		return err
+	}
+	s.notifications = newNotificationLease(ctx, svc, subscription)
+
+	// for each location, map of object name to the latest version created
+	objectVersions := make([]map[string]objectVersion, len(locations))
+	for i := range objectVersions {
+		objectVersions[i] = make(map[string]objectVersion)
+	}
+	// the IDs of the messages processed
+	messageIds := make(map[string]struct{})
+	maxMessages := s.Config.GetMaxNotifications()
+	messageCount, duplicateCount, objectCount := 0, 0, 0
+	for messageCount < maxMessages {
+		messages, err := s.pullNotifications(ctx, svc, subscription, min(notificationPullMaxMessages, maxMessages-messageCount))
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			break
+		}
+		messageCount += len(messages)
+
+		ackIds := make([]string, len(messages))
+		for i, msg := range messages {
+			ackIds[i] = msg.AckId
+		}
+		if err := s.notifications.add(ctx, ackIds); err != nil {
+			return err
+		}
+
+		for _, msg := range messages {
+			if msg.Message == nil {
+				continue
+			}
+			// Pub/Sub delivers messages at least once - each delivery has its own ack ID, so all are acknowledged
+			if _, ok := messageIds[msg.Message.MessageId]; ok {
+				duplicateCount++
+				continue
+			}
+			messageIds[msg.Message.MessageId] = struct{}{}
+
+			attributes := msg.Message.Attributes
+			if attributes["eventType"] != eventTypeObjectFinalize {
+				continue
+			}
+			bucket := attributes["bucketId"]
+			objectName := attributes["objectId"]
+			if objectName == "" {
+				continue
+			}
+			idx := locationIndex(locations, bucket, objectName)
+			if idx < 0 {
+				continue
+			}
+			if s.Config.HasObjectFilters() {
+				attrs, err := s.getNotificationObjectAttrs(ctx, msg.Message)
+				if err != nil {
+					return err
+				}
+				if attrs == nil || !s.Config.ObjectSatisfiesFilters(attrs) {
+					continue
+				}
+			}
+
+			// the notification includes the generation of the object which was created
+			generation, _ := strconv.ParseInt(attributes["objectGeneration"], 10, 64)
+			existing, ok := objectVersions[idx][objectName]
+			if !ok {
+				objectCount++
+			}
+			if !ok || generation >= existing.generation {
+				objectVersions[idx][objectName] = objectVersion{bucket: bucket, name: objectName, generation: generation}
+			}
+		}
+	}
+
+	if messageCount >= maxMessages {
+		slog.Info("Pulled the maximum number of Cloud Storage notifications, any more will be pulled by the next collection", "subscription", subscription, "max_notifications", maxMessages)
+	}
+	slog.Info("Discovered objects from Cloud Storage notifications", "subscription", subscription, "messages", messageCount, "duplicates", duplicateCount, "objects", objectCount)
+
+	return s.walkLocationObjects(ctx, locations, objectVersions, filterMap)
+}
+
+// locationIndex returns the index of the location containing the object, or -1 if it is not in any location
+// (locations cannot overlap, so the object is in at most one location)
+func locationIndex(locations []BucketLocation, bucket, objectName string) int {
+	return slices.IndexFunc(locations, func(l BucketLocation) bool {
+		return l.Bucket == bucket && strings.HasPrefix(objectName, l.getPrefix())
+	})
+}
+
+// walkLocationObjects walks the objects discovered in each location, other than by listing the bucket
+// objectVersions holds a map of object name to version for each location
+func (s *GcpStorageBucketSource) walkLocationObjects(ctx context.Context, locations []BucketLocation, objectVersions []map[string]objectVersion, filterMap map[string]*filter.SqlFilter) error {
+	for i, location := range locations {
+		if len(objectVersions[i]) == 0 {
+			continue
+		}
+
+		// the objects are not ordered - sort them so they are discovered in (layout) time order
+		versions := make([]objectVersion, 0, len(objectVersions[i]))
+		for _, version := range objectVersions[i] {
+			versions = append(versions, version)
+		}
+		slices.SortFunc(versions, func(a, b objectVersion) int {
+			return strings.Compare(a.name, b.name)
+		})
+
+		g, err := s.newGrok()
+		if err != nil {
+			return err
+		}
+		s.registerBucket(location.Bucket)
+		if err := s.walkObjects(ctx, versions, location.getPrefix(), s.getLayouts(location), filterMap, g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notificationObject is the object resource in the payload of a notification with the JSON_API_V1 payload format
+// (only the fields used by the object filters are included)
+type notificationObject struct {
+	ContentType  string            `json:"contentType"`
+	Size         int64             `json:"size,string"`
+	StorageClass string            `json:"storageClass"`
+	Metadata     map[string]string `json:"metadata"`
+	TimeCreated  time.Time         `json:"timeCreated"`
+	Updated      time.Time         `json:"updated"`
+}
+
+// getNotificationObjectAttrs returns the attributes of the object the notification is for, used to apply the
+// object filters - these are read from the notification payload, or if the notification has no payload,
+// from the object itself (nil is returned if the object no longer exists)
+func (s *GcpStorageBucketSource) getNotificationObjectAttrs(ctx context.Context, msg *pubsub.PubsubMessage) (*storage.ObjectAttrs, error) {
+	bucket := msg.Attributes["bucketId"]
+	objectName := msg.Attributes["objectId"]
+
+	if msg.Attributes["payloadFormat"] == payloadFormatJson && msg.Data != "" {
+		data, err := base64.StdEncoding.DecodeString(msg.Data)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding notification payload for object %s, %w", objectURL(bucket, objectName), err)
+		}
+		var object notificationObject
+		if err := json.Unmarshal(data, &object); err != nil {
+			return nil, fmt.Errorf("error parsing notification payload for object %s, %w", objectURL(bucket, objectName), err)
+		}
+		return &storage.ObjectAttrs{
+			Name:         objectName,
+			ContentType:  object.ContentType,
+			Size:         object.Size,
+			StorageClass: object.StorageClass,
+			Metadata:     object.Metadata,
+			Created:      object.TimeCreated,
+			Updated:      object.Updated,
+		}, nil
+	}
+
+	attrs, err := s.bucket(bucket).Object(objectName).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, nil
+	}
+	if rpErr := s.requesterPaysError(bucket, err); rpErr != nil {
+		return nil, rpErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting attributes of object %s, %w", objectURL(bucket, objectName), err)
+	}
+	return attrs, nil
+}
+
+// pullNotifications pulls the next batch of at most maxMessages messages from the subscription
+// an empty result means the subscription has been drained
+func (s *GcpStorageBucketSource) pullNotifications(ctx context.Context, svc *pubsub.Service, subscription string, maxMessages int) ([]*pubsub.ReceivedMessage, error) {
+	pullCtx, cancel := context.WithTimeout(ctx, notificationPullTimeout)
+	defer cancel()
+
+	resp, err := svc.Projects.Subscriptions.Pull(subscription, &pubsub.PullRequest{
+		MaxMessages: int64(maxMessages),
+	}).Context(pullCtx).Do()
+	if err != nil {
+		// if the pull timed out (rather than the collection being cancelled) there are no messages available
+		if pullCtx.Err() != nil && ctx.Err() == nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error pulling notifications from subscription %s, %w", subscription, err)
+	}
+	return resp.ReceivedMessages, nil
+}
+
+// acknowledgeNotifications acknowledges the messages pulled by discoverFromNotifications
+func (s *GcpStorageBucketSource) acknowledgeNotifications(ctx context.Context) error {
+	if s.notifications == nil {
+		return nil
+	}
+	lease := s.notifications
+	s.notifications = nil
+
+	ackIds := lease.stop()
+	for chunk := range slices.Chunk(ackIds, notificationPullMaxMessages) {
+		_, err := lease.svc.Projects.Subscriptions.Acknowledge(lease.subscription, &pubsub.AcknowledgeRequest{AckIds: chunk}).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("error acknowledging notifications for subscription %s, %w", lease.subscription, err)
+		}
+	}
+
+	slog.Info("Acknowledged Cloud Storage notifications", "subscription", lease.subscription, "messages", len(ackIds))
+	return nil
+}
+
+// releaseNotifications releases any messages pulled by discoverFromNotifications which have not been acknowledged,
+// by setting their ack deadline to zero, so Pub/Sub redelivers them
+func (s *GcpStorageBucketSource) releaseNotifications(ctx context.Context) {
+	if s.notifications == nil {
+		return
+	}
+	lease := s.notifications
+	s.notifications = nil
+
+	ackIds := lease.stop()
+	if err := lease.modifyAckDeadline(ctx, ackIds, 0); err != nil {
+		// the messages are redelivered once their ack deadline expires
+		slog.Warn("Failed to release Cloud Storage notifications", "subscription", lease.subscription, "messages", len(ackIds), "error", err)
+		return
+	}
+	slog.Info("Released Cloud Storage notifications", "subscription", lease.subscription, "messages", len(ackIds))
+}
+
+// notificationLease holds the ack IDs of the messages pulled from a subscription, extending their ack deadline
+// until they are acknowledged or released
+type notificationLease struct {
+	svc          *pubsub.Service
+	subscription string
+
+	ackIds []string
+	mut    sync.Mutex
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newNotificationLease(ctx context.Context, svc *pubsub.Service, subscription string) *notificationLease {
+	ctx, cancel := context.WithCancel(ctx)
+	l := &notificationLease{
+		svc:          svc,
+		subscription: subscription,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+	}
+	go l.extend(ctx)
+	return l
+}
+
+// add leases the ack IDs - their ack deadline is extended immediately, as the subscription ack deadline
+// may be as short as 10 seconds
+func (l *notificationLease) add(ctx context.Context, ackIds []string) error {
+	l.mut.Lock()
+	l.ackIds = append(l.ackIds, ackIds...)
+	l.mut.Unlock()
+
+	return l.modifyAckDeadline(ctx, ackIds, notificationAckDeadline)
+}
+
+// extend extends the ack deadline of the leased ack IDs until the lease is stopped
+func (l *notificationLease) extend(ctx context.Context) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(notificationAckExtendInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.mut.Lock()
+			ackIds := slices.Clone(l.ackIds)
+			l.mut.Unlock()
+
+			if err := l.modifyAckDeadline(ctx, ackIds, notificationAckDeadline); err != nil && ctx.Err() == nil {
+				slog.Warn("Failed to extend the ack deadline of Cloud Storage notifications", "subscription", l.subscription, "messages", len(ackIds), "error", err)
+			}
+		}
+	}
+}
+
+// stop stops extending the ack deadline of the leased ack IDs, and returns them
+func (l *notificationLease) stop() []string {
+	l.cancel()
+	<-l.done
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return l.ackIds
+}
+
+// modifyAckDeadline sets the ack deadline of the ack IDs - a deadline of zero releases the messages for redelivery
+func (l *notificationLease) modifyAckDeadline(ctx context.Context, ackIds []string, deadline time.Duration) error {
+	for chunk := range slices.Chunk(ackIds, notificationPullMaxMessages) {
+		_, err := l.svc.Projects.Subscriptions.ModifyAckDeadline(l.subscription, &pubsub.ModifyAckDeadlineRequest{
+			AckIds:             chunk,
+			AckDeadlineSeconds: int64(deadline.Seconds()),
+		}).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("error modifying the ack deadline of notifications for subscription %s, %w", l.subscription, err)
+		}
+	}
+	return nil
+}
+
+// getPubSubService returns the Pub/Sub service of the connection, which is shared by all sources using the connection
+func (s *GcpStorageBucketSource) getPubSubService(ctx context.Context) (*pubsub.Service, error) {
+	emulatorHost := os.Getenv("PUBSUB_EMULATOR_HOST")
+	key := string(config.PubSubAPI)
+	if emulatorHost != "" {
+		key += "/emulator=" + emulatorHost
+	}
+
+	return config.GetClient(ctx, s.Connection, key, func(ctx context.Context) (*pubsub.Service, error) {
+		var opts []option.ClientOption
+		// if the PUBSUB_EMULATOR_HOST env var is set, connect to the emulator without authentication
+		if emulatorHost != "" {
+			opts = []option.ClientOption{
+				option.WithEndpoint(fmt.Sprintf("http://%s/", emulatorHost)),
+				option.WithoutAuthentication(),
+			}
+		} else {
+			var err error
+			opts, err = s.Connection.GetClientOptions(ctx, config.PubSubAPI)
+			if err != nil {
+				return nil, fmt.Errorf("failed setting GCP Pub/Sub client config: %s", err.Error())
+			}
+		}
+
+		svc, err := pubsub.NewService(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCP Pub/Sub client: %s", err.Error())
+		}
+		return svc, nil
+	})
+}
@@ -0,0 +1,212 @@
+package storage_bucket_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/turbot/tailpipe-plugin-gcp/tables/audit_log"
+)
+
+// fakeNotification is a message in the subscription of fakePubSubServer
+type fakeNotification struct {
+	messageId  string
+	attributes map[string]string
+}
+
+// fakePubSubServer is an in-process Pub/Sub stand-in, implementing the subscription pull, modifyAckDeadline and
+// acknowledge requests made by the source - the messages are delivered in order, the nth with the ack ID ack-<n>
+type fakePubSubServer struct {
+	*httptest.Server
+
+	mut      sync.Mutex
+	messages []fakeNotification
+	pulled   int
+	// map of ack ID to the last ack deadline set, in seconds
+	ackDeadlines map[string]int64
+	acked        []string
+}
+
+func newFakePubSubServer(t *testing.T, messages []fakeNotification) *fakePubSubServer {
+	f := &fakePubSubServer{messages: messages, ackDeadlines: make(map[string]int64)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakePubSubServer) host() string {
+	return strings.TrimPrefix(f.URL, "http://")
+}
+
+func (f *fakePubSubServer) serve(w http.ResponseWriter, r *http.Request) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	var req struct {
+		MaxMessages        int      `json:"maxMessages"`
+		AckIds             []string `json:"ackIds"`
+		AckDeadlineSeconds int64    `json:"ackDeadlineSeconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case strings.HasSuffix(r.URL.Path, ":pull"):
+		type message struct {
+			MessageId  string            `json:"messageId"`
+			Attributes map[string]string `json:"attributes"`
+		}
+		type receivedMessage struct {
+			AckId   string  `json:"ackId"`
+			Message message `json:"message"`
+		}
+		resp := struct {
+			ReceivedMessages []receivedMessage `json:"receivedMessages"`
+		}{}
+		for len(resp.ReceivedMessages) < req.MaxMessages && f.pulled < len(f.messages) {
+			msg := f.messages[f.pulled]
+			f.pulled++
+			resp.ReceivedMessages = append(resp.ReceivedMessages, receivedMessage{
+				AckId:   fmt.Sprintf("ack-%d", f.pulled),
+				Message: message{MessageId: msg.messageId, Attributes: msg.attributes},
+			})
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	case strings.HasSuffix(r.URL.Path, ":modifyAckDeadline"):
+		for _, ackId := range req.AckIds {
+			f.ackDeadlines[ackId] = req.AckDeadlineSeconds
+		}
+		_, _ = w.Write([]byte("{}"))
+	case strings.HasSuffix(r.URL.Path, ":acknowledge"):
+		f.acked = append(f.acked, req.AckIds...)
+		_, _ = w.Write([]byte("{}"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// finalizeNotification returns an OBJECT_FINALIZE notification for the object
+func finalizeNotification(messageId, bucket, objectName string) fakeNotification {
+	return fakeNotification{
+		messageId: messageId,
+		attributes: map[string]string{
+			"eventType":        "OBJECT_FINALIZE",
+			"bucketId":         bucket,
+			"objectId":         objectName,
+			"objectGeneration": "1",
+		},
+	}
+}
+
+func TestCollectFromNotifications(t *testing.T) {
+	activity := `{"logName":"projects/p/logs/cloudaudit.googleapis.com%2Factivity","insertId":"1"}
+`
+	first := "cloudaudit.googleapis.com/activity/2025/06/07/00:00:00_00:59:59_S0.json"
+	second := "cloudaudit.googleapis.com/activity/2025/06/07/01:00:00_01:59:59_S0.json"
+	missing := "cloudaudit.googleapis.com/activity/2025/06/07/02:00:00_02:59:59_S0.json"
+	gcs := newFakeGcsServer(t, map[string][]fakeObject{
+		"audit-logs": {
+			{name: first, content: []byte(activity), generation: 1},
+			{name: second, content: []byte(activity), generation: 1},
+		},
+	})
+
+	metadata, err := (&audit_log.AuditLogTable{}).GetSourceMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := getSourceOptions(t, metadata)
+	from := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC)
+	connectionConfig := "without_authentication = true\n"
+	sourceConfig := func(extra string) string {
+		return fmt.Sprintf("bucket = \"audit-logs\"\nendpoint = %q\nnotification_subscription = \"projects/p/subscriptions/s\"\n%s", gcs.endpoint(), extra)
+	}
+
+	t.Run("acknowledged", func(t *testing.T) {
+		pubsub := newFakePubSubServer(t, []fakeNotification{
+			finalizeNotification("1", "audit-logs", first),
+			// a redelivery of the first message
+			finalizeNotification("1", "audit-logs", first),
+			{messageId: "2", attributes: map[string]string{"eventType": "OBJECT_DELETE", "bucketId": "audit-logs", "objectId": second}},
+			finalizeNotification("3", "audit-logs", second),
+		})
+		t.Setenv("PUBSUB_EMULATOR_HOST", pubsub.host())
+
+		rows := collect(t, sourceConfig(""), connectionConfig, from, to, opts)
+		assertRows(t, rows, map[string][]string{
+			"gs://audit-logs/" + first:  strings.Split(strings.TrimSpace(activity), "\n"),
+			"gs://audit-logs/" + second: strings.Split(strings.TrimSpace(activity), "\n"),
+		})
+
+		pubsub.mut.Lock()
+		defer pubsub.mut.Unlock()
+		// every delivery is leased for the collection, then acknowledged
+		wantAckIds := []string{"ack-1", "ack-2", "ack-3", "ack-4"}
+		for _, ackId := range wantAckIds {
+			if got := pubsub.ackDeadlines[ackId]; got != 600 {
+				t.Errorf("ack deadline of %s = %d, want 600", ackId, got)
+			}
+		}
+		slices.Sort(pubsub.acked)
+		if !slices.Equal(pubsub.acked, wantAckIds) {
+			t.Errorf("acknowledged %v, want %v", pubsub.acked, wantAckIds)
+		}
+	})
+
+	t.Run("max notifications", func(t *testing.T) {
+		pubsub := newFakePubSubServer(t, []fakeNotification{
+			finalizeNotification("1", "audit-logs", first),
+			finalizeNotification("2", "audit-logs", second),
+		})
+		t.Setenv("PUBSUB_EMULATOR_HOST", pubsub.host())
+
+		rows := collect(t, sourceConfig("max_notifications = 1\n"), connectionConfig, from, to, opts)
+		assertRows(t, rows, map[string][]string{
+			"gs://audit-logs/" + first: strings.Split(strings.TrimSpace(activity), "\n"),
+		})
+
+		pubsub.mut.Lock()
+		defer pubsub.mut.Unlock()
+		if pubsub.pulled != 1 {
+			t.Errorf("pulled %d messages, want 1", pubsub.pulled)
+		}
+		if !slices.Equal(pubsub.acked, []string{"ack-1"}) {
+			t.Errorf("acknowledged %v, want [ack-1]", pubsub.acked)
+		}
+	})
+
+	t.Run("released on download failure", func(t *testing.T) {
+		pubsub := newFakePubSubServer(t, []fakeNotification{
+			finalizeNotification("1", "audit-logs", first),
+			finalizeNotification("2", "audit-logs", missing),
+		})
+		t.Setenv("PUBSUB_EMULATOR_HOST", pubsub.host())
+
+		collector := collectWithErrors(t, sourceConfig(""), connectionConfig, from, to, opts)
+		if len(collector.waitForErrors(5*time.Second)) == 0 {
+			t.Errorf("expected an error downloading %s", missing)
+		}
+
+		pubsub.mut.Lock()
+		defer pubsub.mut.Unlock()
+		// the messages are not acknowledged, and are released for redelivery
+		if len(pubsub.acked) != 0 {
+			t.Errorf("acknowledged %v, want none", pubsub.acked)
+		}
+		for _, ackId := range []string{"ack-1", "ack-2"} {
+			if got, ok := pubsub.ackDeadlines[ackId]; !ok || got != 0 {
+				t.Errorf("ack deadline of %s = %d (set %v), want 0", ackId, got, ok)
+			}
+		}
+	})
+}
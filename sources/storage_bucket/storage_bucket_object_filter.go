@@ -0,0 +1,137 @@
+package storage_bucket
+
+import (
+	"fmt"
+	"mime"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/hashicorp/hcl/v2"
+)
+
+// the storage classes an object may have
+var storageClasses = []string{"STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE", "MULTI_REGIONAL", "REGIONAL", "DURABLE_REDUCED_AVAILABILITY"}
+
+// objectFilterAttrs are the object attributes required to apply the object filters
+var objectFilterAttrs = []string{"ContentType", "Size", "StorageClass", "Metadata", "Created", "Updated"}
+
+// ObjectFilters restricts the objects collected by their attributes, as well as their path
+// it is embedded in [GcpStorageBucketSourceConfig], so the filters are top level attributes of the source
+type ObjectFilters struct {
+	// required to allow partial decoding
+	Remain hcl.Body `hcl:",remain" json:"-"`
+
+	// only collect objects with one of these content types (parameters such as charset are ignored)
+	ContentTypes []string `hcl:"content_types,optional"`
+	// only collect objects of at least/at most this size, in bytes
+	MinSize *int64 `hcl:"min_size,optional"`
+	MaxSize *int64 `hcl:"max_size,optional"`
+	// only collect objects with one of these storage classes
+	StorageClasses []string `hcl:"storage_classes,optional"`
+	// only collect objects with all of these custom metadata keys and values - a value of "*" matches any value
+	Metadata map[string]string `hcl:"metadata,optional"`
+	// only collect objects created or updated within these times (RFC 3339)
+	CreatedAfter  *string `hcl:"created_after,optional"`
+	CreatedBefore *string `hcl:"created_before,optional"`
+	UpdatedAfter  *string `hcl:"updated_after,optional"`
+	UpdatedBefore *string `hcl:"updated_before,optional"`
+}
+
+func (f *ObjectFilters) validateObjectFilters() error {
+	if f.MinSize != nil && *f.MinSize < 0 {
+		return fmt.Errorf("min_size must be at least 0")
+	}
+	if f.MaxSize != nil && *f.MaxSize < 0 {
+		return fmt.Errorf("max_size must be at least 0")
+	}
+	if f.MinSize != nil && f.MaxSize != nil && *f.MinSize > *f.MaxSize {
+		return fmt.Errorf("min_size must not be greater than max_size")
+	}
+
+	for _, storageClass := range f.StorageClasses {
+		if !slices.Contains(storageClasses, strings.ToUpper(storageClass)) {
+			return fmt.Errorf("invalid storage class %s, valid storage classes are: %s", storageClass, strings.Join(storageClasses, ", "))
+		}
+	}
+
+	for name, value := range map[string]*string{
+		"created_after":  f.CreatedAfter,
+		"created_before": f.CreatedBefore,
+		"updated_after":  f.UpdatedAfter,
+		"updated_before": f.UpdatedBefore,
+	} {
+		if value == nil {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, *value); err != nil {
+			return fmt.Errorf("invalid %s %s, expected an RFC 3339 time, e.g. 2025-01-01T00:00:00Z", name, *value)
+		}
+	}
+
+	return nil
+}
+
+// HasObjectFilters returns whether any object filters are set
+func (f *ObjectFilters) HasObjectFilters() bool {
+	return !(len(f.ContentTypes) == 0 && f.MinSize == nil && f.MaxSize == nil && len(f.StorageClasses) == 0 &&
+		len(f.Metadata) == 0 && f.CreatedAfter == nil && f.CreatedBefore == nil && f.UpdatedAfter == nil && f.UpdatedBefore == nil)
+}
+
+// ObjectSatisfiesFilters returns whether the object satisfies all the object filters
+func (f *ObjectFilters) ObjectSatisfiesFilters(attrs *storage.ObjectAttrs) bool {
+	if len(f.ContentTypes) > 0 && !slices.ContainsFunc(f.ContentTypes, func(contentType string) bool {
+		return strings.EqualFold(mediaType(contentType), mediaType(attrs.ContentType))
+	}) {
+		return false
+	}
+
+	if f.MinSize != nil && attrs.Size < *f.MinSize {
+		return false
+	}
+	if f.MaxSize != nil && attrs.Size > *f.MaxSize {
+		return false
+	}
+
+	if len(f.StorageClasses) > 0 && !slices.ContainsFunc(f.StorageClasses, func(storageClass string) bool {
+		return strings.EqualFold(storageClass, attrs.StorageClass)
+	}) {
+		return false
+	}
+
+	for key, want := range f.Metadata {
+		got, ok := attrs.Metadata[key]
+		if !ok || (want != "*" && got != want) {
+			return false
+		}
+	}
+
+	return timeWithin(attrs.Created, f.CreatedAfter, f.CreatedBefore) && timeWithin(attrs.Updated, f.UpdatedAfter, f.UpdatedBefore)
+}
+
+// mediaType returns the content type without any parameters, e.g. application/json; charset=utf-8 -> application/json
+func mediaType(contentType string) string {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mt
+	}
+	return strings.TrimSpace(contentType)
+}
+
+// timeWithin returns whether the time is on or after the after time (if set), and before the before time (if set)
+// the times have already been validated
+func timeWithin(t time.Time, after, before *string) bool {
+	if after != nil {
+		afterTime, _ := time.Parse(time.RFC3339, *after)
+		if t.Before(afterTime) {
+			return false
+		}
+	}
+	if before != nil {
+		beforeTime, _ := time.Parse(time.RFC3339, *before)
+		if !t.Before(beforeTime) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+package storage_bucket
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestObjectSatisfiesFilters(t *testing.T) {
+	created := time.Date(2025, 6, 7, 0, 0, 0, 0, time.UTC)
+	attrs := &storage.ObjectAttrs{
+		ContentType:  "application/json; charset=utf-8",
+		Size:         1024,
+		StorageClass: "NEARLINE",
+		Metadata:     map[string]string{"env": "prod", "team": "security"},
+		Created:      created,
+		Updated:      created.Add(time.Hour),
+	}
+	ptr := func(v int64) *int64 { return &v }
+	str := func(v string) *string { return &v }
+
+	tests := []struct {
+		name    string
+		filters ObjectFilters
+		want    bool
+	}{
+		{name: "no filters", want: true},
+		{name: "content type ignoring parameters", filters: ObjectFilters{ContentTypes: []string{"text/plain", "APPLICATION/JSON"}}, want: true},
+		{name: "other content type", filters: ObjectFilters{ContentTypes: []string{"text/plain"}}},
+		{name: "size within range", filters: ObjectFilters{MinSize: ptr(1024), MaxSize: ptr(1024)}, want: true},
+		{name: "smaller than min size", filters: ObjectFilters{MinSize: ptr(1025)}},
+		{name: "larger than max size", filters: ObjectFilters{MaxSize: ptr(1023)}},
+		{name: "storage class ignoring case", filters: ObjectFilters{StorageClasses: []string{"nearline"}}, want: true},
+		{name: "other storage class", filters: ObjectFilters{StorageClasses: []string{"STANDARD", "ARCHIVE"}}},
+		{name: "metadata", filters: ObjectFilters{Metadata: map[string]string{"env": "prod", "team": "*"}}, want: true},
+		{name: "metadata with another value", filters: ObjectFilters{Metadata: map[string]string{"env": "dev"}}},
+		{name: "metadata key missing", filters: ObjectFilters{Metadata: map[string]string{"owner": "*"}}},
+		{name: "created on the after time", filters: ObjectFilters{CreatedAfter: str("2025-06-07T00:00:00Z")}, want: true},
+		{name: "created before the after time", filters: ObjectFilters{CreatedAfter: str("2025-06-07T00:00:01Z")}},
+		{name: "created on the before time", filters: ObjectFilters{CreatedBefore: str("2025-06-07T00:00:00Z")}},
+		{name: "updated on the before time in another time zone", filters: ObjectFilters{UpdatedBefore: str("2025-06-07T02:00:00+01:00")}},
+		{name: "updated within the time range in another time zone", filters: ObjectFilters{UpdatedAfter: str("2025-06-07T00:00:00Z"), UpdatedBefore: str("2025-06-07T03:00:00+01:00")}, want: true},
+		{
+			name: "all filters satisfied but one",
+			filters: ObjectFilters{
+				ContentTypes:   []string{"application/json"},
+				MinSize:        ptr(1),
+				StorageClasses: []string{"NEARLINE"},
+				Metadata:       map[string]string{"env": "prod"},
+				UpdatedBefore:  str("2025-06-07T00:30:00Z"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.filters.validateObjectFilters(); err != nil {
+				t.Fatalf("validateObjectFilters() error = %v", err)
+			}
+			if got := tt.filters.ObjectSatisfiesFilters(attrs); got != tt.want {
+				t.Errorf("ObjectSatisfiesFilters() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasObjectFilters(t *testing.T) {
+	if (&ObjectFilters{}).HasObjectFilters() {
+		t.Errorf("HasObjectFilters() = true with no filters, want false")
+	}
+	size := int64(0)
+	if !(&ObjectFilters{MinSize: &size}).HasObjectFilters() {
+		t.Errorf("HasObjectFilters() = false with min_size set, want true")
+	}
+}
@@ -0,0 +1,81 @@
+package storage_bucket
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// getUserProject returns the project billed for requests to requester-pays buckets - the user_project if set,
+// otherwise the connection project (an empty user_project means no user project is sent)
+func (s *GcpStorageBucketSource) getUserProject() string {
+	if s.Config.UserProject != nil {
+		return *s.Config.UserProject
+	}
+	return s.Connection.GetProject()
+}
+
+// bucket returns the handle for the bucket - all list and read requests are made using this,
+// so they are billed to the user project if the bucket is requester pays
+func (s *GcpStorageBucketSource) bucket(name string) *storage.BucketHandle {
+	bkt := s.client.Bucket(name)
+	if s.userProject != "" {
+		bkt = bkt.UserProject(s.userProject)
+	}
+	return bkt
+}
+
+// requesterPaysError returns an error explaining the user_project argument if the request to the bucket failed
+// because the bucket is requester pays, and no user project was sent or the user project cannot be billed
+// nil is returned for any other error
+func (s *GcpStorageBucketSource) requesterPaysError(bucket string, err error) error {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return nil
+	}
+
+	reasons := errorReasons(apiErr)
+	switch {
+	case apiErr.Code == http.StatusBadRequest && (slices.Contains(reasons, "userprojectmissing") || (s.userProject == "" && slices.Contains(reasons, "required"))):
+		return fmt.Errorf("bucket %s is a requester pays bucket - set user_project (or the connection project) to the project to bill for reading it, %w", bucket, err)
+	case s.userProject != "" && userProjectCannotBeBilled(apiErr, reasons):
+		return fmt.Errorf("requests to bucket %s cannot be billed to user_project %s - check the project exists and the credentials have the serviceusage.services.use permission for it, %w", bucket, s.userProject, err)
+	}
+	return nil
+}
+
+// userProjectCannotBeBilled returns whether the request failed because the user project is invalid, or the
+// caller cannot bill it - a caller without the serviceusage.services.use permission on the user project gets a
+// forbidden error which can only be told apart from other forbidden errors by its message
+func userProjectCannotBeBilled(apiErr *googleapi.Error, reasons []string) bool {
+	switch apiErr.Code {
+	case http.StatusBadRequest:
+		return slices.Contains(reasons, "userprojectinvalid")
+	case http.StatusForbidden:
+		return slices.Contains(reasons, "userprojectaccessdenied") || slices.Contains(reasons, "userprojectaccountproblem") ||
+			strings.Contains(apiErr.Message, "serviceusage.services.use")
+	}
+	return false
+}
+
+// the error code of an XML API error response, e.g. <Code>UserProjectMissing</Code>
+var xmlErrorCodeRegex = regexp.MustCompile(`<Code>([^<]+)</Code>`)
+
+// errorReasons returns the lower case reasons of the error - the reasons of a JSON API error, or the code of an XML
+// API error, which objects are read with
+func errorReasons(apiErr *googleapi.Error) []string {
+	var reasons []string
+	for _, item := range apiErr.Errors {
+		reasons = append(reasons, strings.ToLower(item.Reason))
+	}
+	if match := xmlErrorCodeRegex.FindStringSubmatch(apiErr.Body); match != nil {
+		reasons = append(reasons, strings.ToLower(match[1]))
+	}
+	return reasons
+}
@@ -0,0 +1,74 @@
+package storage_bucket
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestRequesterPaysError(t *testing.T) {
+	tests := []struct {
+		name        string
+		userProject string
+		err         error
+		want        string
+	}{
+		{
+			name: "json user project required",
+			err:  &googleapi.Error{Code: 400, Errors: []googleapi.ErrorItem{{Reason: "required"}}},
+			want: "bucket my-logs is a requester pays bucket",
+		},
+		{
+			name: "xml user project missing",
+			err:  &googleapi.Error{Code: 400, Body: `<?xml version='1.0' encoding='UTF-8'?><Error><Code>UserProjectMissing</Code></Error>`},
+			want: "bucket my-logs is a requester pays bucket",
+		},
+		{
+			name:        "other required parameter",
+			userProject: "billing-project",
+			err:         &googleapi.Error{Code: 400, Errors: []googleapi.ErrorItem{{Reason: "required"}}},
+		},
+		{
+			name:        "user project access denied",
+			userProject: "billing-project",
+			err:         &googleapi.Error{Code: 403, Body: `<Error><Code>UserProjectAccessDenied</Code></Error>`},
+			want:        "cannot be billed to user_project billing-project",
+		},
+		{
+			name:        "no serviceusage permission",
+			userProject: "billing-project",
+			err: &googleapi.Error{
+				Code:    403,
+				Message: "reader@my-project.iam.gserviceaccount.com does not have serviceusage.services.use access to the Google Cloud project.",
+				Errors:  []googleapi.ErrorItem{{Reason: "forbidden"}},
+			},
+			want: "cannot be billed to user_project billing-project",
+		},
+		{
+			name:        "no object permission",
+			userProject: "billing-project",
+			err:         &googleapi.Error{Code: 403, Message: "reader does not have storage.objects.get access", Errors: []googleapi.ErrorItem{{Reason: "forbidden"}}},
+		},
+		{
+			name: "not an api error",
+			err:  errors.New("requester pays"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &GcpStorageBucketSource{userProject: tt.userProject}
+			got := s.requesterPaysError("my-logs", tt.err)
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("requesterPaysError() = %v, want nil", got)
+				}
+				return
+			}
+			if got == nil || !strings.Contains(got.Error(), tt.want) || !errors.Is(got, tt.err) {
+				t.Errorf("requesterPaysError() = %v, want an error wrapping the request error containing %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,20 +4,27 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"io/fs"
 	"log/slog"
+	"maps"
 	"os"
 	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"cloud.google.com/go/storage"
 	"github.com/elastic/go-grok"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 
 	typehelpers "github.com/turbot/go-kit/types"
 	"github.com/turbot/pipe-fittings/v2/filter"
 	"github.com/turbot/tailpipe-plugin-gcp/config"
 	"github.com/turbot/tailpipe-plugin-sdk/artifact_source"
+	"github.com/turbot/tailpipe-plugin-sdk/context_values"
+	"github.com/turbot/tailpipe-plugin-sdk/rate_limiter"
 	"github.com/turbot/tailpipe-plugin-sdk/row_source"
 	"github.com/turbot/tailpipe-plugin-sdk/types"
 )
@@ -28,11 +35,42 @@ const GcpStorageBucketSourceIdentifier = "gcp_storage_bucket"
 type GcpStorageBucketSource struct {
 	artifact_source.ArtifactSourceImpl[*GcpStorageBucketSourceConfig, *config.GcpConnection]
 
-	client    *storage.Client
-	errorList []error
+	client *storage.Client
+	// the project billed for requests to requester-pays buckets
+	userProject string
+	// locations are discovered concurrently, so errors are added under a mutex
+	errorList    []error
+	errorListMut sync.Mutex
+
+	// the notifications pulled during discovery, acknowledged when the collection completes
+	notifications *notificationLease
+	// the number of artifacts which failed to download
+	downloadErrorCount int32
+
+	// if incremental listing is enabled, map of directory at the listing offset depth (in the form gs://bucket/prefix)
+	// to the name of the last object downloaded from it in this collection
+	lastObjectNames   map[string]string
+	lastObjectNameMut sync.Mutex
+	// map of bucket location (in the form gs://bucket/prefix) to the listing offset depth of its layouts
+	listingOffsetDepths map[string]int
+
+	// limits the number of concurrent object reads
+	downloadLimiter *rate_limiter.APILimiter
+
+	// if true, objects are streamed to the row pipeline rather than downloaded to temp files
+	streaming bool
+	// map of artifact local name to the objectStream to load it from
+	streams sync.Map
+	// map of artifact path to the objectVersion it was discovered from
+	objectVersions sync.Map
+	// the identity objects are read as, recorded in the provenance of each row
+	identity string
 }
 
 func (s *GcpStorageBucketSource) Init(ctx context.Context, params *row_source.RowSourceParams, opts ...row_source.RowSourceOption) error {
+	// set the collection state ctor
+	s.NewCollectionStateFunc = NewStorageBucketCollectionState
+
 	// call base to parse config and apply options
 	if err := s.ArtifactSourceImpl.Init(ctx, params, opts...); err != nil {
 		return err
@@ -43,10 +81,47 @@ func (s *GcpStorageBucketSource) Init(ctx context.Context, params *row_source.Ro
 		return err
 	}
 	s.client = client
+	s.userProject = s.getUserProject()
+
+	// artifacts were identified by object name when the source collected from a single bucket -
+	// migrate any collection state saved then, so objects already collected are not collected again
+	if s.Config.Bucket != "" {
+		if state, ok := s.CollectionState.State.(*StorageBucketCollectionState); ok {
+			state.MigrateObjectPaths(s.Config.Bucket)
+		}
+	}
+
+	if err := s.checkPermissions(ctx); err != nil {
+		return err
+	}
 
 	s.errorList = []error{}
+	s.lastObjectNames = make(map[string]string)
+	s.listingOffsetDepths = make(map[string]int)
+	for _, location := range s.Config.GetLocations() {
+		s.listingOffsetDepths[location.url()] = listingOffsetDepth(s.getLayouts(location))
+	}
 
-	slog.Info("Initialized GcpStorageBucketSource", "bucket", s.Config.Bucket, "layout", s.Config.FileLayout)
+	s.downloadLimiter = rate_limiter.NewAPILimiter(&rate_limiter.Definition{
+		Name:           "gcp_storage_object_download",
+		MaxConcurrency: int64(s.Config.GetMaxConcurrentDownloads()),
+	})
+
+	// objects can only be streamed if the table reads them a line at a time, using the default loaders
+	if s.Config.GetStreaming() {
+		if s.RowPerLine && s.Loader == nil {
+			s.streaming = true
+			s.Loader = &objectStreamLoader{source: s}
+		} else {
+			slog.Warn("GcpStorageBucketSource streaming is not supported for this table, objects will be downloaded to temp files")
+		}
+	}
+	// otherwise downloaded objects are loaded with the SDK loader for their extension, as they are by default
+	if s.Loader == nil {
+		s.Loader = &downloadedObjectLoader{rowPerLine: s.RowPerLine}
+	}
+
+	slog.Info("Initialized GcpStorageBucketSource", "locations", len(s.Config.GetLocations()), "layout", s.Config.FileLayout, "max_concurrent_downloads", s.Config.GetMaxConcurrentDownloads(), "streaming", s.streaming, "user_project", s.userProject)
 	return nil
 }
 
@@ -55,27 +130,134 @@ func (s *GcpStorageBucketSource) Identifier() string {
 }
 
 func (s *GcpStorageBucketSource) Close() error {
-	_ = os.RemoveAll(s.TempDir)
-	return s.client.Close()
+	// the client is shared by all sources using the connection, so is closed when the plugin shuts down
+	return os.RemoveAll(s.TempDir)
 }
 
-func (s *GcpStorageBucketSource) DiscoverArtifacts(ctx context.Context) error {
-	var prefix string
-	layout := typehelpers.SafeString(s.Config.GetFileLayout())
-	// if there are any optional segments, we expand them into all possible alternatives
-	optionalLayouts := artifact_source.ExpandPatternIntoOptionalAlternatives(layout)
+// Collect discovers and collects the artifacts - once all artifacts have been downloaded successfully,
+// any notifications the artifacts were discovered from are acknowledged, and if incremental listing is enabled,
+// the last object collected from each directory is stored in the collection state
+func (s *GcpStorageBucketSource) Collect(ctx context.Context) error {
+	// the emulator is used without authentication
+	if os.Getenv("STORAGE_EMULATOR_HOST") == "" {
+		s.identity = s.Connection.GetIdentity(ctx)
+	}
 
+	// any notifications which are not acknowledged are released, so they are redelivered
+	defer s.releaseNotifications(context.WithoutCancel(ctx))
+
+	if err := s.ArtifactSourceImpl.Collect(ctx); err != nil {
+		return err
+	}
+
+	// if any downloads failed, do not acknowledge the notifications, and do not move the listing start past
+	// the failed objects (the collection state ensures any objects which were collected are not collected again)
+	if count := atomic.LoadInt32(&s.downloadErrorCount); count > 0 {
+		slog.Warn("Not acknowledging Cloud Storage notifications or updating the last object collected as some artifacts failed to download", "failed", count)
+		return nil
+	}
+
+	if state, ok := s.CollectionState.State.(*StorageBucketCollectionState); ok {
+		s.lastObjectNameMut.Lock()
+		for location, objectName := range s.lastObjectNames {
+			state.SetLastObjectName(location, objectName)
+		}
+		s.lastObjectNameMut.Unlock()
+	}
+
+	return s.acknowledgeNotifications(ctx)
+}
+
+func (s *GcpStorageBucketSource) DiscoverArtifacts(ctx context.Context) error {
 	filterMap := make(map[string]*filter.SqlFilter)
+	locations := s.Config.GetLocations()
 
-	g := grok.New()
-	// add any patterns defined in config
-	err := g.AddPatterns(s.Config.GetPatterns())
+	if s.Config.NotificationSubscription != nil {
+		err := s.discoverFromNotifications(ctx, locations, filterMap)
+		if err != nil {
+			s.addError(fmt.Errorf("error discovering artifacts from notification subscription %s, %w", *s.Config.NotificationSubscription, err))
+		}
+	} else if s.Config.InventoryReport != nil {
+		err := s.discoverFromInventoryReport(ctx, locations, filterMap)
+		if err != nil {
+			s.addError(fmt.Errorf("error discovering artifacts from inventory report, %w", err))
+		}
+	} else {
+		// discover the locations concurrently, limited by max_concurrent_discovery
+		sem := make(chan struct{}, s.Config.GetMaxConcurrentDiscovery())
+		var wg sync.WaitGroup
+		for _, location := range locations {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				if err := s.discoverLocation(ctx, location, filterMap); err != nil {
+					s.addError(fmt.Errorf("error discovering artifacts in %s, %w", location.url(), err))
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	if len(s.errorList) > 0 {
+		// requests rejected as unauthenticated are usually caused by an expired token
+		return s.Connection.AuthError(errors.Join(s.errorList...))
+	}
+
+	return nil
+}
+
+// discoverLocation discovers the artifacts in a single bucket location
+func (s *GcpStorageBucketSource) discoverLocation(ctx context.Context, location BucketLocation, filterMap map[string]*filter.SqlFilter) error {
+	prefix := location.getPrefix()
+	layouts := s.getLayouts(location)
+
+	// the grok parser is not safe for concurrent use, so each location has its own
+	g, err := s.newGrok()
 	if err != nil {
-		return fmt.Errorf("error adding grok patterns: %v", err)
+		return err
 	}
 
-	if s.Config.Prefix != nil {
-		prefix = *s.Config.Prefix
+	s.registerBucket(location.Bucket)
+
+	// soft-deleted objects are only discovered if the bucket allows the restored copies to be deleted -
+	// otherwise the live objects are still collected, and the error reported
+	restoreSoftDeleted := false
+	if s.Config.GetRestoreSoftDeleted() {
+		if err := s.checkRestoreAllowed(ctx, location.Bucket); err != nil {
+			s.addError(err)
+		} else {
+			restoreSoftDeleted = true
+		}
+	}
+
+	// rather than walking the whole bucket, only list the objects which may match the layouts
+	listings := getListings(prefix, layouts, s.CollectionTimeRange.LowerBoundary, s.CollectionTimeRange.UpperBoundary)
+	for _, listing := range listings {
+		listing.bucket = location.Bucket
+		slog.Debug("Listing GCP storage bucket", "bucket", listing.bucket, "prefix", listing.prefix, "match_glob", listing.matchGlob)
+		err = s.discoverListing(ctx, location, listing, restoreSoftDeleted, layouts, filterMap, g)
+		if err != nil {
+			s.addError(fmt.Errorf("error discovering artifacts in GCP storage bucket %s, %w", listing.bucket, err))
+		}
+	}
+	return nil
+}
+
+// getLayouts returns the layouts for the objects in the location - the layout of the location if set,
+// otherwise the layout of the source - with any optional segments expanded into all possible alternatives
+func (s *GcpStorageBucketSource) getLayouts(location BucketLocation) []string {
+	layout := typehelpers.SafeString(s.Config.GetFileLayout())
+	if location.FileLayout != nil {
+		layout = *location.FileLayout
+	}
+	// if there are any optional segments, we expand them into all possible alternatives
+	optionalLayouts := artifact_source.ExpandPatternIntoOptionalAlternatives(layout)
+
+	if location.Prefix != nil {
+		prefix := *location.Prefix
 		var newOptionalLayouts []string
 		for _, l := range optionalLayouts {
 			newOptionalLayouts = append(newOptionalLayouts, fmt.Sprintf("%s%s", prefix, l))
@@ -89,68 +271,257 @@ func (s *GcpStorageBucketSource) DiscoverArtifacts(ctx context.Context) error {
 		// while adding support for flat buckets as a new, optional configuration path.
 		optionalLayouts = append(optionalLayouts, newOptionalLayouts...)
 	}
+	return optionalLayouts
+}
 
-	err = s.walk(ctx, s.Config.Bucket, prefix, optionalLayouts, filterMap, g)
+func (s *GcpStorageBucketSource) newGrok() (*grok.Grok, error) {
+	g := grok.New()
+	// add any patterns defined in config
+	err := g.AddPatterns(s.Config.GetPatterns())
 	if err != nil {
-		s.errorList = append(s.errorList, fmt.Errorf("error discovering artifacts in GCP storage bucket %s, %w", s.Config.Bucket, err))
+		return nil, fmt.Errorf("error adding grok patterns: %v", err)
 	}
+	return g, nil
+}
 
-	if len(s.errorList) > 0 {
-		return errors.Join(s.errorList...)
+// registerBucket registers the root of the bucket with the collection state, so objects which are not under
+// a trunk directory do not share a trunk with objects in other buckets
+func (s *GcpStorageBucketSource) registerBucket(bucket string) {
+	s.CollectionState.RegisterPath(objectURL(bucket, ""), nil)
+}
+
+func (s *GcpStorageBucketSource) addError(err error) {
+	s.errorListMut.Lock()
+	defer s.errorListMut.Unlock()
+	s.errorList = append(s.errorList, err)
+}
+
+func (s *GcpStorageBucketSource) DownloadArtifact(ctx context.Context, info *types.ArtifactInfo) error {
+	if err := s.waitForDiscovery(ctx, info); err != nil {
+		s.onDownloadFailed()
+		return err
+	}
+	version := s.getObjectVersion(info)
+
+	// a streamed object is only recorded as collected once the loader has read it to the end
+	if s.canStream(version.name) {
+		if err := s.streamArtifact(ctx, info); err != nil {
+			s.onDownloadFailed()
+			s.notifyError(ctx, s.deleteRestoredObject(context.WithoutCancel(ctx), info))
+			return s.Connection.AuthError(err)
+		}
+		return nil
+	}
+
+	downloadInfo, err := s.downloadArtifact(ctx, info)
+	s.notifyError(ctx, s.deleteRestoredObject(context.WithoutCancel(ctx), info))
+	if err != nil {
+		s.onDownloadFailed()
+		return s.Connection.AuthError(err)
 	}
 
+	// the object is recorded as collected before it is passed to the loader - the collection completes as soon as
+	// the last object has been loaded, so it may complete before OnArtifactDownloaded returns
+	s.onObjectCollected(info)
+	if err := s.OnArtifactDownloaded(ctx, downloadInfo); err != nil {
+		s.onDownloadFailed()
+		return err
+	}
 	return nil
 }
 
-func (s *GcpStorageBucketSource) DownloadArtifact(ctx context.Context, info *types.ArtifactInfo) error {
-	bucket := s.client.Bucket(s.Config.Bucket)
-	obj := bucket.Object(info.Name)
+// notifyError reports an error which does not fail the artifact being collected
+func (s *GcpStorageBucketSource) notifyError(ctx context.Context, err error) {
+	if err == nil {
+		return
+	}
+	slog.Error("GcpStorageBucketSource error", "error", err)
+	if executionId, idErr := context_values.ExecutionIdFromContext(ctx); idErr == nil {
+		s.NotifyError(ctx, executionId, err)
+	}
+}
+
+// onObjectCollected records the object as collected, once it has been downloaded or streamed to the end
+func (s *GcpStorageBucketSource) onObjectCollected(info *types.ArtifactInfo) {
+	if s.Config.GetIncrementalListing() {
+		s.setLastObjectName(s.getObjectVersion(info))
+	}
+	s.onObjectDownloaded(info)
+}
+
+// onDownloadFailed records that an object could not be downloaded or streamed to the end - the collection state
+// end time is not moved past the object, and notifications are not acknowledged, so the object is collected again
+func (s *GcpStorageBucketSource) onDownloadFailed() {
+	atomic.AddInt32(&s.downloadErrorCount, 1)
+	atomic.AddInt32(&s.ErrorCount, 1)
+}
+
+// setLastObjectName records the object as the last object downloaded from its directory at the listing offset depth,
+// if it is after the last object already recorded (objects above that depth are always listed, so are not recorded)
+func (s *GcpStorageBucketSource) setLastObjectName(version objectVersion) {
+	location, ok := s.getObjectLocation(version)
+	if !ok {
+		return
+	}
+	dir, ok := s.offsetDir(location, version.name)
+	if !ok {
+		return
+	}
+	dirURL := objectURL(version.bucket, dir)
+
+	s.lastObjectNameMut.Lock()
+	defer s.lastObjectNameMut.Unlock()
+	if version.name > s.lastObjectNames[dirURL] {
+		s.lastObjectNames[dirURL] = version.name
+	}
+}
+
+// getObjectLocation returns the configured location containing the object
+// (locations cannot overlap, so there is at most one)
+func (s *GcpStorageBucketSource) getObjectLocation(version objectVersion) (BucketLocation, bool) {
+	for _, location := range s.Config.GetLocations() {
+		if location.Bucket == version.bucket && strings.HasPrefix(version.name, location.getPrefix()) {
+			return location, true
+		}
+	}
+	return BucketLocation{}, false
+}
 
-	reader, err := obj.NewReader(ctx)
+// getStartOffset returns the object name to start listing the directory of the location from - if incremental listing
+// is enabled, this is the last object collected by a previous collection from the directory at the listing offset depth
+// containing it, as the objects in each of these directories are written in name order
+// (the listing includes this object, which the collection state will not collect again)
+// returns an empty string if the directory is above the listing offset depth, so must be listed in full
+func (s *GcpStorageBucketSource) getStartOffset(location BucketLocation, dir string) string {
+	if !s.Config.GetIncrementalListing() {
+		return ""
+	}
+	state, ok := s.CollectionState.State.(*StorageBucketCollectionState)
+	if !ok {
+		return ""
+	}
+	offsetDir, ok := s.offsetDir(location, dir)
+	if !ok {
+		return ""
+	}
+	return state.GetLastObjectName(objectURL(location.Bucket, offsetDir))
+}
+
+// downloadArtifact downloads the object to a temp file
+func (s *GcpStorageBucketSource) downloadArtifact(ctx context.Context, info *types.ArtifactInfo) (*types.DownloadedArtifactInfo, error) {
+	obj, err := s.getObjectHandle(ctx, info)
 	if err != nil {
-		return fmt.Errorf("failed to get object reader: %s", err.Error())
+		return nil, err
 	}
-	defer reader.Close()
 
-	localFilePath := path.Join(s.TempDir, info.Name)
+	// the object is downloaded to a path ending with the object name, so the loader for its extension is used -
+	// noncurrent and soft-deleted versions are downloaded to a separate directory for each generation
+	version := s.getObjectVersion(info)
+	localDir := version.bucket
+	if version.path() != version.url() {
+		localDir = fmt.Sprintf("%s#%d", version.bucket, version.generation)
+	}
+	localFilePath := path.Join(s.TempDir, localDir, version.name)
 	if err := os.MkdirAll(path.Dir(localFilePath), 0755); err != nil {
-		return fmt.Errorf("failed to create directory for file, %w", err)
+		return nil, fmt.Errorf("failed to create directory for file, %w", err)
 	}
 
 	outFile, err := os.Create(localFilePath)
 	if err != nil {
-		return fmt.Errorf("failed to create file, %w", err)
+		return nil, fmt.Errorf("failed to create file, %w", err)
 	}
 	defer outFile.Close()
 
-	if _, err = io.Copy(outFile, reader); err != nil {
-		return fmt.Errorf("failed to write data to file, %w", err)
+	size, attrs, err := s.downloadObject(ctx, obj, outFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download object %s, %w", info.Name, err)
+	}
+	if err := s.setProvenance(info, attrs); err != nil {
+		return nil, err
 	}
 
-	downloadInfo := types.NewDownloadedArtifactInfo(info, localFilePath, reader.Attrs.Size)
-
-	return s.OnArtifactDownloaded(ctx, downloadInfo)
+	return types.NewDownloadedArtifactInfo(info, localFilePath, size), nil
 }
 
-func (s *GcpStorageBucketSource) getClient(ctx context.Context) (*storage.Client, error) {
-	opts, err := s.Connection.GetClientOptions(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed setting GCP Storage client config: %s", err.Error())
+// checkPermissions checks the connection can list and read the objects in each bucket the source collects from,
+// and restore and delete them if soft-deleted objects are restored, so a misconfigured partition fails before collecting
+func (s *GcpStorageBucketSource) checkPermissions(ctx context.Context) error {
+	// the check is made using the endpoint of the connection, so it is skipped if the source uses another endpoint
+	if os.Getenv("STORAGE_EMULATOR_HOST") != "" || s.Config.Endpoint != nil {
+		slog.Warn("GcpStorageBucketSource permissions are not checked when the source endpoint is set")
+		return nil
+	}
+
+	// map of bucket to the permissions needed in it - restoring soft-deleted objects also writes to the bucket
+	permissions := make(map[string][]string)
+	for _, location := range s.Config.GetLocations() {
+		permissions[location.Bucket] = config.StorageReadPermissions
+		if s.Config.GetRestoreSoftDeleted() {
+			permissions[location.Bucket] = slices.Concat(config.StorageReadPermissions, config.StorageRestorePermissions)
+		}
+	}
+	if s.Config.InventoryReport != nil {
+		if _, ok := permissions[s.Config.InventoryReport.Bucket]; !ok {
+			permissions[s.Config.InventoryReport.Bucket] = config.StorageReadPermissions
+		}
 	}
 
-	client, err := storage.NewClient(ctx, opts...)
+	var checks []config.PermissionCheck
+	for _, bucket := range slices.Sorted(maps.Keys(permissions)) {
+		check := config.BucketPermissions(bucket, permissions[bucket]...)
+		// requester-pays buckets bill the user project for the check, as for the requests made collecting
+		check.UserProject = s.userProject
+		checks = append(checks, check)
+	}
+	result, err := s.Connection.CheckConnection(ctx, checks...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GCP Storage client: %s", err.Error())
+		return fmt.Errorf("error checking GCP connection: %w", err)
+	}
+	return result.Err()
+}
+
+// getClient returns the storage client of the connection, which is shared by all sources using the connection
+// with the same endpoint
+func (s *GcpStorageBucketSource) getClient(ctx context.Context) (*storage.Client, error) {
+	emulatorHost := os.Getenv("STORAGE_EMULATOR_HOST")
+	key := string(config.StorageAPI)
+	if emulatorHost != "" {
+		key += "/emulator=" + emulatorHost
+	}
+	if s.Config.Endpoint != nil {
+		key += "/endpoint=" + *s.Config.Endpoint
 	}
 
-	return client, nil
+	return config.GetClient(ctx, s.Connection, key, func(ctx context.Context) (*storage.Client, error) {
+		var opts []option.ClientOption
+		// if the STORAGE_EMULATOR_HOST env var is set, the client connects to the emulator without authentication
+		if emulatorHost == "" {
+			var err error
+			opts, err = s.Connection.GetClientOptions(ctx, config.StorageAPI)
+			if err != nil {
+				return nil, fmt.Errorf("failed setting GCP Storage client config: %s", err.Error())
+			}
+		}
+		if s.Config.Endpoint != nil {
+			opts = append(opts, option.WithEndpoint(*s.Config.Endpoint))
+		}
+
+		client, err := storage.NewClient(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCP Storage client: %s", err.Error())
+		}
+		return client, nil
+	})
 }
 
-func (s *GcpStorageBucketSource) walk(ctx context.Context, bucket string, prefix string, layouts []string, filterMap map[string]*filter.SqlFilter, g *grok.Grok) error {
-	bkt := s.client.Bucket(bucket)
+func (s *GcpStorageBucketSource) walk(ctx context.Context, location BucketLocation, prefix string, layouts []string, filterMap map[string]*filter.SqlFilter, g *grok.Grok) error {
+	bucket := location.Bucket
+	bkt := s.bucket(bucket)
 	query := &storage.Query{
-		Prefix:    prefix,
-		Delimiter: "/", // Treat '/' as directory separator
+		Prefix:      prefix,
+		Delimiter:   "/", // Treat '/' as directory separator
+		StartOffset: s.getStartOffset(location, prefix),
+		Versions:    s.Config.GetIncludeNoncurrentVersions(),
 	}
 
 	// List objects and prefixes
@@ -161,13 +532,16 @@ func (s *GcpStorageBucketSource) walk(ctx context.Context, bucket string, prefix
 			break
 		}
 		if err != nil {
+			if rpErr := s.requesterPaysError(bucket, err); rpErr != nil {
+				return rpErr
+			}
 			return fmt.Errorf("error getting interating next objects, %w", err)
 		}
 
 		// Directories
 		if objAttrs.Prefix != "" {
 			// Process the directory node
-			err = s.WalkNode(ctx, objAttrs.Prefix, "", layouts, true, g, filterMap)
+			err = s.WalkNode(ctx, objectURL(bucket, objAttrs.Prefix), objectURL(bucket, ""), layouts, true, g, filterMap)
 			if err != nil {
 				if errors.Is(err, fs.SkipDir) {
 					continue
@@ -175,18 +549,24 @@ func (s *GcpStorageBucketSource) walk(ctx context.Context, bucket string, prefix
 					return fmt.Errorf("error walking node, %w", err)
 				}
 			}
-			err = s.walk(ctx, bucket, objAttrs.Prefix, layouts, filterMap, g)
+			err = s.walk(ctx, location, objAttrs.Prefix, layouts, filterMap, g)
 			if err != nil {
-				s.errorList = append(s.errorList, err)
+				s.addError(err)
 			}
 		}
 
 		// Files
 		if objAttrs.Prefix == "" {
+			// apply the object filters before the layout
+			if !s.Config.ObjectSatisfiesFilters(objAttrs) {
+				continue
+			}
+
 			// Process the file node
-			err = s.WalkNode(ctx, objAttrs.Name, "", layouts, false, g, filterMap)
+			version := newObjectVersion(bucket, objAttrs, false)
+			err = s.walkObject(ctx, version, layouts, filterMap, g)
 			if err != nil {
-				s.errorList = append(s.errorList, fmt.Errorf("error parsing object %s, %w", objAttrs.Name, err))
+				s.addError(fmt.Errorf("error parsing object %s, %w", version.path(), err))
 			}
 		}
 	}
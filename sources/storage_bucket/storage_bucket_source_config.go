@@ -2,30 +2,247 @@ package storage_bucket
 
 import (
 	"fmt"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/hcl/v2"
 
+	"github.com/turbot/tailpipe-plugin-sdk/artifact_source"
 	"github.com/turbot/tailpipe-plugin-sdk/artifact_source_config"
 )
 
+const (
+	// the default, and maximum, number of concurrent object reads - the SDK downloads at most this many artifacts at once
+	defaultMaxConcurrentDownloads = artifact_source.ArtifactSourceMaxConcurrency
+	// the default number of bucket locations discovered concurrently
+	defaultMaxConcurrentDiscovery = 4
+	// the default maximum number of notifications pulled in a collection
+	defaultMaxNotifications = 10000
+)
+
+var subscriptionRegex = regexp.MustCompile(`^projects/[^/]+/subscriptions/[^/]+$`)
+
+// BucketLocation is a bucket, and optionally a prefix within it, to collect from
+type BucketLocation struct {
+	Bucket string  `hcl:"bucket,optional"`
+	Prefix *string `hcl:"prefix,optional"`
+	// if set, overrides the file_layout of the source for objects in this location
+	FileLayout *string `hcl:"file_layout,optional"`
+}
+
+// url returns the location in the form gs://bucket/prefix
+func (l BucketLocation) url() string {
+	return objectURL(l.Bucket, l.getPrefix())
+}
+
+func (l BucketLocation) getPrefix() string {
+	if l.Prefix == nil {
+		return ""
+	}
+	return *l.Prefix
+}
+
+// overlaps returns whether the location contains objects which are also in the other location
+func (l BucketLocation) overlaps(other BucketLocation) bool {
+	return l.Bucket == other.Bucket && (strings.HasPrefix(l.getPrefix(), other.getPrefix()) || strings.HasPrefix(other.getPrefix(), l.getPrefix()))
+}
+
+// InventoryReport is the destination of a Storage Insights inventory report configuration
+// if set, objects are discovered from the latest inventory report, rather than by listing the bucket locations
+type InventoryReport struct {
+	// the bucket and folder the inventory reports are written to
+	Bucket string  `hcl:"bucket"`
+	Prefix *string `hcl:"prefix,optional"`
+	// the ID of the report configuration, if reports from more than one configuration are written to the destination
+	ReportConfigId *string `hcl:"report_config_id,optional"`
+	// the maximum age of the latest report, e.g. 48h - if the latest report is older, the collection fails
+	MaxAge *string `hcl:"max_age,optional"`
+}
+
+func (r *InventoryReport) getPrefix() string {
+	if r.Prefix == nil {
+		return ""
+	}
+	return *r.Prefix
+}
+
 // GcpStorageBucketSourceConfig is the configuration for [GcpStorageBucketSource]
 type GcpStorageBucketSourceConfig struct {
 	artifact_source_config.ArtifactSourceConfigImpl
+	ObjectFilters
 	// required to allow partial decoding
 	Remain hcl.Body `hcl:",remain" json:"-"`
 
-	Bucket string  `hcl:"bucket"`
+	Bucket string  `hcl:"bucket,optional"`
 	Prefix *string `hcl:"prefix,optional"`
+	// additional bucket locations to collect from, e.g. for logs sharded across regional buckets
+	Locations []BucketLocation `hcl:"location,block"`
+	// the Cloud Storage JSON API endpoint, e.g. for an emulator such as fake-gcs-server
+	Endpoint *string `hcl:"endpoint,optional"`
+	// the project billed for requests to requester-pays buckets - defaults to the connection project
+	// (an empty string means no user project is sent)
+	UserProject *string `hcl:"user_project,optional"`
+	// the maximum number of bucket locations discovered concurrently
+	MaxConcurrentDiscovery *int `hcl:"max_concurrent_discovery,optional"`
+	// the Pub/Sub subscription receiving Cloud Storage notifications for the bucket
+	// if set, artifacts are discovered from OBJECT_FINALIZE notifications rather than by listing the bucket
+	NotificationSubscription *string `hcl:"notification_subscription,optional"`
+	// the maximum number of notifications pulled in a collection - any more are left for the next collection
+	MaxNotifications *int `hcl:"max_notifications,optional"`
+	// the Storage Insights inventory reports for the bucket locations
+	// if set, artifacts are discovered from the latest inventory report rather than by listing the bucket
+	InventoryReport *InventoryReport `hcl:"inventory_report,block"`
+	// if true, the name of the last object collected from each directory before the first date field of the layout
+	// is stored in the collection state, and later collections only list objects in the directory after it -
+	// this requires objects to be written to each directory in name order
+	IncrementalListing *bool `hcl:"incremental_listing,optional"`
+	// the maximum number of concurrent object reads, at most 16 - large objects are read in concurrent parts
+	MaxConcurrentDownloads *int `hcl:"max_concurrent_downloads,optional"`
+	// if true, objects are read directly into the row pipeline rather than downloaded to temp files
+	Streaming *bool `hcl:"streaming,optional"`
+	// if true, the generations of the objects collected are stored in the collection state,
+	// and an object which is rewritten is collected again
+	TrackGenerations *bool `hcl:"track_generations,optional"`
+	// if true, noncurrent versions of objects in versioned buckets are collected (this implies track_generations)
+	IncludeNoncurrentVersions *bool `hcl:"include_noncurrent_versions,optional"`
+	// if true, soft-deleted objects are restored and collected, and the restored copy deleted once it has been read
+	// (this writes to the bucket, and implies track_generations)
+	RestoreSoftDeleted *bool `hcl:"restore_soft_deleted,optional"`
 }
 
 func (g *GcpStorageBucketSourceConfig) Validate() error {
-	if g.Bucket == "" {
-		return fmt.Errorf("bucket is required and cannot be empty")
+	if g.Bucket == "" && len(g.Locations) == 0 {
+		return fmt.Errorf("bucket or at least one location block is required")
+	}
+	if g.Bucket == "" && g.Prefix != nil {
+		return fmt.Errorf("prefix cannot be set without bucket")
+	}
+
+	locations := g.GetLocations()
+	for i, location := range locations {
+		if location.Bucket == "" {
+			return fmt.Errorf("location bucket is required and cannot be empty")
+		}
+		for _, other := range locations[:i] {
+			if location.overlaps(other) {
+				return fmt.Errorf("locations %s and %s overlap", other.url(), location.url())
+			}
+		}
+	}
+
+	if g.NotificationSubscription != nil && !subscriptionRegex.MatchString(*g.NotificationSubscription) {
+		return fmt.Errorf("invalid notification_subscription %s, expected the format projects/<project>/subscriptions/<subscription>", *g.NotificationSubscription)
+	}
+
+	if g.NotificationSubscription != nil && g.GetIncrementalListing() {
+		return fmt.Errorf("incremental_listing cannot be used with notification_subscription")
+	}
+
+	if g.NotificationSubscription != nil && (g.GetIncludeNoncurrentVersions() || g.GetRestoreSoftDeleted()) {
+		return fmt.Errorf("include_noncurrent_versions and restore_soft_deleted cannot be used with notification_subscription")
+	}
+
+	if g.InventoryReport != nil {
+		if g.InventoryReport.Bucket == "" {
+			return fmt.Errorf("inventory_report bucket is required and cannot be empty")
+		}
+		if g.InventoryReport.MaxAge != nil {
+			if _, err := time.ParseDuration(*g.InventoryReport.MaxAge); err != nil {
+				return fmt.Errorf("invalid inventory_report max_age %s, expected a duration, e.g. 48h", *g.InventoryReport.MaxAge)
+			}
+		}
+		if g.NotificationSubscription != nil {
+			return fmt.Errorf("inventory_report cannot be used with notification_subscription")
+		}
+		// inventory reports only list live objects
+		if g.GetIncludeNoncurrentVersions() || g.GetRestoreSoftDeleted() {
+			return fmt.Errorf("include_noncurrent_versions and restore_soft_deleted cannot be used with inventory_report")
+		}
+		// inventory reports do not include custom metadata
+		if len(g.Metadata) > 0 {
+			return fmt.Errorf("metadata cannot be used with inventory_report")
+		}
+	}
+
+	if err := g.validateObjectFilters(); err != nil {
+		return err
+	}
+
+	if g.MaxConcurrentDownloads != nil && (*g.MaxConcurrentDownloads < 1 || *g.MaxConcurrentDownloads > defaultMaxConcurrentDownloads) {
+		return fmt.Errorf("max_concurrent_downloads must be between 1 and %d", defaultMaxConcurrentDownloads)
+	}
+
+	if g.MaxConcurrentDiscovery != nil && *g.MaxConcurrentDiscovery < 1 {
+		return fmt.Errorf("max_concurrent_discovery must be at least 1")
+	}
+
+	if g.MaxNotifications != nil && *g.MaxNotifications < 1 {
+		return fmt.Errorf("max_notifications must be at least 1")
 	}
 
 	return nil
 }
 
+// GetLocations returns the bucket locations to collect from - the bucket and prefix, if set,
+// followed by the location blocks
+func (g *GcpStorageBucketSourceConfig) GetLocations() []BucketLocation {
+	var locations []BucketLocation
+	if g.Bucket != "" {
+		locations = append(locations, BucketLocation{Bucket: g.Bucket, Prefix: g.Prefix})
+	}
+	return append(locations, g.Locations...)
+}
+
+// GetMaxConcurrentDiscovery returns the maximum number of bucket locations discovered concurrently
+func (g *GcpStorageBucketSourceConfig) GetMaxConcurrentDiscovery() int {
+	if g.MaxConcurrentDiscovery == nil {
+		return defaultMaxConcurrentDiscovery
+	}
+	return *g.MaxConcurrentDiscovery
+}
+
+// GetMaxNotifications returns the maximum number of notifications pulled in a collection
+func (g *GcpStorageBucketSourceConfig) GetMaxNotifications() int {
+	if g.MaxNotifications == nil {
+		return defaultMaxNotifications
+	}
+	return *g.MaxNotifications
+}
+
+// GetIncrementalListing returns whether listings start from the last object collected from each directory
+func (g *GcpStorageBucketSourceConfig) GetIncrementalListing() bool {
+	return g.IncrementalListing != nil && *g.IncrementalListing
+}
+
+// GetTrackGenerations returns whether the generations of the objects collected are stored in the collection state
+func (g *GcpStorageBucketSourceConfig) GetTrackGenerations() bool {
+	return (g.TrackGenerations != nil && *g.TrackGenerations) || g.GetIncludeNoncurrentVersions() || g.GetRestoreSoftDeleted()
+}
+
+// GetIncludeNoncurrentVersions returns whether noncurrent versions of objects are collected
+func (g *GcpStorageBucketSourceConfig) GetIncludeNoncurrentVersions() bool {
+	return g.IncludeNoncurrentVersions != nil && *g.IncludeNoncurrentVersions
+}
+
+// GetRestoreSoftDeleted returns whether soft-deleted objects are restored and collected
+func (g *GcpStorageBucketSourceConfig) GetRestoreSoftDeleted() bool {
+	return g.RestoreSoftDeleted != nil && *g.RestoreSoftDeleted
+}
+
+// GetStreaming returns whether objects are streamed rather than downloaded to temp files
+func (g *GcpStorageBucketSourceConfig) GetStreaming() bool {
+	return g.Streaming != nil && *g.Streaming
+}
+
+// GetMaxConcurrentDownloads returns the maximum number of concurrent object reads
+func (g *GcpStorageBucketSourceConfig) GetMaxConcurrentDownloads() int {
+	if g.MaxConcurrentDownloads == nil {
+		return defaultMaxConcurrentDownloads
+	}
+	return *g.MaxConcurrentDownloads
+}
+
 func (*GcpStorageBucketSourceConfig) Identifier() string {
 	return GcpStorageBucketSourceIdentifier
 }
@@ -0,0 +1,929 @@
+package storage_bucket_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+	"github.com/hashicorp/hcl/v2"
+
+	"github.com/turbot/tailpipe-plugin-gcp/config"
+	"github.com/turbot/tailpipe-plugin-gcp/sources/storage_bucket"
+	"github.com/turbot/tailpipe-plugin-gcp/tables/audit_log"
+	"github.com/turbot/tailpipe-plugin-gcp/tables/billing_report"
+	"github.com/turbot/tailpipe-plugin-gcp/tables/storage_inventory"
+	"github.com/turbot/tailpipe-plugin-sdk/context_values"
+	"github.com/turbot/tailpipe-plugin-sdk/events"
+	"github.com/turbot/tailpipe-plugin-sdk/row_source"
+	"github.com/turbot/tailpipe-plugin-sdk/table"
+	"github.com/turbot/tailpipe-plugin-sdk/types"
+)
+
+// fakeObject is an object stored by fakeGcsServer
+type fakeObject struct {
+	name       string
+	content    []byte
+	generation int64
+	created    time.Time
+	// if true, reads of the object fail part way through
+	truncated bool
+}
+
+// fakeListing is an object listing requested from fakeGcsServer
+type fakeListing struct {
+	prefix      string
+	startOffset string
+}
+
+// fakeGcsServer is an in-process Cloud Storage stand-in, implementing the object list (JSON API)
+// and object read (XML API) requests made by the source
+type fakeGcsServer struct {
+	*httptest.Server
+	buckets map[string][]fakeObject
+
+	// the listings requested
+	listings   []fakeListing
+	listingMut sync.Mutex
+
+	// the requester-pays buckets, which reject requests without a user project
+	requesterPays map[string]bool
+	// the user projects of the list and read requests made
+	listUserProjects []string
+	readUserProjects []string
+	userProjectMut   sync.Mutex
+}
+
+func newFakeGcsServer(t *testing.T, buckets map[string][]fakeObject) *fakeGcsServer {
+	f := &fakeGcsServer{buckets: buckets}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /storage/v1/b/{bucket}/o", f.listObjects)
+	mux.HandleFunc("GET /{bucket}/{object...}", f.readObject)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeGcsServer) endpoint() string {
+	return f.URL + "/storage/v1/"
+}
+
+func (f *fakeGcsServer) listObjects(w http.ResponseWriter, r *http.Request) {
+	objects, ok := f.buckets[r.PathValue("bucket")]
+	if !ok {
+		http.Error(w, `{"error":{"code":404,"message":"The specified bucket does not exist."}}`, http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	f.userProjectMut.Lock()
+	f.listUserProjects = append(f.listUserProjects, query.Get("userProject"))
+	f.userProjectMut.Unlock()
+	if f.requesterPays[r.PathValue("bucket")] && query.Get("userProject") == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":{"code":400,"message":"Bucket is a requester pays bucket but no user project provided.","errors":[{"reason":"required","message":"Bucket is a requester pays bucket but no user project provided."}]}}`))
+		return
+	}
+
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	startOffset := query.Get("startOffset")
+	f.listingMut.Lock()
+	f.listings = append(f.listings, fakeListing{prefix: prefix, startOffset: startOffset})
+	f.listingMut.Unlock()
+	var glob *regexp.Regexp
+	if matchGlob := query.Get("matchGlob"); matchGlob != "" {
+		glob = globToRegexp(matchGlob)
+	}
+
+	type item struct {
+		Bucket         string `json:"bucket"`
+		Name           string `json:"name"`
+		Generation     int64  `json:"generation,string"`
+		Metageneration int64  `json:"metageneration,string"`
+		Size           int64  `json:"size,string"`
+		Md5Hash        string `json:"md5Hash"`
+		TimeCreated    string `json:"timeCreated"`
+		Updated        string `json:"updated"`
+	}
+	var resp struct {
+		Items    []item   `json:"items"`
+		Prefixes []string `json:"prefixes"`
+	}
+	for _, object := range objects {
+		if !strings.HasPrefix(object.name, prefix) || object.name < startOffset {
+			continue
+		}
+		if glob != nil && !glob.MatchString(object.name) {
+			continue
+		}
+		if delimiter != "" {
+			if idx := strings.Index(object.name[len(prefix):], delimiter); idx >= 0 {
+				dir := object.name[:len(prefix)+idx+len(delimiter)]
+				if !slices.Contains(resp.Prefixes, dir) {
+					resp.Prefixes = append(resp.Prefixes, dir)
+				}
+				continue
+			}
+		}
+		created := object.created
+		if created.IsZero() {
+			created = time.Now()
+		}
+		resp.Items = append(resp.Items, item{
+			Bucket:         r.PathValue("bucket"),
+			Name:           object.name,
+			Generation:     object.generation,
+			Metageneration: 1,
+			Size:           int64(len(object.content)),
+			Md5Hash:        md5Hash(object.content),
+			TimeCreated:    created.UTC().Format(time.RFC3339),
+			Updated:        time.Now().UTC().Format(time.RFC3339),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (f *fakeGcsServer) readObject(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("object")
+	idx := slices.IndexFunc(f.buckets[r.PathValue("bucket")], func(o fakeObject) bool { return o.name == name })
+	if idx < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	object := f.buckets[r.PathValue("bucket")][idx]
+
+	// objects are read with the XML API, which sends the user project in a header
+	userProject := r.Header.Get("X-Goog-User-Project")
+	f.userProjectMut.Lock()
+	f.readUserProjects = append(f.readUserProjects, userProject)
+	f.userProjectMut.Unlock()
+	if f.requesterPays[r.PathValue("bucket")] && userProject == "" {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`<?xml version='1.0' encoding='UTF-8'?><Error><Code>UserProjectMissing</Code><Message>Bucket is a requester pays bucket but no user project provided.</Message></Error>`))
+		return
+	}
+
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(object.generation, 10))
+	w.Header().Set("X-Goog-Metageneration", "1")
+	if object.truncated {
+		// the first read sends half the object then drops the connection, and attempts to resume the read fail
+		if r.Header.Get("Range") != "" {
+			http.Error(w, "read failed", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.content)))
+		_, _ = w.Write(object.content[:len(object.content)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(object.content))
+}
+
+// md5Hash returns the base64 encoded MD5 hash of the content, as Cloud Storage returns it
+func md5Hash(content []byte) string {
+	hash := md5.Sum(content)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// globToRegexp converts a Cloud Storage match glob to a regular expression
+func globToRegexp(glob string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '{':
+			sb.WriteString("(?:")
+		case c == '}':
+			sb.WriteString(")")
+		case c == ',':
+			sb.WriteString("|")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+// rowCollector is an observer which records the rows extracted by the source, and the provenance of each object
+type rowCollector struct {
+	mut        sync.Mutex
+	rows       map[string][]string
+	provenance map[string]*config.Provenance
+	errs       []error
+}
+
+func (c *rowCollector) Notify(_ context.Context, event events.Event) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	switch e := event.(type) {
+	case *events.RowExtracted:
+		location := *e.SourceEnrichment.CommonFields.TpSourceLocation
+		// inventory report rows are recorded by object name
+		row := fmt.Sprint(e.Row)
+		if record, ok := e.Row.(*storage_bucket.InventoryRecord); ok {
+			row = record.Name
+		}
+		c.rows[location] = append(c.rows[location], row)
+		provenance, err := config.ProvenanceFromMetadata(e.SourceEnrichment.Metadata)
+		if err != nil {
+			c.errs = append(c.errs, err)
+		}
+		c.provenance[location] = provenance
+	case *events.Error:
+		c.errs = append(c.errs, e.Err)
+	}
+	return nil
+}
+
+// waitForErrors returns the errors raised, waiting up to the timeout for an error to be raised - the SDK raises
+// the error for an artifact which failed to download after the collection stops waiting for the artifact, so the error
+// may be raised after Collect returns
+func (c *rowCollector) waitForErrors(timeout time.Duration) []error {
+	deadline := time.Now().Add(timeout)
+	for {
+		c.mut.Lock()
+		errs := slices.Clone(c.errs)
+		c.mut.Unlock()
+		if len(errs) > 0 || time.Now().After(deadline) {
+			return errs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// collect initializes a source with the source and connection config and table source options, and collects from the fake server
+func collect(t *testing.T, sourceConfig, connectionConfig string, from, to time.Time, opts []row_source.RowSourceOption) map[string][]string {
+	t.Helper()
+	return collectRows(t, sourceConfig, connectionConfig, from, to, opts).rows
+}
+
+// collectRows collects from the fake server as collect does, returning the collector
+func collectRows(t *testing.T, sourceConfig, connectionConfig string, from, to time.Time, opts []row_source.RowSourceOption) *rowCollector {
+	t.Helper()
+
+	collector := collectWithErrors(t, sourceConfig, connectionConfig, from, to, opts)
+	if len(collector.errs) > 0 {
+		t.Fatalf("errors collecting: %v", collector.errs)
+	}
+	return collector
+}
+
+// collectWithErrors collects from the fake server as collectRows does, returning the collector with any errors
+// raised for the artifacts
+func collectWithErrors(t *testing.T, sourceConfig, connectionConfig string, from, to time.Time, opts []row_source.RowSourceOption) *rowCollector {
+	t.Helper()
+	return collectWithState(t, filepath.Join(t.TempDir(), "collection_state.json"), sourceConfig, connectionConfig, from, to, opts)
+}
+
+// collectWithState collects from the fake server as collectWithErrors does, using the collection state at the path,
+// which is saved when the collection completes
+func collectWithState(t *testing.T, statePath, sourceConfig, connectionConfig string, from, to time.Time, opts []row_source.RowSourceOption) *rowCollector {
+	t.Helper()
+
+	ctx := context_values.WithExecutionId(context.Background(), "test")
+	params := &row_source.RowSourceParams{
+		SourceConfigData:    types.NewSourceConfigData([]byte(sourceConfig), hcl.Range{}, storage_bucket.GcpStorageBucketSourceIdentifier),
+		ConnectionData:      types.NewConnectionConfigData([]byte(connectionConfig), hcl.Range{}, config.PluginName),
+		CollectionStatePath: statePath,
+		CollectionTempDir:   t.TempDir(),
+		From:                from,
+		To:                  to,
+	}
+
+	source := &storage_bucket.GcpStorageBucketSource{}
+	source.RegisterSource(source)
+	if err := source.Init(ctx, params, opts...); err != nil {
+		t.Fatalf("error initializing source: %s", err)
+	}
+	defer source.Close()
+
+	collector := &rowCollector{rows: make(map[string][]string), provenance: make(map[string]*config.Provenance)}
+	if err := source.AddObserver(collector); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := source.Collect(ctx); err != nil {
+		t.Fatalf("error collecting: %s", err)
+	}
+	if err := source.OnCollectionComplete(); err != nil {
+		t.Fatalf("error completing collection: %s", err)
+	}
+	// the state is only saved on completion if there were no errors - save it anyway, so the artifacts recorded as
+	// collected by a collection with errors can be checked
+	if err := source.SaveCollectionState(); err != nil {
+		t.Fatalf("error saving collection state: %s", err)
+	}
+	return collector
+}
+
+// getSourceOptions returns the options a table passes to the storage bucket source
+func getSourceOptions[R any](t *testing.T, metadata []*table.SourceMetadata[R]) []row_source.RowSourceOption {
+	t.Helper()
+
+	for _, m := range metadata {
+		if m.SourceName == storage_bucket.GcpStorageBucketSourceIdentifier {
+			return m.Options
+		}
+	}
+	t.Fatalf("table has no %s source", storage_bucket.GcpStorageBucketSourceIdentifier)
+	return nil
+}
+
+func assertRows(t *testing.T, got, want map[string][]string) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Errorf("got rows from %d objects, want %d: %v", len(got), len(want), got)
+	}
+	for location, wantRows := range want {
+		gotRows := got[location]
+		slices.Sort(gotRows)
+		slices.Sort(wantRows)
+		if !slices.Equal(gotRows, wantRows) {
+			t.Errorf("rows from %s: got %v, want %v", location, gotRows, wantRows)
+		}
+	}
+}
+
+func TestCollectAuditLogs(t *testing.T) {
+	activity := `{"logName":"projects/p/logs/cloudaudit.googleapis.com%2Factivity","insertId":"1"}
+{"logName":"projects/p/logs/cloudaudit.googleapis.com%2Factivity","insertId":"2"}
+`
+	dataAccess := `{"logName":"projects/p/logs/cloudaudit.googleapis.com%2Fdata_access","insertId":"3"}
+`
+	server := newFakeGcsServer(t, map[string][]fakeObject{
+		"audit-logs": {
+			{name: "cloudaudit.googleapis.com/activity/2025/06/07/00:00:00_00:59:59_S0.json", content: []byte(activity), generation: 1},
+			{name: "cloudaudit.googleapis.com/activity/2025/07/01/00:00:00_00:59:59_S0.json", content: []byte(activity), generation: 2},
+			{name: "cloudaudit.googleapis.com/data_access/2025/06/08/10:00:00_10:59:59_S0.json", content: []byte(dataAccess), generation: 3},
+			{name: "other/2025/06/07/00:00:00_00:59:59_S0.json", content: []byte(activity), generation: 4},
+		},
+	})
+
+	metadata, err := (&audit_log.AuditLogTable{}).GetSourceMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := getSourceOptions(t, metadata)
+
+	// the collection is within a single month, so the objects are listed with a match glob
+	from := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC)
+	want := map[string][]string{
+		"gs://audit-logs/cloudaudit.googleapis.com/activity/2025/06/07/00:00:00_00:59:59_S0.json":    strings.Split(strings.TrimSpace(activity), "\n"),
+		"gs://audit-logs/cloudaudit.googleapis.com/data_access/2025/06/08/10:00:00_10:59:59_S0.json": strings.Split(strings.TrimSpace(dataAccess), "\n"),
+	}
+
+	tests := []struct {
+		name             string
+		sourceConfig     string
+		connectionConfig string
+		emulatorHost     string
+	}{
+		{
+			name:             "endpoint",
+			sourceConfig:     fmt.Sprintf("bucket = \"audit-logs\"\nendpoint = %q\n", server.endpoint()),
+			connectionConfig: "without_authentication = true\n",
+		},
+		{
+			name:             "endpoint streaming",
+			sourceConfig:     fmt.Sprintf("bucket = \"audit-logs\"\nendpoint = %q\nstreaming = true\n", server.endpoint()),
+			connectionConfig: "without_authentication = true\n",
+		},
+		{
+			name:         "emulator host",
+			sourceConfig: "bucket = \"audit-logs\"\n",
+			emulatorHost: server.Listener.Addr().String(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.emulatorHost != "" {
+				t.Setenv("STORAGE_EMULATOR_HOST", tt.emulatorHost)
+			}
+			collector := collectRows(t, tt.sourceConfig, tt.connectionConfig, from, to, opts)
+			assertRows(t, collector.rows, want)
+			assertProvenance(t, collector.provenance, server, "audit-logs")
+		})
+	}
+}
+
+// assertProvenance checks the rows of each object record the object they were collected from
+func assertProvenance(t *testing.T, got map[string]*config.Provenance, server *fakeGcsServer, bucket string) {
+	t.Helper()
+
+	for location, provenance := range got {
+		if provenance == nil {
+			t.Errorf("rows from %s have no provenance", location)
+			continue
+		}
+		idx := slices.IndexFunc(server.buckets[bucket], func(o fakeObject) bool { return "gs://"+bucket+"/"+o.name == location })
+		if idx < 0 {
+			t.Errorf("rows from unknown object %s", location)
+			continue
+		}
+		object := server.buckets[bucket][idx]
+		if provenance.URI != location || provenance.Generation != object.generation || provenance.Md5Hash != md5Hash(object.content) || provenance.Updated == nil {
+			t.Errorf("provenance of rows from %s: got %+v, want uri %s, generation %d and md5 hash %s", location, provenance, location, object.generation, md5Hash(object.content))
+		}
+	}
+}
+
+func TestCollectBillingReports(t *testing.T) {
+	gzipped := func(content string) []byte {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, _ = w.Write([]byte(content))
+		_ = w.Close()
+		return buf.Bytes()
+	}
+	usEast := `{"billing_account_id":"A","cost":1.5}
+{"billing_account_id":"A","cost":2.5}
+`
+	europe := `{"billing_account_id":"B","cost":3}
+`
+	server := newFakeGcsServer(t, map[string][]fakeObject{
+		"billing-us": {
+			{name: "billing_export_2025-06-07.json.gz", content: gzipped(usEast), generation: 1},
+			{name: "README.txt", content: []byte("not a billing export"), generation: 2},
+		},
+		"billing-eu": {
+			{name: "exports/billing_export_2025-06-07.json.gz", content: gzipped(europe), generation: 3},
+		},
+	})
+
+	metadata, err := (&billing_report.BillingReportTable{}).GetSourceMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := getSourceOptions(t, metadata)
+
+	sourceConfig := fmt.Sprintf(`
+bucket   = "billing-us"
+endpoint = %q
+
+location {
+  bucket = "billing-eu"
+  prefix = "exports/"
+}
+`, server.endpoint())
+
+	got := collect(t, sourceConfig, "without_authentication = true\n", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Now(), opts)
+	assertRows(t, got, map[string][]string{
+		"gs://billing-us/billing_export_2025-06-07.json.gz":         strings.Split(strings.TrimSpace(usEast), "\n"),
+		"gs://billing-eu/exports/billing_export_2025-06-07.json.gz": strings.Split(strings.TrimSpace(europe), "\n"),
+	})
+}
+
+func TestCollectFromInventoryReport(t *testing.T) {
+	activity := `{"logName":"projects/p/logs/cloudaudit.googleapis.com%2Factivity","insertId":"1"}
+`
+	snapshot := time.Date(2025, 6, 9, 0, 0, 0, 0, time.UTC)
+	manifest := func(shards ...string) []byte {
+		shardNames, _ := json.Marshal(shards)
+		return []byte(fmt.Sprintf(`{
+  "report_config": {"csvOptions": {"delimiter": ",", "headerRequired": true}},
+  "records_processed": 4,
+  "snapshot_time": %q,
+  "shard_count": %d,
+  "report_shards_file_names": %s
+}`, snapshot.Format(time.RFC3339), len(shards), shardNames))
+	}
+	// the objects are not sorted across the shards, so the earliest object is in the last shard
+	header := "bucket,name,size,storageClass,timeCreated,updated,softDeleteTime\n"
+	report := header + `audit-logs,cloudaudit.googleapis.com/activity/2025/06/08/00:00:00_00:59:59_S0.json,100,COLDLINE,2025-06-08T01:00:00Z,2025-06-08T01:00:00Z,
+audit-logs,cloudaudit.googleapis.com/activity/2025/06/08/01:00:00_01:59:59_S0.json,100,STANDARD,2025-06-08T02:00:00Z,2025-06-08T02:00:00Z,2025-06-08T03:00:00Z
+other-bucket,cloudaudit.googleapis.com/activity/2025/06/08/00:00:00_00:59:59_S0.json,100,STANDARD,2025-06-08T01:00:00Z,2025-06-08T01:00:00Z,
+`
+	secondShard := header + `audit-logs,cloudaudit.googleapis.com/activity/2025/06/07/00:00:00_00:59:59_S0.json,100,STANDARD,2025-06-07T01:00:00Z,2025-06-07T01:00:00Z,
+`
+	server := newFakeGcsServer(t, map[string][]fakeObject{
+		"audit-logs": {
+			{name: "cloudaudit.googleapis.com/activity/2025/06/07/00:00:00_00:59:59_S0.json", content: []byte(activity), generation: 1},
+			{name: "cloudaudit.googleapis.com/activity/2025/06/08/00:00:00_00:59:59_S0.json", content: []byte(activity), generation: 2},
+			// created after the report snapshot, so not discovered
+			{name: "cloudaudit.googleapis.com/activity/2025/06/10/00:00:00_00:59:59_S0.json", content: []byte(activity), generation: 3},
+		},
+		"reports": {
+			// an older report, which must not be read
+			{name: "inventory/cfg_2025-06-08T00:00_manifest.json", content: manifest("cfg_2025-06-08T00:00_0.csv"), generation: 4, created: snapshot.Add(-24 * time.Hour)},
+			{name: "inventory/cfg_2025-06-09T00:00_manifest.json", content: manifest("cfg_2025-06-09T00:00_0.csv", "cfg_2025-06-09T00:00_1.csv"), generation: 5, created: snapshot},
+			{name: "inventory/cfg_2025-06-09T00:00_0.csv", content: []byte(report), generation: 6, created: snapshot},
+			{name: "inventory/cfg_2025-06-09T00:00_1.csv", content: []byte(secondShard), generation: 7, created: snapshot},
+		},
+	})
+
+	metadata, err := (&audit_log.AuditLogTable{}).GetSourceMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := getSourceOptions(t, metadata)
+
+	from := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC)
+	wantRows := strings.Split(strings.TrimSpace(activity), "\n")
+
+	tests := []struct {
+		name         string
+		sourceConfig string
+		want         map[string][]string
+	}{
+		{
+			name: "latest report",
+			sourceConfig: `
+inventory_report {
+  bucket = "reports"
+  prefix = "inventory/"
+}
+`,
+			want: map[string][]string{
+				"gs://audit-logs/cloudaudit.googleapis.com/activity/2025/06/07/00:00:00_00:59:59_S0.json": wantRows,
+				"gs://audit-logs/cloudaudit.googleapis.com/activity/2025/06/08/00:00:00_00:59:59_S0.json": wantRows,
+			},
+		},
+		{
+			name: "object filters",
+			sourceConfig: `
+storage_classes = ["STANDARD"]
+
+inventory_report {
+  bucket           = "reports"
+  prefix           = "inventory/"
+  report_config_id = "cfg"
+}
+`,
+			want: map[string][]string{
+				"gs://audit-logs/cloudaudit.googleapis.com/activity/2025/06/07/00:00:00_00:59:59_S0.json": wantRows,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sourceConfig := fmt.Sprintf("bucket = \"audit-logs\"\nendpoint = %q\n%s", server.endpoint(), tt.sourceConfig)
+			assertRows(t, collect(t, sourceConfig, "without_authentication = true\n", from, to, opts), tt.want)
+		})
+	}
+}
+
+func TestCollectStorageInventory(t *testing.T) {
+	csvReport := `bucket,name,size,storageClass,kmsKeyName,retentionExpirationTime
+data,a.txt,10,STANDARD,projects/p/locations/us/keyRings/r/cryptoKeys/k,2030-01-01T00:00:00Z
+data,b/c.txt,20,ARCHIVE,,
+`
+
+	// a Parquet report, with a timestamp column
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "bucket", Type: arrow.BinaryTypes.String},
+		{Name: "name", Type: arrow.BinaryTypes.String},
+		{Name: "size", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "timeCreated", Type: &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}, Nullable: true},
+	}, nil)
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer builder.Release()
+	builder.Field(0).(*array.StringBuilder).AppendValues([]string{"logs", "logs"}, nil)
+	builder.Field(1).(*array.StringBuilder).AppendValues([]string{"x.json", "y.json"}, nil)
+	builder.Field(2).(*array.Int64Builder).AppendValues([]int64{1, 2}, nil)
+	builder.Field(3).(*array.TimestampBuilder).AppendValues([]arrow.Timestamp{arrow.Timestamp(time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC).UnixMicro())}, nil)
+	builder.Field(3).(*array.TimestampBuilder).AppendNull()
+	record := builder.NewRecord()
+	defer record.Release()
+	var parquetReport bytes.Buffer
+	if err := pqarrow.WriteTable(array.NewTableFromRecords(schema, []arrow.Record{record}), &parquetReport, 1024, nil, pqarrow.DefaultWriterProps()); err != nil {
+		t.Fatal(err)
+	}
+
+	server := newFakeGcsServer(t, map[string][]fakeObject{
+		"reports": {
+			{name: "cfg_2025-06-09T00:00_manifest.json", content: []byte(`{}`), generation: 1},
+			{name: "cfg_2025-06-09T00:00_0.csv", content: []byte(csvReport), generation: 2},
+			{name: "cfg_2025-06-09T00:00_1.parquet", content: parquetReport.Bytes(), generation: 3},
+		},
+	})
+
+	metadata, err := (&storage_inventory.StorageInventoryTable{}).GetSourceMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := getSourceOptions(t, metadata)
+
+	sourceConfig := fmt.Sprintf("bucket = \"reports\"\nendpoint = %q\n", server.endpoint())
+	got := collect(t, sourceConfig, "without_authentication = true\n", time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC), opts)
+	assertRows(t, got, map[string][]string{
+		"gs://reports/cfg_2025-06-09T00:00_0.csv":     {"a.txt", "b/c.txt"},
+		"gs://reports/cfg_2025-06-09T00:00_1.parquet": {"x.json", "y.json"},
+	})
+}
+
+// auditLogLayout is the default file layout of the audit log table
+const auditLogLayout = "cloudaudit.googleapis.com/%{DATA:type}/%{YEAR:year}/%{MONTHNUM:month}/%{MONTHDAY:day}/%{HOUR:hour}:%{MINUTE:minute}:%{SECOND:second}_%{DATA:end_time}_%{DATA:suffix}.json"
+
+func TestCollectIncrementalListing(t *testing.T) {
+	activity := `{"logName":"projects/p/logs/cloudaudit.googleapis.com%2Factivity","insertId":"1"}
+`
+	first := "cloudaudit.googleapis.com/activity/2025/06/07/00:00:00_00:59:59_S0.json"
+	second := "cloudaudit.googleapis.com/activity/2025/06/07/01:00:00_01:59:59_S0.json"
+	third := "cloudaudit.googleapis.com/activity/2025/06/08/00:00:00_00:59:59_S0.json"
+	server := newFakeGcsServer(t, map[string][]fakeObject{
+		"audit-logs": {
+			{name: first, content: []byte(activity), generation: 1},
+			{name: second, content: []byte(activity), generation: 2},
+		},
+	})
+
+	metadata, err := (&audit_log.AuditLogTable{}).GetSourceMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := getSourceOptions(t, metadata)
+	from := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC)
+	// the file layout is set, so the collection state has the granularity of the layout
+	sourceConfig := fmt.Sprintf("bucket = \"audit-logs\"\nendpoint = %q\nincremental_listing = true\nfile_layout = %q\n", server.endpoint(), strings.ReplaceAll(auditLogLayout, "%{", "%%{"))
+	connectionConfig := "without_authentication = true\n"
+	statePath := filepath.Join(t.TempDir(), "collection_state.json")
+	rows := strings.Split(strings.TrimSpace(activity), "\n")
+
+	// the first collection lists the whole bucket, and stores the last object collected
+	collector := collectWithState(t, statePath, sourceConfig, connectionConfig, from, time.Date(2025, 6, 8, 0, 0, 0, 0, time.UTC), opts)
+	assertRows(t, collector.rows, map[string][]string{
+		"gs://audit-logs/" + first:  rows,
+		"gs://audit-logs/" + second: rows,
+	})
+	for _, listing := range server.listings {
+		if listing.startOffset != "" {
+			t.Errorf("first collection listed %s from %q, want the whole directory", listing.prefix, listing.startOffset)
+		}
+	}
+
+	// the last object collected is stored for the directory of the log type
+	assertLastObjectNames(t, statePath, map[string]string{
+		"gs://audit-logs/cloudaudit.googleapis.com/activity/": second,
+	})
+
+	// the next collection lists the directory from the last object collected, which is not collected again,
+	// and collects the object written since
+	server.buckets["audit-logs"] = append(server.buckets["audit-logs"], fakeObject{name: third, content: []byte(activity), generation: 3})
+	server.listings = nil
+	collector = collectWithState(t, statePath, sourceConfig, connectionConfig, from, to, opts)
+	assertRows(t, collector.rows, map[string][]string{
+		"gs://audit-logs/" + third: rows,
+	})
+	assertListedFrom(t, server.listings, map[string]string{
+		"cloudaudit.googleapis.com/activity/": second,
+	})
+}
+
+func TestCollectIncrementalListingDirectories(t *testing.T) {
+	activity := `{"logName":"projects/p/logs/cloudaudit.googleapis.com%2Factivity","insertId":"1"}
+`
+	rows := strings.Split(strings.TrimSpace(activity), "\n")
+	// each log type is written to its own directory, so an object written to the activity directory sorts before
+	// objects already collected from the data_access directory
+	activityFirst := "cloudaudit.googleapis.com/activity/2025/06/07/00:00:00_00:59:59_S0.json"
+	dataAccessFirst := "cloudaudit.googleapis.com/data_access/2025/06/07/01:00:00_01:59:59_S0.json"
+	activitySecond := "cloudaudit.googleapis.com/activity/2025/06/08/01:00:00_01:59:59_S0.json"
+	dataAccessSecond := "cloudaudit.googleapis.com/data_access/2025/06/08/02:00:00_02:59:59_S0.json"
+
+	metadata, err := (&audit_log.AuditLogTable{}).GetSourceMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := getSourceOptions(t, metadata)
+
+	tests := []struct {
+		name string
+		from time.Time
+	}{
+		// the collection is within a single month, so each log type directory is listed with a glob
+		{name: "glob listing", from: time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)},
+		// the collection spans years, so the directories are walked
+		{name: "directory walk", from: time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeGcsServer(t, map[string][]fakeObject{
+				"audit-logs": {
+					{name: activityFirst, content: []byte(activity), generation: 1},
+					{name: dataAccessFirst, content: []byte(activity), generation: 2},
+				},
+			})
+			sourceConfig := fmt.Sprintf("bucket = \"audit-logs\"\nendpoint = %q\nincremental_listing = true\nfile_layout = %q\n", server.endpoint(), strings.ReplaceAll(auditLogLayout, "%{", "%%{"))
+			connectionConfig := "without_authentication = true\n"
+			statePath := filepath.Join(t.TempDir(), "collection_state.json")
+
+			collector := collectWithState(t, statePath, sourceConfig, connectionConfig, tt.from, time.Date(2025, 6, 8, 0, 0, 0, 0, time.UTC), opts)
+			assertRows(t, collector.rows, map[string][]string{
+				"gs://audit-logs/" + activityFirst:   rows,
+				"gs://audit-logs/" + dataAccessFirst: rows,
+			})
+			assertLastObjectNames(t, statePath, map[string]string{
+				"gs://audit-logs/cloudaudit.googleapis.com/activity/":    activityFirst,
+				"gs://audit-logs/cloudaudit.googleapis.com/data_access/": dataAccessFirst,
+			})
+
+			// each directory is listed from the last object collected from it, so the object written to the
+			// activity directory is collected although it sorts before the last data_access object
+			server.buckets["audit-logs"] = append(server.buckets["audit-logs"],
+				fakeObject{name: activitySecond, content: []byte(activity), generation: 3},
+				fakeObject{name: dataAccessSecond, content: []byte(activity), generation: 4},
+			)
+			server.listings = nil
+			collector = collectWithState(t, statePath, sourceConfig, connectionConfig, tt.from, time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC), opts)
+			assertRows(t, collector.rows, map[string][]string{
+				"gs://audit-logs/" + activitySecond:   rows,
+				"gs://audit-logs/" + dataAccessSecond: rows,
+			})
+			assertListedFrom(t, server.listings, map[string]string{
+				"cloudaudit.googleapis.com/activity/":    activityFirst,
+				"cloudaudit.googleapis.com/data_access/": dataAccessFirst,
+			})
+		})
+	}
+}
+
+// assertLastObjectNames asserts the last object names saved in the collection state
+func assertLastObjectNames(t *testing.T, statePath string, want map[string]string) {
+	t.Helper()
+
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved struct {
+		State struct {
+			LastObjectNames map[string]string `json:"last_object_names"`
+		} `json:"state"`
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(saved.State.LastObjectNames, want) {
+		t.Errorf("last object names = %v, want %v", saved.State.LastObjectNames, want)
+	}
+}
+
+// assertListedFrom asserts that each listing of the directories (or a directory under them) was from the start offset
+// of the directory, that each directory was listed, and that any other listings were from the start
+func assertListedFrom(t *testing.T, listings []fakeListing, want map[string]string) {
+	t.Helper()
+
+	listed := make(map[string]bool)
+	for _, listing := range listings {
+		wantOffset := ""
+		for dir, startOffset := range want {
+			if strings.HasPrefix(listing.prefix, dir) {
+				wantOffset = startOffset
+				listed[dir] = true
+			}
+		}
+		if listing.startOffset != wantOffset {
+			t.Errorf("listed %s from %q, want %q", listing.prefix, listing.startOffset, wantOffset)
+		}
+	}
+	for dir := range want {
+		if !listed[dir] {
+			t.Errorf("did not list %s", dir)
+		}
+	}
+}
+
+func TestCollectStreamingReadFailure(t *testing.T) {
+	activity := `{"logName":"projects/p/logs/cloudaudit.googleapis.com%2Factivity","insertId":"1"}
+{"logName":"projects/p/logs/cloudaudit.googleapis.com%2Factivity","insertId":"2"}
+`
+	first := "cloudaudit.googleapis.com/activity/2025/06/07/00:00:00_00:59:59_S0.json"
+	second := "cloudaudit.googleapis.com/activity/2025/06/07/01:00:00_01:59:59_S0.json"
+	server := newFakeGcsServer(t, map[string][]fakeObject{
+		"audit-logs": {
+			{name: first, content: []byte(activity), generation: 1},
+			{name: second, content: []byte(activity), generation: 2, truncated: true},
+		},
+	})
+
+	metadata, err := (&audit_log.AuditLogTable{}).GetSourceMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := getSourceOptions(t, metadata)
+	from := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC)
+	sourceConfig := fmt.Sprintf("bucket = \"audit-logs\"\nendpoint = %q\nstreaming = true\nfile_layout = %q\n", server.endpoint(), strings.ReplaceAll(auditLogLayout, "%{", "%%{"))
+	connectionConfig := "without_authentication = true\n"
+	statePath := filepath.Join(t.TempDir(), "collection_state.json")
+
+	// the failed read is raised as an error, and the object is not recorded as collected
+	collector := collectWithState(t, statePath, sourceConfig, connectionConfig, from, to, opts)
+	if len(collector.errs) != 1 || !strings.Contains(collector.errs[0].Error(), "error reading object stream gs://audit-logs/"+second) {
+		t.Errorf("errors = %v, want an error reading %s", collector.errs, second)
+	}
+	assertRows(t, map[string][]string{"gs://audit-logs/" + first: collector.rows["gs://audit-logs/"+first]}, map[string][]string{
+		"gs://audit-logs/" + first: strings.Split(strings.TrimSpace(activity), "\n"),
+	})
+
+	// the next collection collects the object again
+	server.buckets["audit-logs"][1].truncated = false
+	collector = collectWithState(t, statePath, sourceConfig, connectionConfig, from, to, opts)
+	if len(collector.errs) > 0 {
+		t.Fatalf("errors collecting: %v", collector.errs)
+	}
+	assertRows(t, collector.rows, map[string][]string{
+		"gs://audit-logs/" + second: strings.Split(strings.TrimSpace(activity), "\n"),
+	})
+}
+
+func TestCollectRequesterPays(t *testing.T) {
+	activity := `{"logName":"projects/p/logs/cloudaudit.googleapis.com%2Factivity","insertId":"1"}
+`
+	name := "cloudaudit.googleapis.com/activity/2025/06/07/00:00:00_00:59:59_S0.json"
+	server := newFakeGcsServer(t, map[string][]fakeObject{
+		"paid-logs": {{name: name, content: []byte(activity), generation: 1}},
+	})
+	server.requesterPays = map[string]bool{"paid-logs": true}
+
+	metadata, err := (&audit_log.AuditLogTable{}).GetSourceMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := getSourceOptions(t, metadata)
+	from := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC)
+	connectionConfig := "without_authentication = true\n"
+
+	t.Run("user project", func(t *testing.T) {
+		sourceConfig := fmt.Sprintf("bucket = \"paid-logs\"\nendpoint = %q\nuser_project = \"billing-project\"\n", server.endpoint())
+		collector := collectRows(t, sourceConfig, connectionConfig, from, to, opts)
+		assertRows(t, collector.rows, map[string][]string{
+			"gs://paid-logs/" + name: strings.Split(strings.TrimSpace(activity), "\n"),
+		})
+
+		server.userProjectMut.Lock()
+		defer server.userProjectMut.Unlock()
+		if len(server.listUserProjects) == 0 || len(server.readUserProjects) == 0 {
+			t.Fatalf("got %d list and %d read requests, want at least one of each", len(server.listUserProjects), len(server.readUserProjects))
+		}
+		for _, userProject := range slices.Concat(server.listUserProjects, server.readUserProjects) {
+			if userProject != "billing-project" {
+				t.Errorf("request was billed to user project %q, want billing-project", userProject)
+			}
+		}
+	})
+
+	t.Run("no user project", func(t *testing.T) {
+		// an empty user_project means no user project is sent
+		sourceConfig := fmt.Sprintf("bucket = \"paid-logs\"\nendpoint = %q\nuser_project = \"\"\n", server.endpoint())
+		ctx := context_values.WithExecutionId(context.Background(), "test")
+		params := &row_source.RowSourceParams{
+			SourceConfigData:    types.NewSourceConfigData([]byte(sourceConfig), hcl.Range{}, storage_bucket.GcpStorageBucketSourceIdentifier),
+			ConnectionData:      types.NewConnectionConfigData([]byte(connectionConfig), hcl.Range{}, config.PluginName),
+			CollectionStatePath: filepath.Join(t.TempDir(), "collection_state.json"),
+			CollectionTempDir:   t.TempDir(),
+			From:                from,
+			To:                  to,
+		}
+		source := &storage_bucket.GcpStorageBucketSource{}
+		source.RegisterSource(source)
+		if err := source.Init(ctx, params, opts...); err != nil {
+			t.Fatalf("error initializing source: %s", err)
+		}
+		defer source.Close()
+
+		err := source.Collect(ctx)
+		if err == nil || !strings.Contains(err.Error(), "bucket paid-logs is a requester pays bucket - set user_project") {
+			t.Errorf("Collect() error = %v, want the requester pays error", err)
+		}
+	})
+}
@@ -0,0 +1,244 @@
+package storage_bucket
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+
+	"github.com/turbot/tailpipe-plugin-sdk/types"
+)
+
+const (
+	ObjectStreamLoaderIdentifier = "gcp_storage_object_stream_loader"
+
+	// the maximum length of a line read from a streamed object
+	maxStreamLineSize = 16 * 1024 * 1024
+)
+
+// canStream returns whether the object can be streamed to the row pipeline, rather than downloaded to a temp file
+// zip archives require random access, and zstd is not supported, so these are always downloaded
+func (s *GcpStorageBucketSource) canStream(objectName string) bool {
+	if !s.streaming {
+		return false
+	}
+	switch filepath.Ext(objectName) {
+	case ".zip", ".zst":
+		return false
+	}
+	return true
+}
+
+// streamArtifact opens a reader for the object and passes it to the row pipeline without writing it to disk
+// the reader is stored, to be read by the objectStreamLoader when the artifact is loaded
+func (s *GcpStorageBucketSource) streamArtifact(ctx context.Context, info *types.ArtifactInfo) error {
+	obj, err := s.getObjectHandle(ctx, info)
+	if err != nil {
+		return err
+	}
+
+	// the read slot is held until the stream has been loaded
+	if err := s.downloadLimiter.Wait(ctx); err != nil {
+		return fmt.Errorf("error acquiring download limiter: %w", err)
+	}
+
+	var reader *storage.Reader
+	err = s.readWithRetry(ctx, info.Name, func() error {
+		var err error
+		reader, err = obj.NewReader(ctx)
+		return err
+	})
+	if err != nil {
+		s.downloadLimiter.Release()
+		if rpErr := s.requesterPaysError(obj.BucketName(), err); rpErr != nil {
+			return rpErr
+		}
+		return fmt.Errorf("failed to get object reader: %s", err.Error())
+	}
+
+	stream := &objectStream{
+		ctx:    ctx,
+		source: s,
+		obj:    obj,
+		reader: reader,
+	}
+	// ensure any reads after a retry are from the same generation of the object
+	if reader.Attrs.Generation > 0 {
+		stream.obj = obj.Generation(reader.Attrs.Generation)
+	}
+
+	if err := s.setProvenance(info, reader.Attrs); err != nil {
+		s.downloadLimiter.Release()
+		_ = reader.Close()
+		return err
+	}
+
+	// the artifact path is the object URL, which identifies the stream
+	localName := info.Name
+	s.streams.Store(localName, stream)
+
+	// the artifact is recorded as collected by the loader, once the stream has been read to the end
+	state, _ := s.CollectionState.State.(*StorageBucketCollectionState)
+	if state != nil {
+		state.OnStreamStarted(info.Identifier())
+	}
+
+	downloadInfo := types.NewDownloadedArtifactInfo(info, localName, reader.Attrs.Size)
+	if err := s.OnArtifactDownloaded(ctx, downloadInfo); err != nil {
+		s.streams.Delete(localName)
+		stream.Close()
+		if state != nil {
+			state.OnStreamFailed(info.Identifier())
+		}
+		return err
+	}
+	return nil
+}
+
+// objectStream is an object reader which resumes from the current offset if the connection fails part way through
+// (objects which Cloud Storage decompresses when read are served whole, so cannot be resumed)
+type objectStream struct {
+	ctx    context.Context
+	source *GcpStorageBucketSource
+	obj    *storage.ObjectHandle
+	reader *storage.Reader
+	offset int64
+	resets int
+}
+
+func (o *objectStream) Read(p []byte) (int, error) {
+	n, err := o.reader.Read(p)
+	o.offset += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	if o.reader.Attrs.Decompressed || o.resets >= maxDownloadRetries || !storage.ShouldRetry(err) {
+		return n, err
+	}
+
+	o.resets++
+	slog.Warn("Resuming object stream", "object", o.obj.ObjectName(), "offset", o.offset, "attempt", o.resets, "error", err)
+	_ = o.reader.Close()
+	reader, openErr := o.obj.NewRangeReader(o.ctx, o.offset, -1)
+	if openErr != nil {
+		return n, fmt.Errorf("error resuming object stream at offset %d: %w (after %w)", o.offset, openErr, err)
+	}
+	// keep the attributes of the original reader, which describe the whole object
+	reader.Attrs = o.reader.Attrs
+	o.reader = reader
+	return n, nil
+}
+
+// Close closes the reader and releases the read slot
+func (o *objectStream) Close() {
+	_ = o.reader.Close()
+	o.source.downloadLimiter.Release()
+}
+
+// lineReader returns a reader for the content of the object, decompressing it if it is gzipped
+// (Cloud Storage decompresses objects with a Content-Encoding of gzip when they are read, unless the
+// client accepts gzip encoding, so we only need to decompress objects which were not decompressed by the server)
+func (o *objectStream) lineReader() (io.ReadCloser, error) {
+	attrs := o.reader.Attrs
+	gzipped := strings.EqualFold(attrs.ContentEncoding, "gzip") || filepath.Ext(o.obj.ObjectName()) == ".gz"
+	if !gzipped || attrs.Decompressed {
+		return io.NopCloser(o), nil
+	}
+	return gzip.NewReader(o)
+}
+
+// objectStreamLoader is an [artifact_loader.Loader] which reads the rows of streamed objects directly from
+// Cloud Storage, a line at a time - objects which were downloaded to a temp file are loaded with the SDK loaders
+type objectStreamLoader struct {
+	source *GcpStorageBucketSource
+}
+
+func (l *objectStreamLoader) Identifier() string {
+	return ObjectStreamLoaderIdentifier
+}
+
+func (l *objectStreamLoader) Load(ctx context.Context, info *types.DownloadedArtifactInfo, dataChan chan *types.RowData) error {
+	s, ok := l.source.streams.LoadAndDelete(info.LocalName)
+	if !ok {
+		return l.loadFile(ctx, info, dataChan)
+	}
+	stream := s.(*objectStream)
+
+	reader, err := stream.lineReader()
+	if err != nil {
+		stream.Close()
+		l.onStreamFailed(ctx, info)
+		return fmt.Errorf("error creating gzip reader for %s: %w", info.LocalName, err)
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, maxStreamLineSize)
+
+	go func() {
+		defer close(dataChan)
+
+		err := l.readLines(ctx, scanner, dataChan)
+		reader.Close()
+		stream.Close()
+
+		if err != nil {
+			// the rows already read have been passed to the row pipeline, but the object is not recorded as collected,
+			// so it is collected again by the next collection
+			l.onStreamFailed(ctx, info)
+			l.source.notifyError(ctx, fmt.Errorf("error reading object stream %s, %w", info.LocalName, err))
+			return
+		}
+		if err := l.onStreamCompleted(ctx, info); err != nil {
+			l.source.notifyError(ctx, fmt.Errorf("error updating collection state for object stream %s, %w", info.LocalName, err))
+		}
+	}()
+	return nil
+}
+
+// readLines passes each line read by the scanner to the row pipeline, returning an error if the object could not be
+// read to the end, or the collection was cancelled
+func (l *objectStreamLoader) readLines(ctx context.Context, scanner *bufio.Scanner, dataChan chan *types.RowData) error {
+	for scanner.Scan() {
+		// check context cancellation
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		dataChan <- &types.RowData{
+			Data: scanner.Text(),
+		}
+	}
+	return scanner.Err()
+}
+
+// onStreamCompleted records the streamed object as collected, once it has been read to the end
+func (l *objectStreamLoader) onStreamCompleted(ctx context.Context, info *types.DownloadedArtifactInfo) error {
+	l.source.notifyError(ctx, l.source.deleteRestoredObject(context.WithoutCancel(ctx), &info.ArtifactInfo))
+	if state, ok := l.source.CollectionState.State.(*StorageBucketCollectionState); ok {
+		state.OnStreamCompleted(info.Identifier())
+		if err := l.source.CollectionState.OnCollected(info.Identifier(), info.Timestamp); err != nil {
+			return fmt.Errorf("error updating collection state: %w", err)
+		}
+	}
+	l.source.onObjectCollected(&info.ArtifactInfo)
+	return nil
+}
+
+// onStreamFailed records that the streamed object could not be read to the end, so it is collected again
+func (l *objectStreamLoader) onStreamFailed(ctx context.Context, info *types.DownloadedArtifactInfo) {
+	l.source.notifyError(ctx, l.source.deleteRestoredObject(context.WithoutCancel(ctx), &info.ArtifactInfo))
+	if state, ok := l.source.CollectionState.State.(*StorageBucketCollectionState); ok {
+		state.OnStreamFailed(info.Identifier())
+	}
+	l.source.onDownloadFailed()
+}
+
+// loadFile loads an object which was downloaded to a temp file, using the SDK row loader for its extension
+func (l *objectStreamLoader) loadFile(ctx context.Context, info *types.DownloadedArtifactInfo, dataChan chan *types.RowData) error {
+	return (&downloadedObjectLoader{rowPerLine: true}).Load(ctx, info, dataChan)
+}
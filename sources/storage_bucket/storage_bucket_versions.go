@@ -0,0 +1,318 @@
+package storage_bucket
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/elastic/go-grok"
+
+	"github.com/turbot/pipe-fittings/v2/filter"
+	"github.com/turbot/tailpipe-plugin-gcp/config"
+	"github.com/turbot/tailpipe-plugin-sdk/types"
+)
+
+// objectVersion identifies a generation of an object
+type objectVersion struct {
+	bucket         string
+	name           string
+	generation     int64
+	metageneration int64
+	// whether this is a noncurrent version of the object
+	noncurrent bool
+	// whether the object has been soft-deleted
+	softDeleted bool
+	// if the object was soft-deleted, the generation of the restored object
+	restoredGeneration     int64
+	restoredMetageneration int64
+	// the hashes (base64 encoded) and update time of the object, if they were discovered with it
+	md5Hash string
+	crc32c  string
+	updated time.Time
+	// the holds and retention of the object, if they were discovered with it (they are only listed for
+	// soft-deleted objects, to check the restored copy can be deleted)
+	eventBasedHold bool
+	temporaryHold  bool
+	retainUntil    time.Time
+	// closed once the object has been walked, i.e. its discovery has completed
+	discovered chan struct{}
+}
+
+func newObjectVersion(bucket string, attrs *storage.ObjectAttrs, softDeleted bool) objectVersion {
+	version := objectVersion{
+		bucket:         bucket,
+		name:           attrs.Name,
+		generation:     attrs.Generation,
+		metageneration: attrs.Metageneration,
+		noncurrent:     !attrs.Deleted.IsZero(),
+		softDeleted:    softDeleted,
+		md5Hash:        encodeMD5(attrs.MD5),
+		crc32c:         encodeCRC32C(attrs.CRC32C),
+		updated:        attrs.Updated,
+		eventBasedHold: attrs.EventBasedHold,
+		temporaryHold:  attrs.TemporaryHold,
+	}
+	if attrs.Retention != nil {
+		version.retainUntil = attrs.Retention.RetainUntil
+	}
+	return version
+}
+
+// encodeMD5 returns the MD5 hash base64 encoded, as Cloud Storage returns it in JSON and inventory reports
+func encodeMD5(md5 []byte) string {
+	if len(md5) == 0 {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(md5)
+}
+
+// encodeCRC32C returns the CRC32C checksum base64 encoded in big-endian byte order, as Cloud Storage returns it
+// in JSON and inventory reports
+func encodeCRC32C(crc32c uint32) string {
+	if crc32c == 0 {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, crc32c))
+}
+
+// url returns the URL of the object, in the form gs://bucket/object
+func (v objectVersion) url() string {
+	return objectURL(v.bucket, v.name)
+}
+
+// path returns the path the object version is discovered as - this is the object URL for the live version,
+// and the object URL followed by #<generation> for noncurrent and soft-deleted versions
+// (this is the notation Cloud Storage uses for object versions, and ensures each version is a distinct artifact)
+func (v objectVersion) path() string {
+	if (v.noncurrent || v.softDeleted) && v.generation > 0 {
+		return fmt.Sprintf("%s#%d", v.url(), v.generation)
+	}
+	return v.url()
+}
+
+// objectURL returns the URL of the object in the bucket, in the form gs://bucket/object
+func objectURL(bucket, objectName string) string {
+	return fmt.Sprintf("gs://%s/%s", bucket, objectName)
+}
+
+// parseObjectURL returns the bucket and object name from a URL in the form gs://bucket/object
+func parseObjectURL(url string) (string, string) {
+	bucket, objectName, _ := strings.Cut(strings.TrimPrefix(url, "gs://"), "/")
+	return bucket, objectName
+}
+
+// walkObject registers the object version, so it can be read and its provenance recorded, and passes it to WalkNode -
+// if object generations are tracked, the collection state can check whether this generation has been collected
+func (s *GcpStorageBucketSource) walkObject(ctx context.Context, version objectVersion, layouts []string, filterMap map[string]*filter.SqlFilter, g *grok.Grok) error {
+	path := version.path()
+	version.discovered = make(chan struct{})
+	defer close(version.discovered)
+	s.objectVersions.Store(path, version)
+	if s.Config.GetTrackGenerations() {
+		if state, ok := s.CollectionState.State.(*StorageBucketCollectionState); ok {
+			state.OnObjectListed(path, version.url(), version.generation, version.metageneration)
+		}
+	}
+
+	// the layout is applied to the path relative to the bucket
+	return s.WalkNode(ctx, path, objectURL(version.bucket, ""), layouts, false, g, filterMap)
+}
+
+// waitForDiscovery waits until the discovery of the artifact has completed - the SDK starts the download of an
+// artifact before it finishes discovering it, and the two share an error variable, so the download must not complete
+// before the discovery
+func (s *GcpStorageBucketSource) waitForDiscovery(ctx context.Context, info *types.ArtifactInfo) error {
+	discovered := s.getObjectVersion(info).discovered
+	if discovered == nil {
+		return nil
+	}
+	select {
+	case <-discovered:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// getObjectVersion returns the version of the object discovered as the artifact
+func (s *GcpStorageBucketSource) getObjectVersion(info *types.ArtifactInfo) objectVersion {
+	if v, ok := s.objectVersions.Load(info.Name); ok {
+		return v.(objectVersion)
+	}
+	bucket, objectName := parseObjectURL(info.Name)
+	return objectVersion{bucket: bucket, name: objectName}
+}
+
+// getObjectHandle returns the handle to read the object version.
+//
+// Soft-deleted objects cannot be read, so if restore_soft_deleted is set they are first restored - this writes a new
+// live generation of the object to the bucket, which is read instead, and is deleted again by deleteRestoredObject
+// once it has been read. To avoid replacing a live object, an object is only restored if there is no live object
+// with the same name, and to avoid leaving a restored copy in the bucket, only if it has no hold or retention which
+// would prevent the copy being deleted (soft-deleted objects are only listed if the bucket allows this, see
+// checkRestoreAllowed).
+// The generation and metageneration are added to the artifact metadata.
+// The generation is only read if object generations are tracked - otherwise the live object is read.
+func (s *GcpStorageBucketSource) getObjectHandle(ctx context.Context, info *types.ArtifactInfo) (*storage.ObjectHandle, error) {
+	version := s.getObjectVersion(info)
+	obj := s.bucket(version.bucket).Object(version.name)
+	if version.generation == 0 || !s.Config.GetTrackGenerations() {
+		return obj, nil
+	}
+
+	generation := version.generation
+	if version.softDeleted {
+		if err := version.checkRestoreAllowed(); err != nil {
+			return nil, err
+		}
+		attrs, err := obj.Generation(version.generation).If(storage.Conditions{DoesNotExist: true}).Restore(ctx, &storage.RestoreOptions{})
+		if rpErr := s.requesterPaysError(version.bucket, err); rpErr != nil {
+			return nil, rpErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore soft-deleted object %s, %w", version.path(), err)
+		}
+		slog.Info("Restored soft-deleted object", "object", version.url(), "soft_deleted_generation", version.generation, "generation", attrs.Generation)
+
+		// store the restored generation, so once the object has been collected, the restored generation
+		// can be recorded as collected, and is not collected again as a live object
+		version.restoredGeneration = attrs.Generation
+		version.restoredMetageneration = attrs.Metageneration
+		s.objectVersions.Store(info.Name, version)
+		generation = attrs.Generation
+	}
+
+	if info.SourceEnrichment != nil && info.SourceEnrichment.Metadata != nil {
+		info.SourceEnrichment.Metadata["gcs_generation"] = strconv.FormatInt(version.generation, 10)
+		info.SourceEnrichment.Metadata["gcs_metageneration"] = strconv.FormatInt(version.metageneration, 10)
+	}
+
+	return obj.Generation(generation), nil
+}
+
+// checkRestoreAllowed returns an error if the bucket would prevent the restored copies of its soft-deleted objects
+// being deleted once they have been read - i.e. the bucket has a retention policy, or places an event-based hold
+// on new objects
+func (s *GcpStorageBucketSource) checkRestoreAllowed(ctx context.Context, bucket string) error {
+	attrs, err := s.bucket(bucket).Attrs(ctx)
+	if rpErr := s.requesterPaysError(bucket, err); rpErr != nil {
+		return rpErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get the attributes of bucket %s to check soft-deleted objects can be restored, %w", bucket, err)
+	}
+
+	if policy := attrs.RetentionPolicy; policy != nil && policy.RetentionPeriod > 0 {
+		locked := ""
+		if policy.IsLocked {
+			locked = "locked "
+		}
+		return fmt.Errorf("soft-deleted objects in bucket %s are not restored: the bucket has a %sretention policy of %s, which would prevent the restored copies being deleted", bucket, locked, policy.RetentionPeriod)
+	}
+	if attrs.DefaultEventBasedHold {
+		return fmt.Errorf("soft-deleted objects in bucket %s are not restored: the bucket places an event-based hold on new objects, which would prevent the restored copies being deleted", bucket)
+	}
+	return nil
+}
+
+// checkRestoreAllowed returns an error if the soft-deleted object has a hold or retention which would prevent
+// the restored copy being deleted once it has been read
+func (v objectVersion) checkRestoreAllowed() error {
+	var reason string
+	switch {
+	case v.eventBasedHold:
+		reason = "it has an event-based hold"
+	case v.temporaryHold:
+		reason = "it has a temporary hold"
+	case v.retainUntil.After(time.Now()):
+		reason = fmt.Sprintf("it is retained until %s", v.retainUntil.UTC().Format(time.RFC3339))
+	default:
+		return nil
+	}
+	return fmt.Errorf("soft-deleted object %s is not restored: %s, which would prevent the restored copy being deleted", v.path(), reason)
+}
+
+// setProvenance adds the provenance of the object read to the artifact metadata - the generation, checksum and
+// update time returned when reading the object are used, falling back to those the object was discovered with
+// (the MD5 hash is only returned when listing objects, so is only recorded if the object was discovered by a listing
+// or inventory report)
+func (s *GcpStorageBucketSource) setProvenance(info *types.ArtifactInfo, attrs storage.ReaderObjectAttrs) error {
+	if info.SourceEnrichment == nil {
+		return nil
+	}
+	if info.SourceEnrichment.Metadata == nil {
+		info.SourceEnrichment.Metadata = make(map[string]string)
+	}
+
+	version := s.getObjectVersion(info)
+	provenance := config.Provenance{
+		Identity:   s.identity,
+		URI:        version.url(),
+		Generation: version.generation,
+		Md5Hash:    version.md5Hash,
+		Crc32c:     version.crc32c,
+	}
+	// if a different generation was read than was discovered, i.e. the object was replaced since it was listed,
+	// the hashes discovered are not of the object read (a restored soft-deleted object has the same contents)
+	if attrs.Generation > 0 && attrs.Generation != version.generation && attrs.Generation != version.restoredGeneration {
+		provenance.Md5Hash = ""
+		provenance.Crc32c = ""
+	}
+	if attrs.Generation > 0 {
+		provenance.Generation = attrs.Generation
+	}
+	// the checksum returned when reading is of the stored object, which is not the content read if it was decompressed
+	if provenance.Crc32c == "" && !attrs.Decompressed {
+		provenance.Crc32c = encodeCRC32C(attrs.CRC32C)
+	}
+	updated := version.updated
+	if !attrs.LastModified.IsZero() {
+		updated = attrs.LastModified
+	}
+	if !updated.IsZero() {
+		updated = updated.UTC()
+		provenance.Updated = &updated
+	}
+
+	return provenance.SetMetadata(info.SourceEnrichment.Metadata)
+}
+
+// deleteRestoredObject deletes the live generation restored to read a soft-deleted object, once it has been read or
+// has failed to be read, so collecting does not leave restored objects in the bucket (in a bucket with soft delete
+// enabled, deleting it soft-deletes it again) - the deletion is made by generation, so only the restored
+// generation is deleted
+func (s *GcpStorageBucketSource) deleteRestoredObject(ctx context.Context, info *types.ArtifactInfo) error {
+	version := s.getObjectVersion(info)
+	if version.restoredGeneration == 0 {
+		return nil
+	}
+	err := s.bucket(version.bucket).Object(version.name).Generation(version.restoredGeneration).Delete(ctx)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("failed to delete restored copy of soft-deleted object %s (generation %d), %w", version.path(), version.restoredGeneration, err)
+	}
+	slog.Info("Deleted restored soft-deleted object", "object", version.url(), "generation", version.restoredGeneration)
+	return nil
+}
+
+// onObjectDownloaded is called once the object version has been downloaded
+// if a soft-deleted object was restored, the restored generation is recorded as collected
+func (s *GcpStorageBucketSource) onObjectDownloaded(info *types.ArtifactInfo) {
+	v, ok := s.objectVersions.LoadAndDelete(info.Name)
+	if !ok {
+		return
+	}
+	version := v.(objectVersion)
+	if version.restoredGeneration == 0 {
+		return
+	}
+	if state, ok := s.CollectionState.State.(*StorageBucketCollectionState); ok {
+		state.AddObjectGeneration(version.url(), version.restoredGeneration, version.restoredMetageneration, info.Timestamp)
+	}
+}
@@ -5,6 +5,7 @@ import (
 
 	"google.golang.org/genproto/googleapis/cloud/audit"
 
+	"github.com/turbot/tailpipe-plugin-gcp/config"
 	"github.com/turbot/tailpipe-plugin-sdk/schema"
 )
 
@@ -43,6 +44,9 @@ type AuditLog struct {
 	Response              map[string]interface{}       `json:"response,omitempty" parquet:"type=JSON"`
 	Metadata              map[string]interface{}       `json:"metadata,omitempty" parquet:"type=JSON"`
 	ServiceData           *map[string]interface{}      `json:"service_data,omitempty" parquet:"type=JSON"`
+
+	// the provenance of the row, recorded by the source it was collected from
+	Provenance *config.Provenance `json:"provenance,omitempty" parquet:"type=JSON"`
 }
 
 func NewAuditLog() *AuditLog {
@@ -154,6 +158,7 @@ func (a *AuditLog) GetColumnDescriptions() map[string]string {
 		"response":                "The response data returned by the service, in JSON format.",
 		"metadata":                "Additional metadata related to the log entry, in JSON format.",
 		"service_data":            "Additional service-specific data related to the event, in JSON format.",
+		"provenance":              "The provenance of the row, including the identity it was collected as, and the API request or Cloud Storage object it was collected from, in JSON format.",
 
 		// Override table specific tp_* column descriptions
 		"tp_index": "The GCP project.",
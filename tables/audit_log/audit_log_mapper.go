@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"cloud.google.com/go/logging"
+	logpb "cloud.google.com/go/logging/apiv2/loggingpb"
 	"google.golang.org/genproto/googleapis/cloud/audit"
 	adminpb "google.golang.org/genproto/googleapis/iam/admin/v1"
 	loggingpb "google.golang.org/genproto/googleapis/iam/v1/logging"
@@ -32,10 +33,12 @@ func (m *AuditLogMapper) Map(_ context.Context, a any, _ ...mappers.MapOption[*A
 		return mapFromBucketJson([]byte(v))
 	case logging.Entry:
 		return mapFromSDKType(v)
+	case *logpb.LogEntry:
+		return mapFromProto(v)
 	case []byte:
 		return mapFromBucketJson(v)
 	default:
-		return nil, fmt.Errorf("expected logging.Entry, string or []byte, got %T", a)
+		return nil, fmt.Errorf("expected logging.Entry, *loggingpb.LogEntry, string or []byte, got %T", a)
 	}
 
 }
@@ -72,6 +75,16 @@ func decodeServiceData(tu string, v []byte) (*map[string]interface{}, error) {
 	return &result, nil
 }
 
+// mapFromProto maps a log entry streamed by the tail API
+// the JSON representation of a log entry is the same format written to storage buckets by log sinks
+func mapFromProto(item *logpb.LogEntry) (*AuditLog, error) {
+	itemBytes, err := protojson.Marshal(item)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling log entry to JSON: %w", err)
+	}
+	return mapFromBucketJson(itemBytes)
+}
+
 func mapFromSDKType(item logging.Entry) (*AuditLog, error) {
 	row := NewAuditLog()
 	row.Timestamp = item.Timestamp
@@ -6,6 +6,7 @@ import (
 	"github.com/rs/xid"
 
 	"github.com/turbot/pipe-fittings/v2/utils"
+	"github.com/turbot/tailpipe-plugin-gcp/config"
 	"github.com/turbot/tailpipe-plugin-gcp/sources/audit_log_api"
 	"github.com/turbot/tailpipe-plugin-gcp/sources/storage_bucket"
 	"github.com/turbot/tailpipe-plugin-sdk/artifact_source"
@@ -56,6 +57,12 @@ func (c *AuditLogTable) GetSourceMetadata() ([]*table.SourceMetadata[*AuditLog],
 func (c *AuditLogTable) EnrichRow(row *AuditLog, sourceEnrichmentFields schema.SourceEnrichment) (*AuditLog, error) {
 	row.CommonFields = sourceEnrichmentFields.CommonFields
 
+	provenance, err := config.ProvenanceFromMetadata(sourceEnrichmentFields.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	row.Provenance = provenance
+
 	row.TpID = xid.New().String()
 	row.TpTimestamp = row.Timestamp
 	row.TpIngestTimestamp = time.Now()
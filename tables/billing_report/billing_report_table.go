@@ -2,6 +2,7 @@ package billing_report
 
 import (
 	"github.com/turbot/pipe-fittings/v2/utils"
+	"github.com/turbot/tailpipe-plugin-gcp/config"
 	"github.com/turbot/tailpipe-plugin-gcp/sources/storage_bucket"
 	"github.com/turbot/tailpipe-plugin-sdk/artifact_source"
 	"github.com/turbot/tailpipe-plugin-sdk/artifact_source_config"
@@ -170,6 +171,10 @@ func (t *BillingReportTable) GetTableDefinition() *schema.TableSchema {
 				Type:       "varchar",
 				Transform:  "(project ->> 'number')",
 			},
+			{
+				ColumnName: "provenance",
+				Type:       "json",
+			},
 			{
 				ColumnName: "service_description",
 				Type:       "varchar",
@@ -235,6 +240,23 @@ func (t *BillingReportTable) GetTableDefinition() *schema.TableSchema {
 	}
 }
 
+// EnrichRow adds the provenance of the row, recorded by the source, to the row
+func (t *BillingReportTable) EnrichRow(row *types.DynamicRow, sourceEnrichmentFields schema.SourceEnrichment) (*types.DynamicRow, error) {
+	row, err := t.CustomTableImpl.EnrichRow(row, sourceEnrichmentFields)
+	if err != nil {
+		return nil, err
+	}
+
+	provenance, err := config.ProvenanceFromMetadata(sourceEnrichmentFields.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	if provenance != nil {
+		row.OutputColumns["provenance"] = provenance
+	}
+	return row, nil
+}
+
 func (t *BillingReportTable) GetDescription() string {
 	return "GCP Billing Reports provide detailed cost and usage information for Google Cloud Platform resources. This table includes billing data such as costs, credits, usage metrics, and resource details, helping teams monitor spending, analyze cost trends, and optimize cloud resource usage across projects and services."
 }
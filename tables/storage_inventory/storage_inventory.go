@@ -0,0 +1,90 @@
+package storage_inventory
+
+import (
+	"time"
+
+	"github.com/turbot/tailpipe-plugin-gcp/config"
+	"github.com/turbot/tailpipe-plugin-sdk/schema"
+)
+
+// StorageInventory represents an object in a Storage Insights inventory report
+type StorageInventory struct {
+	// embed required enrichment fields
+	schema.CommonFields
+
+	// Mandatory fields
+	Name        string `json:"name"`
+	SoftDeleted bool   `json:"soft_deleted"`
+
+	// Optional fields
+	SnapshotTime            *time.Time `json:"snapshot_time,omitempty"`
+	Project                 *string    `json:"project,omitempty"`
+	Bucket                  *string    `json:"bucket,omitempty"`
+	Location                *string    `json:"location,omitempty"`
+	Size                    *int64     `json:"size,omitempty"`
+	Generation              *int64     `json:"generation,omitempty"`
+	Metageneration          *int64     `json:"metageneration,omitempty"`
+	StorageClass            *string    `json:"storage_class,omitempty"`
+	ContentType             *string    `json:"content_type,omitempty"`
+	ContentEncoding         *string    `json:"content_encoding,omitempty"`
+	ContentLanguage         *string    `json:"content_language,omitempty"`
+	Etag                    *string    `json:"etag,omitempty"`
+	Md5Hash                 *string    `json:"md5_hash,omitempty"`
+	Crc32c                  *string    `json:"crc32c,omitempty"`
+	KmsKeyName              *string    `json:"kms_key_name,omitempty"`
+	ComponentCount          *int64     `json:"component_count,omitempty"`
+	TimeCreated             *time.Time `json:"time_created,omitempty"`
+	Updated                 *time.Time `json:"updated,omitempty"`
+	TimeDeleted             *time.Time `json:"time_deleted,omitempty"`
+	TimeStorageClassUpdated *time.Time `json:"time_storage_class_updated,omitempty"`
+	CustomTime              *time.Time `json:"custom_time,omitempty"`
+	RetentionExpirationTime *time.Time `json:"retention_expiration_time,omitempty"`
+	TemporaryHold           *bool      `json:"temporary_hold,omitempty"`
+	EventBasedHold          *bool      `json:"event_based_hold,omitempty"`
+	SoftDeleteTime          *time.Time `json:"soft_delete_time,omitempty"`
+	HardDeleteTime          *time.Time `json:"hard_delete_time,omitempty"`
+
+	// the provenance of the row, recorded by the source it was collected from
+	Provenance *config.Provenance `json:"provenance,omitempty" parquet:"type=JSON"`
+}
+
+func NewStorageInventory() *StorageInventory {
+	return &StorageInventory{}
+}
+
+func (s *StorageInventory) GetColumnDescriptions() map[string]string {
+	return map[string]string{
+		"name":                       "The name of the object.",
+		"soft_deleted":               "Indicates whether the object was soft-deleted at the time of the report snapshot.",
+		"snapshot_time":              "The time of the inventory report snapshot the object was listed in.",
+		"project":                    "The number of the project which owns the bucket.",
+		"bucket":                     "The name of the bucket containing the object.",
+		"location":                   "The location of the bucket containing the object, such as 'US' or 'EUROPE-WEST1'.",
+		"size":                       "The size of the object, in bytes.",
+		"generation":                 "The generation of the object.",
+		"metageneration":             "The metageneration of the object, incremented whenever its metadata is updated.",
+		"storage_class":              "The storage class of the object, such as 'STANDARD' or 'ARCHIVE'.",
+		"content_type":               "The content type of the object.",
+		"content_encoding":           "The content encoding of the object, such as 'gzip'.",
+		"content_language":           "The content language of the object.",
+		"etag":                       "The HTTP entity tag of the object.",
+		"md5_hash":                   "The base64 encoded MD5 hash of the object data.",
+		"crc32c":                     "The base64 encoded CRC32C checksum of the object data.",
+		"kms_key_name":               "The Cloud KMS key used to encrypt the object, if it is encrypted with a customer-managed encryption key.",
+		"component_count":            "The number of components the object was composed from, if it is a composite object.",
+		"time_created":               "The time the object was created.",
+		"updated":                    "The time the object metadata was last updated.",
+		"time_deleted":               "The time the object became noncurrent, if it is a noncurrent version.",
+		"time_storage_class_updated": "The time the storage class of the object was last changed.",
+		"custom_time":                "The user-specified custom time of the object.",
+		"retention_expiration_time":  "The earliest time the object can be deleted, under the retention policy of the bucket or the retention configuration of the object.",
+		"temporary_hold":             "Indicates whether the object is under a temporary hold.",
+		"event_based_hold":           "Indicates whether the object is under an event-based hold.",
+		"soft_delete_time":           "The time the object was soft-deleted, if it is soft-deleted.",
+		"hard_delete_time":           "The time a soft-deleted object will be permanently deleted.",
+		"provenance":                 "The provenance of the row, including the identity it was collected as, and the URI, generation, hashes and update time of the inventory report shard it was collected from, in JSON format.",
+
+		// Override table specific tp_* column descriptions
+		"tp_timestamp": "The time of the inventory report snapshot, or the time the report was collected if the snapshot time is not in the report file name.",
+	}
+}
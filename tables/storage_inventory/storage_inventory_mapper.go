@@ -0,0 +1,61 @@
+package storage_inventory
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/turbot/tailpipe-plugin-gcp/sources/storage_bucket"
+	"github.com/turbot/tailpipe-plugin-sdk/mappers"
+)
+
+type StorageInventoryMapper struct {
+}
+
+func (m *StorageInventoryMapper) Identifier() string {
+	return "gcp_storage_inventory_mapper"
+}
+
+func (m *StorageInventoryMapper) Map(_ context.Context, a any, _ ...mappers.MapOption[*StorageInventory]) (*StorageInventory, error) {
+	record, ok := a.(*storage_bucket.InventoryRecord)
+	if !ok {
+		return nil, fmt.Errorf("expected *storage_bucket.InventoryRecord, got %T", a)
+	}
+
+	return &StorageInventory{
+		Name:                    record.Name,
+		SoftDeleted:             record.SoftDeleteTime != nil,
+		Project:                 optionalString(record.Project),
+		Bucket:                  optionalString(record.Bucket),
+		Location:                optionalString(record.Location),
+		Size:                    record.Size,
+		Generation:              record.Generation,
+		Metageneration:          record.Metageneration,
+		StorageClass:            optionalString(record.StorageClass),
+		ContentType:             optionalString(record.ContentType),
+		ContentEncoding:         optionalString(record.ContentEncoding),
+		ContentLanguage:         optionalString(record.ContentLanguage),
+		Etag:                    optionalString(record.Etag),
+		Md5Hash:                 optionalString(record.Md5Hash),
+		Crc32c:                  optionalString(record.Crc32c),
+		KmsKeyName:              optionalString(record.KmsKeyName),
+		ComponentCount:          record.ComponentCount,
+		TimeCreated:             record.TimeCreated,
+		Updated:                 record.Updated,
+		TimeDeleted:             record.TimeDeleted,
+		TimeStorageClassUpdated: record.TimeStorageClassUpdated,
+		CustomTime:              record.CustomTime,
+		RetentionExpirationTime: record.RetentionExpirationTime,
+		TemporaryHold:           record.TemporaryHold,
+		EventBasedHold:          record.EventBasedHold,
+		SoftDeleteTime:          record.SoftDeleteTime,
+		HardDeleteTime:          record.HardDeleteTime,
+	}, nil
+}
+
+// optionalString returns nil for an empty string, as fields not selected in the report configuration are empty
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,93 @@
+package storage_inventory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/turbot/tailpipe-plugin-gcp/sources/storage_bucket"
+)
+
+func TestStorageInventoryMapper(t *testing.T) {
+	size := int64(100)
+	generation := int64(5)
+	created := time.Date(2025, 6, 7, 1, 0, 0, 0, time.UTC)
+	softDeleted := time.Date(2025, 6, 8, 3, 0, 0, 0, time.UTC)
+	hold := true
+
+	tests := []struct {
+		name   string
+		record *storage_bucket.InventoryRecord
+		check  func(t *testing.T, row *StorageInventory)
+	}{
+		{
+			name: "live object",
+			record: &storage_bucket.InventoryRecord{
+				Bucket:        "my-logs",
+				Name:          "logs/a.json",
+				Size:          &size,
+				Generation:    &generation,
+				StorageClass:  "STANDARD",
+				TimeCreated:   &created,
+				TemporaryHold: &hold,
+			},
+			check: func(t *testing.T, row *StorageInventory) {
+				if row.Name != "logs/a.json" || row.Bucket == nil || *row.Bucket != "my-logs" {
+					t.Errorf("name = %q, bucket = %v, want logs/a.json in my-logs", row.Name, row.Bucket)
+				}
+				if row.Size == nil || *row.Size != size || row.Generation == nil || *row.Generation != generation {
+					t.Errorf("size = %v, generation = %v, want %d, %d", row.Size, row.Generation, size, generation)
+				}
+				if row.StorageClass == nil || *row.StorageClass != "STANDARD" {
+					t.Errorf("storage class = %v, want STANDARD", row.StorageClass)
+				}
+				if row.TimeCreated == nil || !row.TimeCreated.Equal(created) {
+					t.Errorf("time created = %v, want %v", row.TimeCreated, created)
+				}
+				if row.TemporaryHold == nil || !*row.TemporaryHold {
+					t.Errorf("temporary hold = %v, want true", row.TemporaryHold)
+				}
+				if row.SoftDeleted {
+					t.Error("soft deleted = true, want false")
+				}
+			},
+		},
+		{
+			name: "soft-deleted object",
+			record: &storage_bucket.InventoryRecord{
+				Name:           "logs/b.json",
+				SoftDeleteTime: &softDeleted,
+			},
+			check: func(t *testing.T, row *StorageInventory) {
+				if !row.SoftDeleted || row.SoftDeleteTime == nil || !row.SoftDeleteTime.Equal(softDeleted) {
+					t.Errorf("soft deleted = %v, soft delete time = %v, want true, %v", row.SoftDeleted, row.SoftDeleteTime, softDeleted)
+				}
+			},
+		},
+		{
+			// fields not selected in the report configuration are empty, and mapped to null
+			name:   "fields not selected",
+			record: &storage_bucket.InventoryRecord{Name: "logs/c.json"},
+			check: func(t *testing.T, row *StorageInventory) {
+				if row.Bucket != nil || row.StorageClass != nil || row.Md5Hash != nil || row.Size != nil {
+					t.Errorf("bucket = %v, storage class = %v, md5 hash = %v, size = %v, want null", row.Bucket, row.StorageClass, row.Md5Hash, row.Size)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			row, err := (&StorageInventoryMapper{}).Map(context.Background(), tt.record)
+			if err != nil {
+				t.Fatalf("Map() error = %v", err)
+			}
+			tt.check(t, row)
+		})
+	}
+}
+
+func TestStorageInventoryMapperInvalidRow(t *testing.T) {
+	if _, err := (&StorageInventoryMapper{}).Map(context.Background(), "bucket,name"); err == nil {
+		t.Error("Map() error = nil, want an error for a row which is not an InventoryRecord")
+	}
+}
@@ -0,0 +1,96 @@
+package storage_inventory
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/turbot/pipe-fittings/v2/utils"
+	"github.com/turbot/tailpipe-plugin-gcp/config"
+	"github.com/turbot/tailpipe-plugin-gcp/sources/storage_bucket"
+	"github.com/turbot/tailpipe-plugin-sdk/artifact_source"
+	"github.com/turbot/tailpipe-plugin-sdk/artifact_source_config"
+	"github.com/turbot/tailpipe-plugin-sdk/constants"
+	"github.com/turbot/tailpipe-plugin-sdk/row_source"
+	"github.com/turbot/tailpipe-plugin-sdk/schema"
+	"github.com/turbot/tailpipe-plugin-sdk/table"
+)
+
+const StorageInventoryTableIdentifier string = "gcp_storage_inventory"
+
+type StorageInventoryTable struct {
+}
+
+func (c *StorageInventoryTable) Identifier() string {
+	return StorageInventoryTableIdentifier
+}
+
+func (c *StorageInventoryTable) GetSourceMetadata() ([]*table.SourceMetadata[*StorageInventory], error) {
+	// inventory report shards are named <report config ID>_<snapshot time>_<shard index>.<csv|parquet>,
+	// alongside a <report config ID>_<snapshot time>_manifest.json manifest, which the layout does not match
+	defaultArtifactConfig := &artifact_source_config.ArtifactSourceConfigImpl{
+		FileLayout: utils.ToStringPointer("%{DATA:report_config_id}_%{YEAR:year}-%{MONTHNUM:month}-%{MONTHDAY:day}T%{HOUR:hour}:%{MINUTE:minute}%{DATA:snapshot_seconds}_%{INT:shard}.%{WORD:format}"),
+	}
+
+	return []*table.SourceMetadata[*StorageInventory]{
+		{
+			SourceName: storage_bucket.GcpStorageBucketSourceIdentifier,
+			Mapper:     &StorageInventoryMapper{},
+			Options: []row_source.RowSourceOption{
+				artifact_source.WithDefaultArtifactSourceConfig(defaultArtifactConfig),
+				artifact_source.WithArtifactLoader(storage_bucket.NewInventoryReportLoader()),
+			},
+		},
+		{
+			SourceName: constants.ArtifactSourceIdentifier,
+			Mapper:     &StorageInventoryMapper{},
+			Options: []row_source.RowSourceOption{
+				artifact_source.WithDefaultArtifactSourceConfig(defaultArtifactConfig),
+				artifact_source.WithArtifactLoader(storage_bucket.NewInventoryReportLoader()),
+			},
+		},
+	}, nil
+}
+
+func (c *StorageInventoryTable) EnrichRow(row *StorageInventory, sourceEnrichmentFields schema.SourceEnrichment) (*StorageInventory, error) {
+	row.CommonFields = sourceEnrichmentFields.CommonFields
+
+	// the snapshot time is taken from the report file name
+	row.SnapshotTime = getSnapshotTime(sourceEnrichmentFields.Metadata)
+
+	provenance, err := config.ProvenanceFromMetadata(sourceEnrichmentFields.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	row.Provenance = provenance
+
+	row.TpID = xid.New().String()
+	row.TpIngestTimestamp = time.Now()
+	if row.SnapshotTime != nil {
+		row.TpTimestamp = *row.SnapshotTime
+	} else {
+		row.TpTimestamp = row.TpIngestTimestamp
+	}
+	row.TpDate = row.TpTimestamp.Truncate(24 * time.Hour)
+
+	if row.Bucket != nil {
+		row.TpAkas = append(row.TpAkas, fmt.Sprintf("gs://%s/%s", *row.Bucket, row.Name))
+	}
+
+	return row, nil
+}
+
+// getSnapshotTime returns the snapshot time from the date fields of the report file layout, if they were matched
+func getSnapshotTime(metadata map[string]string) *time.Time {
+	value := fmt.Sprintf("%s-%s-%sT%s:%s", metadata[constants.TemplateFieldYear], metadata[constants.TemplateFieldMonth], metadata[constants.TemplateFieldDay], metadata[constants.TemplateFieldHour], metadata[constants.TemplateFieldMinute])
+	t, err := time.Parse("2006-1-2T15:4", value)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+func (c *StorageInventoryTable) GetDescription() string {
+	return "GCP Storage Insights inventory reports list the objects in Cloud Storage buckets along with their metadata, including size, storage class, encryption, retention and soft-delete state, supporting data governance and storage optimization."
+}
@@ -0,0 +1,48 @@
+package storage_inventory
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetSnapshotTime(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		want     *time.Time
+	}{
+		{
+			name:     "date fields of the report file name",
+			metadata: map[string]string{"year": "2025", "month": "06", "day": "09", "hour": "00", "minute": "00"},
+			want:     ptr(time.Date(2025, 6, 9, 0, 0, 0, 0, time.UTC)),
+		},
+		{
+			name:     "unpadded date fields",
+			metadata: map[string]string{"year": "2025", "month": "6", "day": "9", "hour": "7", "minute": "5"},
+			want:     ptr(time.Date(2025, 6, 9, 7, 5, 0, 0, time.UTC)),
+		},
+		{
+			name:     "missing date fields",
+			metadata: map[string]string{"year": "2025", "month": "06"},
+		},
+		{
+			name:     "invalid date",
+			metadata: map[string]string{"year": "2025", "month": "13", "day": "09", "hour": "00", "minute": "00"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := getSnapshotTime(tt.metadata)
+			switch {
+			case tt.want == nil && got != nil:
+				t.Errorf("getSnapshotTime() = %v, want nil", got)
+			case tt.want != nil && (got == nil || !got.Equal(*tt.want)):
+				t.Errorf("getSnapshotTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}